@@ -0,0 +1,95 @@
+package main
+
+import (
+	"crypto/subtle"
+	"logagent/collects"
+	"logagent/conf"
+	"net/http"
+	"strconv"
+
+	"github.com/sirupsen/logrus"
+)
+
+// registerAdmin 注册管理接口, 请求需要带上`Authorization: Bearer {token}`
+// 管理接口可以暂停收集和重新读取配置, 没有配置token时不注册
+//
+//	GET  /admin/managers                                   收集器的配置、状态以及正在收集的文件
+//	POST /admin/managers/pause?name={name}                 暂停收集
+//	POST /admin/managers/resume?name={name}                恢复收集
+//	POST /admin/managers/reread?name={name}&path=&offset=  从指定的偏移量重新收集, 默认从头开始
+//	POST /admin/reload                                     立即重新读取etcd的配置
+func registerAdmin(mux *http.ServeMux, token string) {
+	if token == "" {
+		logrus.Warn("Admin token is empty, admin api is disabled")
+		return
+	}
+	handle := func(pattern, method string, h http.HandlerFunc) {
+		mux.HandleFunc(pattern, func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != method {
+				writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+				return
+			}
+			if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer "+token)) != 1 {
+				writeError(w, http.StatusUnauthorized, "unauthorized")
+				return
+			}
+			h(w, r)
+		})
+	}
+	handle("/admin/managers", http.MethodGet, listManagers)
+	handle("/admin/managers/pause", http.MethodPost, pauseManager)
+	handle("/admin/managers/resume", http.MethodPost, resumeManager)
+	handle("/admin/managers/reread", http.MethodPost, rereadManager)
+	handle("/admin/reload", http.MethodPost, reloadConfig)
+}
+
+func listManagers(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, collects.Managers())
+}
+
+func pauseManager(w http.ResponseWriter, r *http.Request) {
+	writeResult(w, collects.Pause(r.URL.Query().Get("name")))
+}
+
+func resumeManager(w http.ResponseWriter, r *http.Request) {
+	writeResult(w, collects.Resume(r.URL.Query().Get("name")))
+}
+
+func rereadManager(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	var offset int64
+	if s := q.Get("offset"); s != "" {
+		var err error
+		offset, err = strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "wrong offset: "+s)
+			return
+		}
+	}
+	writeResult(w, collects.Reread(q.Get("name"), q.Get("path"), offset))
+}
+
+func reloadConfig(w http.ResponseWriter, r *http.Request) {
+	changed, err := conf.ReloadEtcd(collects.UpdateManagers)
+	if err != nil {
+		writeError(w, http.StatusServiceUnavailable, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]bool{"changed": changed})
+}
+
+// writeResult 返回操作的结果
+func writeResult(w http.ResponseWriter, err error) {
+	switch {
+	case err == nil:
+		writeJSON(w, http.StatusOK, map[string]string{"result": "ok"})
+	case err == collects.ErrManagerNotFound:
+		writeError(w, http.StatusNotFound, err.Error())
+	default:
+		writeError(w, http.StatusBadRequest, err.Error())
+	}
+}
+
+func writeError(w http.ResponseWriter, code int, msg string) {
+	writeJSON(w, code, map[string]string{"error": msg})
+}
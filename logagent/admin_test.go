@@ -0,0 +1,41 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// TestAdminAuth 没有配置token时不提供管理接口, 配置了token时没有认证的请求被拒绝
+func TestAdminAuth(t *testing.T) {
+	cases := []struct {
+		token  string
+		header string
+		code   int
+	}{
+		{"", "", http.StatusNotFound},
+		{"", "Bearer ", http.StatusNotFound},
+		{"secret", "", http.StatusUnauthorized},
+		{"secret", "Bearer wrong", http.StatusUnauthorized},
+		{"secret", "secret", http.StatusUnauthorized},
+		// 认证通过, 收集器不存在
+		{"secret", "Bearer secret", http.StatusNotFound},
+	}
+	for _, c := range cases {
+		mux := http.NewServeMux()
+		registerAdmin(mux, c.token)
+		req := httptest.NewRequest(http.MethodPost, "/admin/managers/pause?name=log", nil)
+		if c.header != "" {
+			req.Header.Set("Authorization", c.header)
+		}
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, req)
+		if w.Code != c.code {
+			t.Errorf("token %q, header %q: got %d, want %d", c.token, c.header, w.Code, c.code)
+		}
+		if c.code == http.StatusNotFound && c.token != "" && !strings.Contains(w.Body.String(), "manager not found") {
+			t.Errorf("token %q, header %q: got body %s", c.token, c.header, w.Body.String())
+		}
+	}
+}
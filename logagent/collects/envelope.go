@@ -0,0 +1,143 @@
+package collects
+
+import (
+	"encoding/json"
+	"fmt"
+	"logagent/conf"
+	"strings"
+	"time"
+)
+
+// 消息格式
+const (
+	formatRaw  = "raw"  // 只发送日志内容
+	formatJson = "json" // 发送带有来源信息的信封
+)
+
+// 生产者的发送方式
+const (
+	producerSync  = "sync"
+	producerAsync = "async"
+)
+
+// 分区key的策略, 相同key的消息写入同一个分区, 保证同一个文件的日志有序
+const (
+	keyHostPath = "hostpath" // 主机名+文件路径
+	keyField    = "field:"   // 自定义字段的值, 处理器修改后的字段
+	keyRandom   = "random"   // 不使用key, 随机分区
+)
+
+// keyer 计算消息的分区key
+type keyer struct {
+	strategy string
+	field    string
+}
+
+func newKeyer(key string) (*keyer, error) {
+	switch {
+	case key == "":
+		return &keyer{strategy: keyHostPath}, nil
+	case key == keyHostPath, key == keyRandom:
+		return &keyer{strategy: key}, nil
+	case strings.HasPrefix(key, keyField) && len(key) > len(keyField):
+		return &keyer{strategy: keyField, field: key[len(keyField):]}, nil
+	}
+	return nil, fmt.Errorf("wrong producer key: %s", key)
+}
+
+// key 事件的分区key, 字段不存在时为空, 随机分区
+func (k *keyer) key(pe *Event) string {
+	switch k.strategy {
+	case keyHostPath:
+		return conf.Configs.HostName + ":" + pe.Path
+	case keyField:
+		return pe.Fields[k.field]
+	}
+	return ""
+}
+
+// envelopeVersion 信封的版本, logtransfer根据`@logagent`字段识别信封
+const envelopeVersion = 1
+
+// envelope json格式的消息
+type envelope struct {
+	Version   int               `json:"@logagent"`
+	Name      string            `json:"name"`
+	HostName  string            `json:"hostname"`
+	Ip        string            `json:"ip"`
+	Node      string            `json:"node"` // 节点标识
+	Path      string            `json:"path"`
+	Offset    int64             `json:"offset"`    // 事件在文件中的起始偏移量
+	Line      int64             `json:"line"`      // 事件第一行的行号
+	Timestamp string            `json:"timestamp"` // 读取时间
+	Fields    map[string]string `json:"fields,omitempty"`
+	Message   string            `json:"message"`
+}
+
+// encoder 将事件编码为消息
+type encoder struct {
+	format string
+	name   string
+	fields map[string]string
+	keyer  *keyer
+}
+
+func newEncoder(info conf.EtcdInfo) *encoder {
+	format := info.Format
+	if format == "" {
+		format = formatRaw
+	}
+	// 配置已经在checkInfo中检查
+	k, err := newKeyer(info.Producer.Key)
+	if err != nil {
+		k = &keyer{strategy: keyHostPath}
+	}
+	return &encoder{
+		format: format,
+		name:   info.Name,
+		fields: info.Fields,
+		keyer:  k,
+	}
+}
+
+// newEvent 生成交给处理器的事件, 字段为配置的自定义字段的副本
+func (e *encoder) newEvent(path string, ev *event) *Event {
+	fields := make(map[string]string, len(e.fields))
+	for k, v := range e.fields {
+		fields[k] = v
+	}
+	return &Event{
+		Path:    path,
+		Message: ev.text,
+		Fields:  fields,
+	}
+}
+
+// encode 编码处理器处理后的事件
+func (e *encoder) encode(pe *Event, ev *event) (string, error) {
+	if e.format != formatJson {
+		return pe.Message, nil
+	}
+	fields := pe.Fields
+	if len(fields) == 0 {
+		fields = nil
+	}
+
+	b, err := json.Marshal(envelope{
+		Version:   envelopeVersion,
+		Name:      e.name,
+		HostName:  conf.Configs.HostName,
+		Ip:        conf.Configs.Ip,
+		Node:      conf.Configs.NodeId,
+		Path:      pe.Path,
+		Offset:    ev.start,
+		Line:      ev.line,
+		Timestamp: ev.time.Format(time.RFC3339Nano),
+		Fields:    fields,
+		Message:   pe.Message,
+	})
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
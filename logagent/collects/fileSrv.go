@@ -2,137 +2,431 @@ package collects
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"logagent/conf"
+	"logagent/metrics"
 	"logagent/mq"
+	"logagent/utils"
+	"os"
+	"sort"
+	"strings"
+	"sync"
 	"time"
 
-	"github.com/hpcloud/tail"
 	"github.com/sirupsen/logrus"
 )
 
+// 默认的文件扫描间隔
+const defaultScanInterval = 10 * time.Second
+
 type FileManager struct {
 	Topic    string
-	Path     string
-	TailConf tail.Config
-	Tail     *tail.Tail
+	Path     string // 文件路径, 支持通配符和目录
 	Producer *mq.MessageQueueProducer
 	Cancel   context.CancelFunc
+
+	info       conf.EtcdInfo
+	lk         sync.Mutex
+	harvesters map[string]*harvester // key为文件标识
+	done       chan struct{}         // 扫描退出后关闭
+	paused     bool                  // 暂停收集, 暂停期间不扫描, 配置更新后也不会恢复
 }
 
-func newFileManager(topic string, path string, hosts ...string) (*FileManager, error) {
-	config := tail.Config{
-		ReOpen:    true,
-		MustExist: true,
-		Poll:      true,
-		Follow:    true,
-		Location:  &tail.SeekInfo{Offset: 0, Whence: 0},
+// checkInfo 提前检查配置, 避免创建收集器时才发现错误
+func checkInfo(info conf.EtcdInfo) error {
+	if info.Path == "" {
+		return errors.New("path is empty")
 	}
-	tail, err := tail.TailFile(path, config)
-	if err != nil {
+	if info.Format != "" && info.Format != formatRaw && info.Format != formatJson {
+		return fmt.Errorf("wrong message format: %s", info.Format)
+	}
+	if _, err := newMultiline(info.Multiline); err != nil {
+		return err
+	}
+	if _, err := newKeyer(info.Producer.Key); err != nil {
+		return err
+	}
+	switch info.Producer.Mode {
+	case "", producerSync, producerAsync:
+	default:
+		return fmt.Errorf("wrong producer mode: %s", info.Producer.Mode)
+	}
+	// 异步发送时同时有多个请求在发送中, 不开启幂等发送时sarama的重试会导致同一个key的消息乱序
+	if info.Producer.Mode == producerAsync && !info.Producer.Idempotent && info.Producer.Key != keyRandom {
+		return errors.New("async producer requires idempotent unless key is random")
+	}
+	if _, err := newProcessors(info.Processors); err != nil {
+		return err
+	}
+	// raw格式只发送日志内容, 修改字段的处理器只能影响分区的key
+	if info.Format != formatJson && !strings.HasPrefix(info.Producer.Key, keyField) {
+		for i, p := range info.Processors {
+			if usesFields(p.Type) {
+				return fmt.Errorf("processor %d: %s requires json format or field key", i, p.Type)
+			}
+		}
+	}
+	return nil
+}
+
+func newFileManager(info conf.EtcdInfo) (*FileManager, error) {
+	if err := checkInfo(info); err != nil {
 		return nil, err
 	}
 
-	producer, err := mq.NewMessageQueueProducer(mq.MqConf{
-		Flag:     mq.KAFKA,
-		Clusters: hosts,
-	})
+	producer, err := mq.NewMessageQueueProducer(mqConf(info))
 	if err != nil {
-		tail.Done()
 		return nil, err
 	}
 
 	tm := &FileManager{
-		Path:     path,
-		Topic:    topic,
-		Producer: producer,
-		Tail:     tail,
-		TailConf: config,
+		Topic:      info.Name,
+		Path:       info.Path,
+		Producer:   producer,
+		info:       info,
+		harvesters: map[string]*harvester{},
 	}
-	// 收集数据
-	ctx, cancel := context.WithCancel(context.Background())
-	tm.Cancel = cancel
-	go tm.collect(ctx)
+	// 扫描文件 并且开始收集数据
+	tm.scan()
+	tm.startScan()
 
 	return tm, nil
 }
 
-// collect 收集数据
-func (tm *FileManager) collect(ctx context.Context) {
-	lines := tm.Tail.Lines
-	var line *tail.Line
-	var ok bool
-	for {
-		select {
-		case <-ctx.Done(): // 使用ctx控制channel监听
-			return
-		case line, ok = <-lines:
-			if !ok {
-				logrus.Warnf("closed channel %s, wait some time...", tm.Path)
-				time.Sleep(1 * time.Second)
-				continue
-			}
-			if line.Text == "" || line.Text == "\n" || line.Text == "\r\n" || line.Text == "\r" {
-				logrus.Debugf("read invaild content %v from path %s", line.Text, tm.Path)
-				continue
+// mqConf 生成消息队列的配置
+func mqConf(info conf.EtcdInfo) mq.MqConf {
+	mqconf := mq.MqConf{
+		Flag:     mq.KAFKA,
+		Clusters: info.MqHosts,
+		Name:     info.Name,
+		Producer: mq.ProducerConf{
+			Async:       info.Producer.Mode == producerAsync,
+			BatchSize:   info.Producer.BatchSize,
+			Linger:      time.Duration(info.Producer.Linger) * time.Millisecond,
+			Compression: info.Producer.Compression,
+			Idempotent:  info.Producer.Idempotent,
+			Acks:        info.Producer.Acks,
+		},
+		Security: securityConf(info),
+	}
+	if conf.SpoolConfigs.Enable {
+		mqconf.Spool = mq.SpoolConf{
+			Dir:     conf.SpoolConfigs.Dir,
+			MaxSize: conf.SpoolConfigs.MaxSize,
+		}
+	}
+	return mqconf
+}
+
+// securityConf 生成kafka的加密和认证配置, etcd中没有配置时使用本地配置
+func securityConf(info conf.EtcdInfo) mq.SecurityConf {
+	k := conf.KafkaConfigs
+	if info.Kafka != nil {
+		k = *info.Kafka
+	}
+	return mq.SecurityConf{
+		TLS: mq.TLSConf{
+			Enable:             k.TLS.Enable,
+			CA:                 k.TLS.CA,
+			Cert:               k.TLS.Cert,
+			Key:                k.TLS.Key,
+			InsecureSkipVerify: k.TLS.InsecureSkipVerify,
+		},
+		SASL: mq.SASLConf{
+			Mechanism:    k.SASL.Mechanism,
+			User:         k.SASL.User,
+			Password:     k.SASL.Password,
+			PasswordFile: k.SASL.PasswordFile,
+		},
+	}
+}
+
+// scanInterval 文件的扫描间隔
+func (tm *FileManager) scanInterval() time.Duration {
+	if tm.info.ScanInterval <= 0 {
+		return defaultScanInterval
+	}
+	return time.Duration(tm.info.ScanInterval) * time.Second
+}
+
+// startScan 定期扫描匹配的文件
+func (tm *FileManager) startScan() {
+	ctx, cancel := context.WithCancel(context.Background())
+	tm.Cancel = cancel
+	tm.done = make(chan struct{})
+	go func(interval time.Duration, done chan struct{}) {
+		defer close(done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				tm.scan()
 			}
-			tm.Producer.Produce(mq.MessageQueueMessage{
-				"topic":   tm.Topic,
-				"message": line.Text,
-			})
 		}
+	}(tm.scanInterval(), tm.done)
+}
+
+// stopScan 停止扫描 并且等待扫描退出
+func (tm *FileManager) stopScan() {
+	if tm.Cancel == nil {
+		return
+	}
+	tm.Cancel()
+	tm.Cancel = nil
+	<-tm.done
+}
+
+// scan 扫描匹配的文件, 为新出现的文件创建收集器, 停止已经消失的文件的收集器
+func (tm *FileManager) scan() {
+	paths, err := utils.Glob(tm.Path)
+	if err != nil {
+		logrus.Errorf("glob path %s error: %v", tm.Path, err)
+		return
+	}
+
+	matched := map[string]string{}
+	sizes := map[string]int64{}
+	for _, path := range paths {
+		id, info, err := utils.StatFileId(path)
+		if err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+		key := registryKey(path, id)
+		matched[key] = path
+		sizes[key] = info.Size()
+	}
+
+	tm.lk.Lock()
+	defer tm.lk.Unlock()
+	// 文件已经消失或者已经收集结束
+	for key, h := range tm.harvesters {
+		_, ok := matched[key]
+		if ok && !h.isFinished() {
+			continue
+		}
+		// 文件被轮转(移走或者删除)后, tail会读到文件末尾再结束, 收集结束后再关闭, 避免丢失轮转前没有读取的日志
+		// 路径下还是原来的文件, 说明是配置的路径变化, 直接关闭
+		if !ok && !h.isFinished() && h.rotated() {
+			logrus.Debugf("Wait harvester %s of %s to read to the end", h.path, tm.Topic)
+			continue
+		}
+		logrus.Debugf("Stop harvester %s of %s", h.path, tm.Topic)
+		h.close()
+		delete(tm.harvesters, key)
+	}
+	// 新出现的文件
+	for key, path := range matched {
+		if _, ok := tm.harvesters[key]; ok {
+			continue
+		}
+		h, err := newHarvester(path, tm.info, tm.Producer)
+		if err != nil {
+			logrus.Errorf("new harvester %s error: %v", path, err)
+			continue
+		}
+		// 打开文件之前文件可能已经发生变化
+		if h.key != key {
+			h.close()
+			continue
+		}
+		tm.harvesters[key] = h
+		if tm.paused {
+			continue
+		}
+		logrus.Debugf("Start harvester %s of %s", path, tm.Topic)
+		h.start()
+	}
+	// 文件大小和读取位置对比可以看出收集的进度
+	for key, h := range tm.harvesters {
+		metrics.FileSize.WithLabelValues(tm.Topic, h.path).Set(float64(sizes[key]))
 	}
 }
 
-func (tm *FileManager) update(topic string, path string, hosts ...string) error {
-	// 关闭日志收集
-	if tm.Cancel != nil {
-		tm.Cancel()
+// status 收集器的状态
+func (tm *FileManager) status() ManagerStatus {
+	tm.lk.Lock()
+	files, paused := len(tm.harvesters), tm.paused
+	tm.lk.Unlock()
+
+	st := ManagerStatus{
+		Name:     tm.Topic,
+		Path:     tm.Path,
+		State:    StateRunning,
+		Files:    files,
+		Producer: tm.Producer.Status(),
+	}
+	if !st.Producer.Connected || st.Producer.Failing {
+		st.State = StateDisconnected
+	}
+	if paused {
+		st.State = StatePaused
+	}
+	st.LastError = st.Producer.LastError
+	return st
+}
+
+func (tm *FileManager) update(info conf.EtcdInfo) error {
+	if err := checkInfo(info); err != nil {
+		return err
+	}
+	// 停止扫描
+	tm.stopScan()
+
+	tm.lk.Lock()
+	// 暂停收集 避免更新时还在发送消息
+	for _, h := range tm.harvesters {
+		h.stop()
 	}
 
 	// 更新消息队列
-	err := tm.Producer.Update(mq.MqConf{
-		Flag:     mq.KAFKA,
-		Clusters: hosts,
-	})
+	err := tm.Producer.Update(mqConf(info))
 	if err != nil {
+		tm.lk.Unlock()
 		return err
 	}
 
-	// 更新收集器信息
-	if tm.Path != path {
-		if tm.Tail != nil {
-			tm.Tail.Stop()
+	// 更新收集器的配置 并且重新开始收集
+	for _, h := range tm.harvesters {
+		if err := h.update(info); err != nil {
+			logrus.Errorf("update harvester %s error: %v", h.path, err)
 		}
-		tail, err := tail.TailFile(path, tm.TailConf)
+		if !tm.paused {
+			h.start()
+		}
+	}
+	tm.Path = info.Path
+	tm.info = info
+	paused := tm.paused
+	tm.lk.Unlock()
+
+	// 按照新的路径重新扫描, 暂停时恢复后再扫描
+	if !paused {
+		tm.scan()
+		tm.startScan()
+	}
+	return nil
+}
+
+// pause 暂停收集, 已经交给生产者的消息会继续发送
+func (tm *FileManager) pause() {
+	tm.stopScan()
+
+	tm.lk.Lock()
+	defer tm.lk.Unlock()
+	tm.paused = true
+	for _, h := range tm.harvesters {
+		h.stop()
+	}
+	logrus.Infof("Pause file manager %s", tm.Topic)
+}
+
+// resume 恢复收集
+func (tm *FileManager) resume() {
+	tm.lk.Lock()
+	if !tm.paused {
+		tm.lk.Unlock()
+		return
+	}
+	tm.paused = false
+	for _, h := range tm.harvesters {
+		h.start()
+	}
+	tm.lk.Unlock()
+	logrus.Infof("Resume file manager %s", tm.Topic)
+
+	tm.scan()
+	tm.startScan()
+}
+
+// reread 从指定的偏移量重新收集文件, path为空时重新收集全部文件
+// 收集器会被重新创建, 还没有确认的消息不再更新读取进度
+// 偏移量超出任何一个文件的大小时返回错误, 不修改读取进度
+func (tm *FileManager) reread(path string, offset int64) error {
+	if offset < 0 {
+		return fmt.Errorf("offset %d must not be negative", offset)
+	}
+	tm.lk.Lock()
+	rereads := []string{}
+	for key, h := range tm.harvesters {
+		if path != "" && h.path != path {
+			continue
+		}
+		info, err := os.Stat(h.path)
 		if err != nil {
-			tm.Producer.Close()
+			tm.lk.Unlock()
 			return err
 		}
-		// 更新结构体信息
-		tm.Tail = tail
-		tm.Path = path
+		if offset > info.Size() {
+			tm.lk.Unlock()
+			return fmt.Errorf("offset %d is larger than the size %d of file %s", offset, info.Size(), h.path)
+		}
+		rereads = append(rereads, key)
 	}
-	// 重新开始收集数据
-	ctx, cancel := context.WithCancel(context.Background())
-	tm.Cancel = cancel
-	go tm.collect(ctx)
+	if len(rereads) == 0 {
+		tm.lk.Unlock()
+		return fmt.Errorf("file %s is not collected by %s", path, tm.Topic)
+	}
+
+	for _, key := range rereads {
+		h := tm.harvesters[key]
+		// 收集协程退出后不会再替换tracker, 这时放弃的tracker之后的确认都不会覆盖新的读取进度
+		h.close()
+		h.tracker.abandon()
+		delete(tm.harvesters, key)
+		// 行号无法从偏移量推算, 从头开始时为0, 否则从0开始重新计数
+		fileRegistry.set(h.topic, h.path, h.fileId, offset, 0)
+		logrus.Infof("Reread file %s of %s from offset %d", h.path, tm.Topic, offset)
+	}
+	tm.lk.Unlock()
+
+	// 重新扫描时按照新的读取进度创建收集器
+	tm.scan()
 	return nil
 }
 
+// files 正在收集的文件以及已经确认的读取进度
+func (tm *FileManager) files() []FileStatus {
+	tm.lk.Lock()
+	defer tm.lk.Unlock()
+	files := []FileStatus{}
+	for _, h := range tm.harvesters {
+		offset, line := fileRegistry.get(h.topic, h.path, h.fileId)
+		fs := FileStatus{Path: h.path, Offset: offset, Line: line}
+		if info, err := os.Stat(h.path); err == nil {
+			fs.Size = info.Size()
+			if fs.Size > offset {
+				fs.Lag = fs.Size - offset
+			}
+		}
+		files = append(files, fs)
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].Path < files[j].Path
+	})
+	return files
+}
+
 func (tm *FileManager) close() {
 	if tm == nil {
 		return
 	}
-	if tm.Cancel != nil {
-		tm.Cancel()
-		tm.Cancel = nil
-	}
-	if tm.Tail != nil {
-		tm.Tail.Stop()
-		tm.Tail = nil
+	tm.stopScan()
+
+	tm.lk.Lock()
+	for key, h := range tm.harvesters {
+		h.close()
+		delete(tm.harvesters, key)
 	}
+	tm.lk.Unlock()
+
 	if tm.Producer != nil {
 		tm.Producer.Close()
 		tm.Producer = nil
 	}
-	return
+	// 保存已经确认的读取进度
+	fileRegistry.save()
 }
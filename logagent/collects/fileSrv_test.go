@@ -0,0 +1,110 @@
+package collects
+
+import (
+	"io/ioutil"
+	"logagent/conf"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestCheckProducer 异步发送时只有开启幂等发送或者随机分区才能保证同一个key的消息不乱序
+func TestCheckProducer(t *testing.T) {
+	cases := []struct {
+		producer conf.ProducerInfo
+		ok       bool
+	}{
+		{conf.ProducerInfo{}, true},
+		{conf.ProducerInfo{Mode: producerSync, Key: "field:service"}, true},
+		{conf.ProducerInfo{Mode: producerAsync}, false},
+		{conf.ProducerInfo{Mode: producerAsync, Key: "field:service"}, false},
+		{conf.ProducerInfo{Mode: producerAsync, Idempotent: true}, true},
+		{conf.ProducerInfo{Mode: producerAsync, Key: keyRandom}, true},
+	}
+	for _, c := range cases {
+		err := checkInfo(conf.EtcdInfo{Path: "/tmp/app.log", Producer: c.producer})
+		if (err == nil) != c.ok {
+			t.Errorf("producer %+v: got error %v", c.producer, err)
+		}
+	}
+}
+
+// TestCheckFieldProcessors raw格式不发送字段, 只有分区的key使用字段时才能配置修改字段的处理器
+func TestCheckFieldProcessors(t *testing.T) {
+	addFields := []conf.ProcessorInfo{{Type: processorAddFields, Fields: map[string]string{"env": "prod"}}}
+	cases := []struct {
+		info conf.EtcdInfo
+		ok   bool
+	}{
+		{conf.EtcdInfo{Processors: addFields}, false},
+		{conf.EtcdInfo{Format: formatRaw, Processors: []conf.ProcessorInfo{{Type: processorDropFields, Names: []string{"env"}}}}, false},
+		{conf.EtcdInfo{Format: formatJson, Processors: addFields}, true},
+		{conf.EtcdInfo{Format: formatRaw, Processors: addFields, Producer: conf.ProducerInfo{Key: "field:env"}}, true},
+		{conf.EtcdInfo{Processors: []conf.ProcessorInfo{{Type: processorTruncate, MaxBytes: 10}}}, true},
+	}
+	for _, c := range cases {
+		c.info.Path = "/tmp/app.log"
+		if err := checkInfo(c.info); (err == nil) != c.ok {
+			t.Errorf("info %+v: got error %v", c.info, err)
+		}
+	}
+}
+
+// TestScanRotated 文件轮转后离开匹配的路径时, 读到文件末尾之前不关闭, 配置的路径变化时直接关闭
+func TestScanRotated(t *testing.T) {
+	defer useTestRegistry()()
+	dir, err := ioutil.TempDir("", "scan")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "app.log")
+	if err := ioutil.WriteFile(path, []byte("a\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// 暂停时只创建harvester, 不发送消息
+	info := conf.EtcdInfo{Name: "app", Path: filepath.Join(dir, "*.log")}
+	tm := &FileManager{Topic: info.Name, Path: info.Path, info: info, paused: true, harvesters: map[string]*harvester{}}
+	defer func() {
+		for _, h := range tm.harvesters {
+			h.close()
+		}
+	}()
+	tm.scan()
+	if len(tm.harvesters) != 1 {
+		t.Fatalf("got %d harvesters, want 1", len(tm.harvesters))
+	}
+
+	// 轮转后还没有读到文件末尾
+	if err := os.Rename(path, path+".1"); err != nil {
+		t.Fatal(err)
+	}
+	tm.scan()
+	if len(tm.harvesters) != 1 {
+		t.Fatalf("rotated harvester closed before finished, got %d harvesters", len(tm.harvesters))
+	}
+
+	// 收集结束后关闭
+	for _, h := range tm.harvesters {
+		h.finished = 1
+	}
+	tm.scan()
+	if len(tm.harvesters) != 0 {
+		t.Fatalf("finished harvester should be closed, got %d harvesters", len(tm.harvesters))
+	}
+
+	// 路径变化时文件没有轮转, 直接关闭
+	if err := os.Rename(path+".1", path); err != nil {
+		t.Fatal(err)
+	}
+	tm.scan()
+	if len(tm.harvesters) != 1 {
+		t.Fatalf("got %d harvesters, want 1", len(tm.harvesters))
+	}
+	tm.Path = filepath.Join(dir, "*.txt")
+	tm.scan()
+	if len(tm.harvesters) != 0 {
+		t.Fatalf("harvester out of path should be closed, got %d harvesters", len(tm.harvesters))
+	}
+}
@@ -0,0 +1,336 @@
+package collects
+
+import (
+	"context"
+	"io"
+	"logagent/conf"
+	"logagent/metrics"
+	"logagent/mq"
+	"logagent/utils"
+	"strings"
+	"sync/atomic"
+
+	"github.com/hpcloud/tail"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+)
+
+// harvester 负责收集单个文件, 以文件标识区分
+type harvester struct {
+	key      string
+	path     string
+	topic    string
+	producer *mq.MessageQueueProducer
+	tailConf tail.Config
+	tail     *tail.Tail
+	cancel   context.CancelFunc
+
+	done      chan struct{}  // collect退出后关闭
+	fileId    utils.FileId   // 当前读取的文件标识
+	offset    int64          // 当前读取的字节偏移量
+	line      int64          // 当前读取的行数
+	reopened  int32          // 文件被截断后重新打开的标记
+	finished  int32          // 文件已经被删除或者移走, 收集结束的标记
+	tracker   *offsetTracker // 记录还没有被确认的行
+	unsent    []*unsentLine  // collect退出时还没有交给生产者的事件
+	multiline *multiline     // 多行合并, 没有配置时为nil
+	encoder   *encoder       // 消息格式
+	processor processors     // 发送前执行的处理器
+
+	linesRead   prometheus.Counter // 读取的行数
+	bytesRead   prometheus.Counter // 读取的字节数
+	offsetGauge prometheus.Gauge   // 读取位置
+}
+
+// unsentLine 等待发送的事件
+type unsentLine struct {
+	msg     mq.MessageQueueMessage
+	pending *pendingOffset
+	tracker *offsetTracker
+}
+
+// tailLogger 将tail的日志转发给logrus, 并且记录文件被重新打开的事件
+type tailLogger struct {
+	*logrus.Logger
+	reopened *int32
+}
+
+func (l *tailLogger) Printf(format string, v ...interface{}) {
+	if strings.HasPrefix(format, "Successfully reopened") {
+		atomic.StoreInt32(l.reopened, 1)
+	}
+	l.Logger.Debugf(format, v...)
+}
+
+// newHarvester 从上次记录的位置开始收集文件
+func newHarvester(path string, info conf.EtcdInfo, producer *mq.MessageQueueProducer) (*harvester, error) {
+	ml, err := newMultiline(info.Multiline)
+	if err != nil {
+		return nil, err
+	}
+	ps, err := newProcessors(info.Processors)
+	if err != nil {
+		return nil, err
+	}
+
+	h := &harvester{
+		path:      path,
+		topic:     info.Name,
+		producer:  producer,
+		multiline: ml,
+		encoder:   newEncoder(info),
+		processor: ps,
+	}
+	offset, line, id := fileRegistry.location(h.topic, path)
+	// 文件被移走或者删除后由FileManager重新扫描, 不需要tail重新打开
+	h.tailConf = tail.Config{
+		ReOpen:    false,
+		MustExist: true,
+		Poll:      true,
+		Follow:    true,
+		Location:  &tail.SeekInfo{Offset: offset, Whence: io.SeekStart},
+		Logger:    &tailLogger{Logger: logrus.StandardLogger(), reopened: &h.reopened},
+	}
+	h.tail, err = tail.TailFile(path, h.tailConf)
+	if err != nil {
+		return nil, err
+	}
+	h.key = registryKey(path, id)
+	h.fileId = id
+	h.offset = offset
+	h.line = line
+	h.tracker = newOffsetTracker(h.topic, path, id, offset, line)
+	h.linesRead = metrics.LinesRead.WithLabelValues(h.topic)
+	h.bytesRead = metrics.BytesRead.WithLabelValues(h.topic)
+	h.offsetGauge = metrics.FileOffset.WithLabelValues(h.topic, path)
+	h.offsetGauge.Set(float64(offset))
+	logrus.Debugf("Tail file %s from offset %d", path, offset)
+	return h, nil
+}
+
+// isFinished 文件是否已经收集结束
+func (h *harvester) isFinished() bool {
+	return atomic.LoadInt32(&h.finished) == 1
+}
+
+// rotated 文件是否已经被移走或者删除, 路径下已经不是正在收集的文件
+func (h *harvester) rotated() bool {
+	id, _, err := utils.StatFileId(h.path)
+	return err != nil || id != h.fileId
+}
+
+// start 开始收集数据
+func (h *harvester) start() {
+	ctx, cancel := context.WithCancel(context.Background())
+	h.cancel = cancel
+	h.done = make(chan struct{})
+	go h.collect(ctx, h.done)
+}
+
+// stop 停止收集数据 并且等待collect退出
+func (h *harvester) stop() {
+	if h.cancel == nil {
+		return
+	}
+	h.cancel()
+	h.cancel = nil
+	<-h.done
+}
+
+// collect 收集数据
+func (h *harvester) collect(ctx context.Context, done chan struct{}) {
+	defer close(done)
+	// 先发送上次没有发送的事件
+	for len(h.unsent) > 0 {
+		if !h.send(ctx, h.unsent[0]) {
+			return
+		}
+		h.unsent = h.unsent[1:]
+	}
+
+	// 多行合并的超时定时器
+	timer := newStoppedTimer()
+	defer timer.Stop()
+
+	lines := h.tail.Lines
+	var line *tail.Line
+	var ok bool
+	for {
+		select {
+		case <-ctx.Done(): // 使用ctx控制channel监听
+			return
+		case <-timer.C:
+			// 超时没有新的行 发送缓存的事件
+			if !h.emit(ctx, h.multiline.flush()) {
+				return
+			}
+		case line, ok = <-lines:
+			if !ok {
+				// 文件被删除或者移走, 发送缓存的事件后结束收集
+				if h.multiline != nil && !h.emit(ctx, h.multiline.flush()) {
+					return
+				}
+				logrus.Debugf("tail file %s stopped: %v", h.path, h.tail.Err())
+				atomic.StoreInt32(&h.finished, 1)
+				return
+			}
+			// 文件被截断后从头开始计算偏移量
+			if atomic.CompareAndSwapInt32(&h.reopened, 1, 0) {
+				// 截断前缓存的事件先发送出去
+				if h.multiline != nil && !h.emit(ctx, h.multiline.flush()) {
+					return
+				}
+				h.offset = 0
+				h.line = 0
+				h.tracker.abandon()
+				h.tracker = newOffsetTracker(h.topic, h.path, h.fileId, 0, 0)
+			}
+			if line.Err != nil {
+				logrus.Warnf("tail file %s error: %v", h.path, line.Err)
+				continue
+			}
+			// tail去掉了行尾的换行符
+			h.line++
+			ev := &event{
+				text:   line.Text,
+				start:  h.offset,
+				offset: h.offset + int64(len(line.Text)) + 1,
+				line:   h.line,
+				lines:  1,
+				time:   line.Time,
+			}
+			h.offset = ev.offset
+			h.linesRead.Inc()
+			h.bytesRead.Add(float64(len(line.Text) + 1))
+			h.offsetGauge.Set(float64(h.offset))
+			if h.multiline == nil {
+				if !h.emit(ctx, ev) {
+					return
+				}
+				continue
+			}
+
+			if !h.emitAll(ctx, h.multiline.feed(ev)) {
+				return
+			}
+			resetTimer(timer, h.multiline.timeout, h.multiline.buffered())
+		}
+	}
+}
+
+// prepare 记录事件的偏移量 并且生成待发送的消息, 空事件直接确认并返回nil
+func (h *harvester) prepare(ev *event) *unsentLine {
+	if ev == nil {
+		return nil
+	}
+	pending := h.tracker.add(ev.offset, ev.line+ev.lines-1)
+	if strings.TrimSpace(ev.text) == "" {
+		logrus.Debugf("read invaild content %v from path %s", ev.text, h.path)
+		metrics.EventsDropped.WithLabelValues(h.topic, metrics.DropEmpty).Inc()
+		h.tracker.ack(pending)
+		return nil
+	}
+
+	pe := h.encoder.newEvent(h.path, ev)
+	if !h.processor.process(pe) {
+		metrics.EventsDropped.WithLabelValues(h.topic, metrics.DropFiltered).Inc()
+		h.tracker.ack(pending)
+		return nil
+	}
+	msg, err := h.encoder.encode(pe, ev)
+	if err != nil {
+		logrus.Errorf("encode message from %s error: %v", h.path, err)
+		metrics.EventsDropped.WithLabelValues(h.topic, metrics.DropEncode).Inc()
+		h.tracker.ack(pending)
+		return nil
+	}
+	return &unsentLine{
+		msg: mq.MessageQueueMessage{
+			"topic":   h.topic,
+			"key":     h.encoder.keyer.key(pe),
+			"message": msg,
+		},
+		pending: pending,
+		tracker: h.tracker,
+	}
+}
+
+// emit 发送事件, 被打断时保存事件, 下次collect时继续发送
+func (h *harvester) emit(ctx context.Context, ev *event) bool {
+	u := h.prepare(ev)
+	if u == nil {
+		return true
+	}
+	if !h.send(ctx, u) {
+		h.unsent = append(h.unsent, u)
+		return false
+	}
+	return true
+}
+
+// emitAll 按顺序发送多个事件, 被打断后剩余的事件全部保存
+func (h *harvester) emitAll(ctx context.Context, events []*event) bool {
+	for i, ev := range events {
+		if h.emit(ctx, ev) {
+			continue
+		}
+		for _, rest := range events[i+1:] {
+			if u := h.prepare(rest); u != nil {
+				h.unsent = append(h.unsent, u)
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// send 将消息交给生产者, 生产者确认后推进读取进度
+func (h *harvester) send(ctx context.Context, u *unsentLine) bool {
+	err := h.producer.Produce(ctx, u.msg, func() {
+		u.tracker.ack(u.pending)
+	})
+	if err != nil {
+		logrus.Debugf("produce message from %s interrupted: %v", h.path, err)
+		return false
+	}
+	return true
+}
+
+// update 更新配置, 调用前需要先停止收集
+func (h *harvester) update(info conf.EtcdInfo) error {
+	ml, err := newMultiline(info.Multiline)
+	if err != nil {
+		return err
+	}
+	ps, err := newProcessors(info.Processors)
+	if err != nil {
+		return err
+	}
+	// 已经缓存的行作为一个事件等待发送
+	if h.multiline != nil {
+		if u := h.prepare(h.multiline.flush()); u != nil {
+			h.unsent = append(h.unsent, u)
+		}
+	}
+	h.multiline = ml
+	h.encoder = newEncoder(info)
+	h.processor = ps
+	h.topic = info.Name
+	return nil
+}
+
+// close 停止收集 并且释放资源
+func (h *harvester) close() {
+	h.stop()
+	if h.tail != nil {
+		// tail发送行时不检查是否已经停止, 丢弃还没有读取的行, 避免Stop一直等待
+		// 这些行没有被确认, 读取进度不受影响
+		go func(lines chan *tail.Line) {
+			for range lines {
+			}
+		}(h.tail.Lines)
+		h.tail.Stop()
+		h.tail = nil
+	}
+	metrics.DeleteFile(h.topic, h.path)
+}
@@ -1,14 +1,63 @@
 package collects
 
 import (
+	"errors"
 	"logagent/conf"
+	"logagent/metrics"
+	"logagent/mq"
+	"sort"
+	"sync"
 
 	"github.com/sirupsen/logrus"
 )
 
-var logManagers = map[string]*FileManager{}
+// 收集器的状态
+const (
+	StateRunning      = "running"      // 正常收集
+	StateDisconnected = "disconnected" // 没有连接上kafka或者发送失败, 消息写入本地队列或者等待重试
+	StateFailed       = "failed"       // 创建或者更新失败, 没有收集
+	StatePaused       = "paused"       // 通过管理接口暂停收集
+)
+
+// ErrManagerNotFound 收集器不存在
+var ErrManagerNotFound = errors.New("manager not found")
+
+// ManagerStatus 收集器的状态
+type ManagerStatus struct {
+	Name      string    `json:"name"`
+	Path      string    `json:"path"`
+	State     string    `json:"state"`
+	Files     int       `json:"files"` // 正在收集的文件数
+	Producer  mq.Status `json:"producer"`
+	LastError string    `json:"last_error"`
+}
+
+// FileStatus 正在收集的文件
+type FileStatus struct {
+	Path   string `json:"path"`
+	Offset int64  `json:"offset"` // 已经确认的偏移量
+	Line   int64  `json:"line"`   // 已经确认的行数
+	Size   int64  `json:"size"`   // 文件大小
+	Lag    int64  `json:"lag"`    // 还没有确认的字节数
+}
+
+// ManagerInfo 收集器的配置和状态
+type ManagerInfo struct {
+	Config conf.EtcdInfo `json:"config"`
+	Status ManagerStatus `json:"status"`
+	Files  []FileStatus  `json:"files"`
+}
+
+var (
+	managersLk     sync.RWMutex // 保护logManagers和failedManagers, 状态查询和配置更新在不同的协程中
+	logManagers    = map[string]*FileManager{}
+	failedManagers = map[string]ManagerStatus{} // 创建或者更新失败的收集器
+)
 
 func UpdateManagers() {
+	managersLk.Lock()
+	defer managersLk.Unlock()
+
 	// 移除旧的收集器
 	m := map[string]struct{}{}
 	for _, v := range conf.EtcdInfos {
@@ -20,34 +69,137 @@ func UpdateManagers() {
 			delete(logManagers, k)
 		}
 	}
+	failedManagers = map[string]ManagerStatus{}
 
 	// 更新收集器
 	var err error
 	for _, config := range conf.EtcdInfos {
 		fm := logManagers[config.Name]
 		if fm == nil {
-			fm, err = newFileManager(config.Name, config.Path, config.MqHosts...)
+			fm, err = newFileManager(config)
 			if err != nil {
 				logrus.Errorf("new file manager error: %v, config: %v", err, config)
+				setFailed(config, err)
 				continue
 			}
 		} else {
-			err = fm.update(config.Name, config.Path, config.MqHosts...)
+			err = fm.update(config)
 			if err != nil {
 				logrus.Errorf("update file manager error: %v, config: %v", err, config)
 				logManagers[config.Name].close()
 				delete(logManagers, config.Name)
+				setFailed(config, err)
 				continue
 			}
 		}
 
 		logManagers[config.Name] = fm
 	}
+	metrics.Managers.Set(float64(len(logManagers)))
+}
+
+// setFailed 记录创建或者更新失败的收集器
+func setFailed(info conf.EtcdInfo, err error) {
+	failedManagers[info.Name] = ManagerStatus{
+		Name:      info.Name,
+		Path:      info.Path,
+		State:     StateFailed,
+		LastError: err.Error(),
+	}
+}
+
+// Status 全部收集器的状态, 包括创建或者更新失败的收集器, 按照名称排序
+func Status() []ManagerStatus {
+	managersLk.RLock()
+	defer managersLk.RUnlock()
+
+	list := []ManagerStatus{}
+	for _, fm := range logManagers {
+		list = append(list, fm.status())
+	}
+	for _, st := range failedManagers {
+		list = append(list, st)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Name < list[j].Name
+	})
+	return list
+}
+
+// Managers 全部收集器的配置、状态以及正在收集的文件, 按照名称排序
+// 配置中的kafka密码不会返回
+func Managers() []ManagerInfo {
+	managersLk.RLock()
+	defer managersLk.RUnlock()
+
+	list := []ManagerInfo{}
+	for _, fm := range logManagers {
+		fm.lk.Lock()
+		info := fm.info
+		fm.lk.Unlock()
+		if info.Kafka != nil && info.Kafka.SASL.Password != "" {
+			k := *info.Kafka
+			k.SASL.Password = "******"
+			info.Kafka = &k
+		}
+		list = append(list, ManagerInfo{
+			Config: info,
+			Status: fm.status(),
+			Files:  fm.files(),
+		})
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Config.Name < list[j].Config.Name
+	})
+	return list
+}
+
+// Pause 暂停收集器, 配置更新后依然保持暂停, 服务重启后恢复
+func Pause(name string) error {
+	managersLk.Lock()
+	defer managersLk.Unlock()
+	fm := logManagers[name]
+	if fm == nil {
+		return ErrManagerNotFound
+	}
+	fm.pause()
+	return nil
+}
+
+// Resume 恢复暂停的收集器
+func Resume(name string) error {
+	managersLk.Lock()
+	defer managersLk.Unlock()
+	fm := logManagers[name]
+	if fm == nil {
+		return ErrManagerNotFound
+	}
+	fm.resume()
+	return nil
+}
+
+// Reread 从指定的偏移量重新收集文件, offset为0时从头开始, path为空时重新收集全部文件
+func Reread(name string, path string, offset int64) error {
+	if offset < 0 {
+		return errors.New("offset must not be negative")
+	}
+	managersLk.Lock()
+	defer managersLk.Unlock()
+	fm := logManagers[name]
+	if fm == nil {
+		return ErrManagerNotFound
+	}
+	return fm.reread(path, offset)
 }
 
 func CloseManagers() {
+	managersLk.Lock()
+	defer managersLk.Unlock()
+
 	for _, m := range logManagers {
 		m.close()
 	}
+	metrics.Managers.Set(0)
+	closeRegistry()
 	logrus.Debug("Closed all managers")
 }
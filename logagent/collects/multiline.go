@@ -0,0 +1,155 @@
+package collects
+
+import (
+	"errors"
+	"logagent/conf"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// 多行合并的默认限制
+const (
+	defaultMaxLines = 500
+	defaultMaxBytes = 10 * 1024 * 1024
+	defaultTimeout  = 5 * time.Second
+)
+
+// event 待发送的日志事件, 开启多行合并时由多行组成
+type event struct {
+	text   string
+	start  int64     // 第一行开始位置的偏移量
+	offset int64     // 最后一行结束位置的偏移量
+	line   int64     // 第一行的行号
+	lines  int64     // 包含的行数
+	time   time.Time // 第一行的读取时间
+}
+
+// multiline 将同一个事件的多行日志合并, 比如java的异常栈、go的panic
+type multiline struct {
+	start    *regexp.Regexp // 事件第一行的正则
+	cont     *regexp.Regexp // 后续行的正则
+	negate   bool           // 对正则的匹配结果取反
+	maxLines int
+	maxBytes int
+	timeout  time.Duration
+
+	buf   []string
+	bytes int
+	first *event // 缓存的第一行
+	last  *event // 缓存的最后一行
+}
+
+// newMultiline 根据配置创建多行合并器, 没有配置时返回nil
+func newMultiline(info *conf.MultilineInfo) (*multiline, error) {
+	if info == nil || (info.Start == "" && info.Continue == "") {
+		return nil, nil
+	}
+
+	var err error
+	m := &multiline{
+		negate:   info.Negate,
+		maxLines: info.MaxLines,
+		maxBytes: info.MaxBytes,
+		timeout:  time.Duration(info.Timeout) * time.Millisecond,
+	}
+	if info.Start != "" {
+		m.start, err = regexp.Compile(info.Start)
+		if err != nil {
+			return nil, errors.New("wrong multiline start pattern: " + err.Error())
+		}
+	}
+	if info.Continue != "" {
+		m.cont, err = regexp.Compile(info.Continue)
+		if err != nil {
+			return nil, errors.New("wrong multiline continue pattern: " + err.Error())
+		}
+	}
+	if m.maxLines <= 0 {
+		m.maxLines = defaultMaxLines
+	}
+	if m.maxBytes <= 0 {
+		m.maxBytes = defaultMaxBytes
+	}
+	if m.timeout <= 0 {
+		m.timeout = defaultTimeout
+	}
+	return m, nil
+}
+
+// isContinue 判断该行是否属于当前事件
+func (m *multiline) isContinue(text string) bool {
+	if m.start != nil && m.start.MatchString(text) != m.negate {
+		return false
+	}
+	if m.cont != nil {
+		return m.cont.MatchString(text) != m.negate
+	}
+	return true
+}
+
+// feed 输入一行日志, 返回已经完整的事件
+func (m *multiline) feed(l *event) []*event {
+	var events []*event
+	if len(m.buf) > 0 && !m.isContinue(l.text) {
+		events = append(events, m.flush())
+	}
+
+	if len(m.buf) == 0 {
+		m.first = l
+	}
+	m.buf = append(m.buf, l.text)
+	m.bytes += len(l.text) + 1
+	m.last = l
+
+	// 超过限制后直接作为一个事件发送, 后续的行作为新的事件
+	if len(m.buf) >= m.maxLines || m.bytes >= m.maxBytes {
+		events = append(events, m.flush())
+	}
+	return events
+}
+
+// flush 返回缓存中的事件
+func (m *multiline) flush() *event {
+	if len(m.buf) == 0 {
+		return nil
+	}
+	ev := &event{
+		text:   strings.Join(m.buf, "\n"),
+		start:  m.first.start,
+		offset: m.last.offset,
+		line:   m.first.line,
+		lines:  int64(len(m.buf)),
+		time:   m.first.time,
+	}
+	m.buf = nil
+	m.bytes = 0
+	m.first = nil
+	m.last = nil
+	return ev
+}
+
+// buffered 是否有缓存的行
+func (m *multiline) buffered() bool {
+	return len(m.buf) > 0
+}
+
+// newStoppedTimer 创建一个还没有开始计时的定时器
+func newStoppedTimer() *time.Timer {
+	timer := time.NewTimer(time.Hour)
+	timer.Stop()
+	return timer
+}
+
+// resetTimer 重置定时器, active为false时只停止定时器
+func resetTimer(timer *time.Timer, d time.Duration, active bool) {
+	if !timer.Stop() {
+		select {
+		case <-timer.C:
+		default:
+		}
+	}
+	if active {
+		timer.Reset(d)
+	}
+}
@@ -0,0 +1,159 @@
+package collects
+
+import (
+	"logagent/conf"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// feedLines 按行输入, 行号和偏移量从0开始计算, 最后发送缓存的事件
+func feedLines(m *multiline, lines []string) []*event {
+	var events []*event
+	var offset int64
+	for i, text := range lines {
+		l := &event{
+			text:   text,
+			start:  offset,
+			offset: offset + int64(len(text)) + 1,
+			line:   int64(i + 1),
+			lines:  1,
+		}
+		offset = l.offset
+		events = append(events, m.feed(l)...)
+	}
+	if ev := m.flush(); ev != nil {
+		events = append(events, ev)
+	}
+	return events
+}
+
+func TestMultiline(t *testing.T) {
+	javaStack := []string{
+		"2021-04-19 10:00:00 ERROR failed",
+		"java.lang.RuntimeException: boom",
+		"\tat Main.main(Main.java:3)",
+		"2021-04-19 10:00:01 INFO ok",
+	}
+	cases := []struct {
+		name  string
+		info  conf.MultilineInfo
+		lines []string
+		want  []string
+	}{
+		{
+			name:  "start",
+			info:  conf.MultilineInfo{Start: `^\d{4}-\d{2}-\d{2}`},
+			lines: javaStack,
+			want:  []string{strings.Join(javaStack[:3], "\n"), javaStack[3]},
+		},
+		{
+			name:  "continue",
+			info:  conf.MultilineInfo{Continue: `^(\s|java\.)`},
+			lines: javaStack,
+			want:  []string{strings.Join(javaStack[:3], "\n"), javaStack[3]},
+		},
+		{
+			// 不以日期开头的行追加到当前事件
+			name:  "continue negate",
+			info:  conf.MultilineInfo{Continue: `^\d{4}-`, Negate: true},
+			lines: javaStack,
+			want:  []string{strings.Join(javaStack[:3], "\n"), javaStack[3]},
+		},
+		{
+			// 不以日期开头的行开始新的事件, 以日期开头的行追加到当前事件
+			name:  "start negate",
+			info:  conf.MultilineInfo{Start: `^\d{4}-`, Negate: true},
+			lines: []string{"a", "b", "2021-04-19 c", "d"},
+			want:  []string{"a", "b\n2021-04-19 c", "d"},
+		},
+		{
+			name:  "maxlines",
+			info:  conf.MultilineInfo{Continue: `^\s`, MaxLines: 2},
+			lines: []string{"a", " 1", " 2", " 3", "b"},
+			want:  []string{"a\n 1", " 2\n 3", "b"},
+		},
+		{
+			// 包括换行符达到6个字节时截断
+			name:  "maxbytes",
+			info:  conf.MultilineInfo{Continue: `^\s`, MaxBytes: 6},
+			lines: []string{"ab", " c", " d", " e"},
+			want:  []string{"ab\n c", " d\n e"},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			info := c.info
+			m, err := newMultiline(&info)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := []string{}
+			for _, ev := range feedLines(m, c.lines) {
+				got = append(got, ev.text)
+			}
+			if !reflect.DeepEqual(got, c.want) {
+				t.Errorf("got %q, want %q", got, c.want)
+			}
+		})
+	}
+}
+
+// TestMultilineEvent 合并后的事件使用第一行的行号和开始位置, 以及最后一行的结束位置
+func TestMultilineEvent(t *testing.T) {
+	m, err := newMultiline(&conf.MultilineInfo{Continue: `^\s`})
+	if err != nil {
+		t.Fatal(err)
+	}
+	events := feedLines(m, []string{"a", " b", "c"})
+	if len(events) != 2 {
+		t.Fatalf("got %d events, want 2", len(events))
+	}
+	ev := events[0]
+	if ev.start != 0 || ev.offset != 5 || ev.line != 1 || ev.lines != 2 {
+		t.Errorf("wrong first event: %+v", ev)
+	}
+	ev = events[1]
+	if ev.start != 5 || ev.offset != 7 || ev.line != 3 || ev.lines != 1 {
+		t.Errorf("wrong second event: %+v", ev)
+	}
+}
+
+// TestMultilineTimeout 和harvester一样, 有缓存时启动定时器, 超时后发送缓存的事件
+func TestMultilineTimeout(t *testing.T) {
+	m, err := newMultiline(&conf.MultilineInfo{Continue: `^\s`, Timeout: 20})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.timeout != 20*time.Millisecond {
+		t.Fatalf("got timeout %v", m.timeout)
+	}
+
+	timer := newStoppedTimer()
+	defer timer.Stop()
+	for _, text := range []string{"a", " b"} {
+		if events := m.feed(&event{text: text}); len(events) != 0 {
+			t.Fatalf("event should be buffered: %+v", events[0])
+		}
+		resetTimer(timer, m.timeout, m.buffered())
+	}
+
+	select {
+	case <-timer.C:
+	case <-time.After(time.Second):
+		t.Fatal("timer not fired")
+	}
+	ev := m.flush()
+	if ev == nil || ev.text != "a\n b" || m.buffered() {
+		t.Errorf("wrong flushed event: %+v", ev)
+	}
+
+	// 没有缓存时不启动定时器
+	resetTimer(timer, m.timeout, m.buffered())
+	select {
+	case <-timer.C:
+		t.Error("timer should be stopped")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
@@ -0,0 +1,232 @@
+package collects
+
+import (
+	"errors"
+	"fmt"
+	"logagent/conf"
+	"regexp"
+	"sync"
+	"unicode/utf8"
+)
+
+// 内置的处理器类型
+const (
+	processorInclude    = "include"     // 只保留匹配正则的事件
+	processorExclude    = "exclude"     // 丢弃匹配正则的事件
+	processorAddFields  = "add_fields"  // 添加字段
+	processorDropFields = "drop_fields" // 删除字段
+	processorTruncate   = "truncate"    // 截断过长的日志内容
+	processorRename     = "rename"      // 重命名字段
+)
+
+// Event 交给处理器的事件
+// Fields只有在json格式时才会发送
+type Event struct {
+	Path    string            // 文件路径
+	Message string            // 日志内容
+	Fields  map[string]string // 自定义字段
+}
+
+// Processor 事件处理器, 在发送之前按照配置的顺序处理事件
+type Processor interface {
+	// Process 处理事件, 返回false表示丢弃该事件
+	Process(e *Event) bool
+}
+
+// processors 处理器链
+type processors []Processor
+
+// newProcessors 按照配置的顺序创建处理器链
+func newProcessors(infos []conf.ProcessorInfo) (processors, error) {
+	ps := processors{}
+	for i, info := range infos {
+		p, err := newProcessor(info)
+		if err != nil {
+			return nil, fmt.Errorf("processor %d: %v", i, err)
+		}
+		ps = append(ps, p)
+	}
+	return ps, nil
+}
+
+// ProcessorFactory 根据配置创建处理器, 配置错误时返回错误
+type ProcessorFactory func(info conf.ProcessorInfo) (Processor, error)
+
+var (
+	factoriesLk sync.RWMutex
+	factories   = map[string]ProcessorFactory{
+		processorInclude:    newMatchProcessor,
+		processorExclude:    newMatchProcessor,
+		processorAddFields:  newAddFieldsProcessor,
+		processorDropFields: newDropFieldsProcessor,
+		processorTruncate:   newTruncateProcessor,
+		processorRename:     newRenameProcessor,
+	}
+)
+
+// Register 注册自定义的处理器, 配置中的type为name时使用factory创建
+// 需要在收集器创建之前注册, 通常在init中调用, 名称为空、factory为nil或者名称已经注册时panic
+func Register(name string, factory ProcessorFactory) {
+	factoriesLk.Lock()
+	defer factoriesLk.Unlock()
+	if name == "" || factory == nil {
+		panic("collects: register processor with empty name or nil factory")
+	}
+	if _, ok := factories[name]; ok {
+		panic("collects: register processor twice: " + name)
+	}
+	factories[name] = factory
+}
+
+// newProcessor 根据类型创建处理器
+func newProcessor(info conf.ProcessorInfo) (Processor, error) {
+	factoriesLk.RLock()
+	factory := factories[info.Type]
+	factoriesLk.RUnlock()
+	if factory == nil {
+		return nil, fmt.Errorf("unknown processor type: %s", info.Type)
+	}
+	return factory(info)
+}
+
+// usesFields 处理器是否只修改字段, raw格式不发送字段, 只有分区的key使用字段时才有作用
+func usesFields(typ string) bool {
+	switch typ {
+	case processorAddFields, processorDropFields, processorRename:
+		return true
+	}
+	return false
+}
+
+func newMatchProcessor(info conf.ProcessorInfo) (Processor, error) {
+	if len(info.Patterns) == 0 {
+		return nil, errors.New("patterns is empty")
+	}
+	res := []*regexp.Regexp{}
+	for _, pattern := range info.Patterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, re)
+	}
+	return &matchProcessor{res: res, include: info.Type == processorInclude}, nil
+}
+
+func newAddFieldsProcessor(info conf.ProcessorInfo) (Processor, error) {
+	if len(info.Fields) == 0 {
+		return nil, errors.New("fields is empty")
+	}
+	return &addFieldsProcessor{fields: info.Fields}, nil
+}
+
+func newDropFieldsProcessor(info conf.ProcessorInfo) (Processor, error) {
+	if len(info.Names) == 0 {
+		return nil, errors.New("names is empty")
+	}
+	return &dropFieldsProcessor{names: info.Names}, nil
+}
+
+func newTruncateProcessor(info conf.ProcessorInfo) (Processor, error) {
+	if info.MaxBytes <= 0 {
+		return nil, errors.New("maxbytes must be positive")
+	}
+	return &truncateProcessor{maxBytes: info.MaxBytes}, nil
+}
+
+func newRenameProcessor(info conf.ProcessorInfo) (Processor, error) {
+	if len(info.Fields) == 0 {
+		return nil, errors.New("fields is empty")
+	}
+	return &renameProcessor{fields: info.Fields}, nil
+}
+
+// process 依次执行处理器, 有一个处理器丢弃事件时返回false
+func (ps processors) process(e *Event) bool {
+	for _, p := range ps {
+		if !p.Process(e) {
+			return false
+		}
+	}
+	return true
+}
+
+// matchProcessor 根据正则保留或者丢弃事件, 匹配任意一个正则即为匹配
+type matchProcessor struct {
+	res     []*regexp.Regexp
+	include bool
+}
+
+func (p *matchProcessor) Process(e *Event) bool {
+	for _, re := range p.res {
+		if re.MatchString(e.Message) {
+			return p.include
+		}
+	}
+	return !p.include
+}
+
+// addFieldsProcessor 添加字段, 已经存在的字段会被覆盖
+type addFieldsProcessor struct {
+	fields map[string]string
+}
+
+func (p *addFieldsProcessor) Process(e *Event) bool {
+	if e.Fields == nil {
+		e.Fields = map[string]string{}
+	}
+	for k, v := range p.fields {
+		e.Fields[k] = v
+	}
+	return true
+}
+
+// dropFieldsProcessor 删除字段
+type dropFieldsProcessor struct {
+	names []string
+}
+
+func (p *dropFieldsProcessor) Process(e *Event) bool {
+	for _, name := range p.names {
+		delete(e.Fields, name)
+	}
+	return true
+}
+
+// truncateProcessor 截断日志内容, 不会截断多字节字符
+type truncateProcessor struct {
+	maxBytes int
+}
+
+func (p *truncateProcessor) Process(e *Event) bool {
+	if len(e.Message) <= p.maxBytes {
+		return true
+	}
+	n := p.maxBytes
+	for n > 0 && !utf8.RuneStart(e.Message[n]) {
+		n--
+	}
+	if n == 0 {
+		// 第一个字符就超过了最大字节数, 保留第一个字符, 不发送空的日志
+		_, n = utf8.DecodeRuneInString(e.Message)
+	}
+	e.Message = e.Message[:n]
+	return true
+}
+
+// renameProcessor 重命名字段, fields为旧名称->新名称
+type renameProcessor struct {
+	fields map[string]string
+}
+
+func (p *renameProcessor) Process(e *Event) bool {
+	for from, to := range p.fields {
+		v, ok := e.Fields[from]
+		if !ok {
+			continue
+		}
+		delete(e.Fields, from)
+		e.Fields[to] = v
+	}
+	return true
+}
@@ -0,0 +1,149 @@
+package collects
+
+import (
+	"logagent/conf"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestProcessors(t *testing.T) {
+	ps, err := newProcessors([]conf.ProcessorInfo{
+		{Type: processorExclude, Patterns: []string{"DEBUG"}},
+		{Type: processorAddFields, Fields: map[string]string{"env": "prod", "app": "api"}},
+		{Type: processorRename, Fields: map[string]string{"app": "service"}},
+		{Type: processorDropFields, Names: []string{"host"}},
+		{Type: processorTruncate, MaxBytes: 8},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 按照配置的顺序处理
+	e := &Event{Path: "/tmp/app.log", Message: "INFO request done", Fields: map[string]string{"host": "web-1"}}
+	if !ps.process(e) {
+		t.Fatal("event should be kept")
+	}
+	if e.Message != "INFO req" {
+		t.Errorf("got message %q", e.Message)
+	}
+	if want := map[string]string{"env": "prod", "service": "api"}; !reflect.DeepEqual(e.Fields, want) {
+		t.Errorf("got fields %v, want %v", e.Fields, want)
+	}
+
+	// 被丢弃后不再执行后面的处理器
+	e = &Event{Message: "DEBUG request done"}
+	if ps.process(e) {
+		t.Error("event should be dropped")
+	}
+	if e.Fields != nil {
+		t.Errorf("add_fields should not run: %v", e.Fields)
+	}
+}
+
+func TestMatchProcessor(t *testing.T) {
+	include, err := newProcessor(conf.ProcessorInfo{Type: processorInclude, Patterns: []string{"ERROR", "WARN"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	exclude, err := newProcessor(conf.ProcessorInfo{Type: processorExclude, Patterns: []string{"ERROR", "WARN"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for msg, matched := range map[string]bool{"ERROR boom": true, "WARN slow": true, "INFO ok": false} {
+		if got := include.Process(&Event{Message: msg}); got != matched {
+			t.Errorf("include %q: got %v", msg, got)
+		}
+		if got := exclude.Process(&Event{Message: msg}); got == matched {
+			t.Errorf("exclude %q: got %v", msg, got)
+		}
+	}
+}
+
+func TestTruncateProcessor(t *testing.T) {
+	cases := []struct {
+		maxBytes int
+		message  string
+		want     string
+	}{
+		{10, "short", "short"},
+		{5, "hello world", "hello"},
+		// "中"占3个字节, 不截断多字节字符
+		{3, "a中文", "a"},
+		{7, "中文字", "中文"},
+		// 第一个字符就超过最大字节数时保留第一个字符
+		{2, "中文", "中"},
+		{1, "😀abc", "😀"},
+		// 不合法的utf8只保留第一个字节
+		{2, "\x80\x80\x80", "\x80"},
+	}
+	for _, c := range cases {
+		p, err := newProcessor(conf.ProcessorInfo{Type: processorTruncate, MaxBytes: c.maxBytes})
+		if err != nil {
+			t.Fatal(err)
+		}
+		e := &Event{Message: c.message}
+		if !p.Process(e) {
+			t.Fatalf("truncate should not drop %q", c.message)
+		}
+		if e.Message != c.want {
+			t.Errorf("truncate %q to %d bytes: got %q, want %q", c.message, c.maxBytes, e.Message, c.want)
+		}
+	}
+}
+
+func TestProcessorConfig(t *testing.T) {
+	infos := []conf.ProcessorInfo{
+		{Type: "unknown"},
+		{Type: processorInclude},
+		{Type: processorExclude, Patterns: []string{"("}},
+		{Type: processorAddFields},
+		{Type: processorDropFields},
+		{Type: processorTruncate},
+		{Type: processorRename},
+	}
+	for _, info := range infos {
+		if _, err := newProcessors([]conf.ProcessorInfo{info}); err == nil {
+			t.Errorf("processor %+v should fail", info)
+		}
+	}
+}
+
+// upperProcessor 测试用的自定义处理器
+type upperProcessor struct{}
+
+func (upperProcessor) Process(e *Event) bool {
+	e.Message = strings.ToUpper(e.Message)
+	return true
+}
+
+func TestRegister(t *testing.T) {
+	Register("test_upper", func(info conf.ProcessorInfo) (Processor, error) {
+		return upperProcessor{}, nil
+	})
+	defer func() {
+		factoriesLk.Lock()
+		delete(factories, "test_upper")
+		factoriesLk.Unlock()
+	}()
+
+	ps, err := newProcessors([]conf.ProcessorInfo{{Type: "test_upper"}, {Type: processorTruncate, MaxBytes: 4}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := &Event{Message: "hello"}
+	if !ps.process(e) || e.Message != "HELL" {
+		t.Errorf("got message %q", e.Message)
+	}
+
+	for _, name := range []string{"test_upper", processorInclude, ""} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("register %q should panic", name)
+				}
+			}()
+			Register(name, func(info conf.ProcessorInfo) (Processor, error) { return upperProcessor{}, nil })
+		}()
+	}
+}
@@ -0,0 +1,293 @@
+package collects
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"logagent/conf"
+	"logagent/utils"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// 文件已经不在记录的路径下, 超过该时间没有更新则删除记录
+const registryCleanAfter = 24 * time.Hour
+
+// registryEntry 单个文件的读取进度
+type registryEntry struct {
+	Topic     string       `json:"topic"` // 收集器名称, 之前的版本没有记录
+	Path      string       `json:"path"`
+	FileId    utils.FileId `json:"fileid"`
+	Offset    int64        `json:"offset"`
+	Line      int64        `json:"line"`      // 已经读取的行数
+	Timestamp int64        `json:"timestamp"` // 最后一次更新的时间
+}
+
+// registry 本地偏移量记录, 服务重启后从记录的位置继续收集
+type registry struct {
+	path    string
+	lk      sync.Mutex // 保护entries
+	wlk     sync.Mutex // 保证同一时间只有一次写入
+	entries map[string]*registryEntry
+	dirty   bool
+	cancel  context.CancelFunc
+}
+
+var fileRegistry *registry
+
+// InitRegistry 加载本地偏移量记录, 并且定期刷盘
+// 需要在读取etcd的配置之后调用, 之前的版本的记录按照当前的收集器迁移
+func InitRegistry(path string, interval time.Duration) {
+	r := &registry{
+		path:    path,
+		entries: map[string]*registryEntry{},
+	}
+	if err := r.load(); err != nil {
+		logrus.Errorf("Load registry %s error: %v, collect from the beginning.", path, err)
+	}
+	r.migrate(conf.EtcdInfos)
+	r.save()
+
+	if interval <= 0 {
+		interval = 5 * time.Second
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	r.cancel = cancel
+	go r.work(ctx, interval)
+
+	fileRegistry = r
+}
+
+// closeRegistry 停止刷盘 并且保存最后的进度
+func closeRegistry() {
+	if fileRegistry == nil {
+		return
+	}
+	if fileRegistry.cancel != nil {
+		fileRegistry.cancel()
+	}
+	fileRegistry.save()
+}
+
+// load 读取本地文件
+func (r *registry) load() error {
+	b, err := ioutil.ReadFile(r.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	entries := []*registryEntry{}
+	err = json.Unmarshal(b, &entries)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		r.entries[entryKey(e.Topic, e.Path, e.FileId)] = e
+	}
+	logrus.Debugf("Load registry suc, %d entries", len(entries))
+	return nil
+}
+
+// migrate 之前的版本没有记录收集器, 将这些记录复制给路径匹配该文件的收集器, 然后删除
+// 收集器已经有记录时保留收集器的记录, 没有收集器匹配的记录保留到之后的启动时再迁移
+func (r *registry) migrate(infos []conf.EtcdInfo) {
+	r.lk.Lock()
+	defer r.lk.Unlock()
+
+	legacy := map[string]*registryEntry{}
+	for key, e := range r.entries {
+		if e.Topic == "" {
+			legacy[key] = e
+		}
+	}
+	if len(legacy) == 0 {
+		return
+	}
+
+	migrated := 0
+	for _, info := range infos {
+		paths, err := utils.Glob(info.Path)
+		if err != nil {
+			continue
+		}
+		for _, path := range paths {
+			id, _, err := utils.StatFileId(path)
+			if err != nil {
+				continue
+			}
+			key := registryKey(path, id)
+			e := legacy[key]
+			if e == nil {
+				continue
+			}
+			if _, ok := r.entries[entryKey(info.Name, path, id)]; !ok {
+				copied := *e
+				copied.Topic = info.Name
+				copied.Path = path
+				r.entries[entryKey(info.Name, path, id)] = &copied
+			}
+			if _, ok := r.entries[key]; ok {
+				delete(r.entries, key)
+				migrated++
+			}
+			r.dirty = true
+		}
+	}
+	logrus.Infof("Migrate registry %s: %d of %d entries without collector migrated", r.path, migrated, len(legacy))
+}
+
+// work 定期刷盘
+func (r *registry) work(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			r.save()
+		}
+	}
+}
+
+// registryKey 记录以文件标识区分, 文件被重命名后依然可以找到读取进度
+// 无法获取文件标识时使用路径
+func registryKey(path string, id utils.FileId) string {
+	if id == (utils.FileId{}) {
+		return path
+	}
+	return fmt.Sprintf("%d:%d", id.Device, id.Inode)
+}
+
+// entryKey 记录以收集器和文件区分, 多个收集器的路径匹配到同一个文件时各自记录读取进度
+// 之前的版本没有记录收集器, topic为空
+func entryKey(topic string, path string, id utils.FileId) string {
+	if topic == "" {
+		return registryKey(path, id)
+	}
+	return topic + "/" + registryKey(path, id)
+}
+
+// location 获取文件的起始读取位置
+// 没有记录说明是新文件, 文件变小说明文件已经被截断, 这两种情况都从头开始读取
+func (r *registry) location(topic string, path string) (offset int64, line int64, id utils.FileId) {
+	id, info, err := utils.StatFileId(path)
+	if r == nil || err != nil {
+		return 0, 0, id
+	}
+
+	r.lk.Lock()
+	defer r.lk.Unlock()
+	e := r.entries[entryKey(topic, path, id)]
+	if e == nil || e.Offset > info.Size() {
+		return 0, 0, id
+	}
+	return e.Offset, e.Line, id
+}
+
+// set 更新文件的读取进度
+func (r *registry) set(topic string, path string, id utils.FileId, offset int64, line int64) {
+	if r == nil {
+		return
+	}
+	r.lk.Lock()
+	defer r.lk.Unlock()
+	key := entryKey(topic, path, id)
+	e := r.entries[key]
+	if e == nil {
+		e = &registryEntry{}
+		r.entries[key] = e
+	}
+	e.Topic = topic
+	e.Path = path
+	e.FileId = id
+	e.Offset = offset
+	e.Line = line
+	e.Timestamp = time.Now().Unix()
+	r.dirty = true
+}
+
+// get 文件已经确认的读取进度, 没有记录时为0
+func (r *registry) get(topic string, path string, id utils.FileId) (offset int64, line int64) {
+	if r == nil {
+		return 0, 0
+	}
+	r.lk.Lock()
+	defer r.lk.Unlock()
+	e := r.entries[entryKey(topic, path, id)]
+	if e == nil {
+		return 0, 0
+	}
+	return e.Offset, e.Line
+}
+
+// save 将进度写入本地文件, 先写临时文件再重命名, 避免写到一半时退出导致文件损坏
+func (r *registry) save() {
+	if r == nil {
+		return
+	}
+	r.wlk.Lock()
+	defer r.wlk.Unlock()
+
+	r.lk.Lock()
+	if !r.dirty {
+		r.lk.Unlock()
+		return
+	}
+	entries := make([]*registryEntry, 0, len(r.entries))
+	for key, e := range r.entries {
+		// 文件已经不在记录的路径下并且长时间没有更新, 不再记录
+		id, _, err := utils.StatFileId(e.Path)
+		if (err != nil || id != e.FileId) && time.Since(time.Unix(e.Timestamp, 0)) > registryCleanAfter {
+			delete(r.entries, key)
+			continue
+		}
+		entries = append(entries, e)
+	}
+	b, err := json.Marshal(entries)
+	r.dirty = false
+	r.lk.Unlock()
+	if err != nil {
+		logrus.Error("Marshal registry error: ", err)
+		return
+	}
+
+	err = r.write(b)
+	if err != nil {
+		logrus.Error("Write registry file error: ", err)
+		// 写入失败 下次继续尝试
+		r.lk.Lock()
+		r.dirty = true
+		r.lk.Unlock()
+	}
+}
+
+// write 写入本地文件
+func (r *registry) write(b []byte) error {
+	err := os.MkdirAll(filepath.Dir(r.path), 0755)
+	if err != nil {
+		return err
+	}
+	tmp := r.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(b)
+	if err == nil {
+		err = f.Sync()
+	}
+	f.Close()
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, r.path)
+}
@@ -0,0 +1,93 @@
+package collects
+
+import (
+	"io/ioutil"
+	"logagent/conf"
+	"logagent/utils"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestRegistryTopics 两个收集器收集同一个文件时各自记录读取进度
+func TestRegistryTopics(t *testing.T) {
+	dir, err := ioutil.TempDir("", "registry")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "app.log")
+	if err := ioutil.WriteFile(path, []byte("0123456789\n0123456789\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	id, _, err := utils.StatFileId(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := &registry{path: filepath.Join(dir, "registry.json"), entries: map[string]*registryEntry{}}
+	// 之前的版本没有记录收集器
+	r.set("", path, id, 11, 1)
+	r.set("app", path, id, 22, 2)
+	r.save()
+
+	// 重新加载后依然区分收集器, 之前的版本的记录迁移给路径匹配的收集器
+	r = &registry{path: r.path, entries: map[string]*registryEntry{}}
+	if err := r.load(); err != nil {
+		t.Fatal(err)
+	}
+	r.migrate([]conf.EtcdInfo{
+		{Name: "app", Path: filepath.Join(dir, "*.log")},
+		{Name: "audit", Path: path},
+		{Name: "other", Path: filepath.Join(dir, "*.txt")},
+	})
+	if offset, line, _ := r.location("app", path); offset != 22 || line != 2 {
+		t.Errorf("app: got %d/%d, want 22/2", offset, line)
+	}
+	if offset, line, _ := r.location("audit", path); offset != 11 || line != 1 {
+		t.Errorf("audit: got %d/%d, want 11/1", offset, line)
+	}
+	// 迁移后删除之前的版本的记录, 其他收集器从头开始收集
+	if offset, _ := r.get("", path, id); offset != 0 {
+		t.Errorf("legacy entry should be deleted, got %d", offset)
+	}
+	if offset, _, _ := r.location("other", path); offset != 0 {
+		t.Errorf("other: got %d, want 0", offset)
+	}
+
+	r.set("audit", path, id, 5, 1)
+	if offset, _ := r.get("app", path, id); offset != 22 {
+		t.Errorf("app overwritten by audit: got %d", offset)
+	}
+	if offset, _, _ := r.location("audit", path); offset != 5 {
+		t.Errorf("audit: got %d, want 5", offset)
+	}
+}
+
+// TestRegistryMigrateUnmatched 没有收集器匹配的记录保留, 之后的启动时再迁移
+func TestRegistryMigrateUnmatched(t *testing.T) {
+	dir, err := ioutil.TempDir("", "registry")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "app.log")
+	if err := ioutil.WriteFile(path, []byte("0123456789\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	id, _, err := utils.StatFileId(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := &registry{path: filepath.Join(dir, "registry.json"), entries: map[string]*registryEntry{}}
+	r.set("", path, id, 11, 1)
+	r.migrate(nil)
+	if offset, _ := r.get("", path, id); offset != 11 {
+		t.Errorf("legacy entry should be kept, got %d", offset)
+	}
+	r.migrate([]conf.EtcdInfo{{Name: "app", Path: path}})
+	if offset, _, _ := r.location("app", path); offset != 11 {
+		t.Errorf("app: got %d, want 11", offset)
+	}
+}
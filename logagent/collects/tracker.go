@@ -0,0 +1,71 @@
+package collects
+
+import (
+	"logagent/utils"
+	"sync"
+)
+
+// pendingOffset 已经读取但是还没有被消息队列确认的行
+type pendingOffset struct {
+	offset int64 // 该行结束位置的偏移量
+	line   int64 // 该行的行号
+	acked  bool
+}
+
+// offsetTracker 记录单个文件中还没有确认的行
+// 只有前面的行全部被确认后才推进读取进度, 保证重启后不会跳过没有发送成功的行
+type offsetTracker struct {
+	lk      sync.Mutex
+	topic   string
+	path    string
+	fileId  utils.FileId
+	pending []*pendingOffset
+	acked   int64 // 已经确认的偏移量
+	line    int64 // 已经确认的行数
+	stale   bool  // 文件已经被轮转或者不再收集, 确认结果不再写入记录
+}
+
+func newOffsetTracker(topic string, path string, id utils.FileId, offset int64, line int64) *offsetTracker {
+	return &offsetTracker{
+		topic:  topic,
+		path:   path,
+		fileId: id,
+		acked:  offset,
+		line:   line,
+	}
+}
+
+// add 记录新读取的行
+func (t *offsetTracker) add(offset int64, line int64) *pendingOffset {
+	p := &pendingOffset{offset: offset, line: line}
+	t.lk.Lock()
+	t.pending = append(t.pending, p)
+	t.lk.Unlock()
+	return p
+}
+
+// ack 确认某一行已经发送成功
+func (t *offsetTracker) ack(p *pendingOffset) {
+	t.lk.Lock()
+	defer t.lk.Unlock()
+	p.acked = true
+
+	advanced := false
+	for len(t.pending) > 0 && t.pending[0].acked {
+		t.acked = t.pending[0].offset
+		t.line = t.pending[0].line
+		t.pending[0] = nil
+		t.pending = t.pending[1:]
+		advanced = true
+	}
+	if advanced && !t.stale {
+		fileRegistry.set(t.topic, t.path, t.fileId, t.acked, t.line)
+	}
+}
+
+// abandon 放弃该文件, 之后的确认结果不再写入记录
+func (t *offsetTracker) abandon() {
+	t.lk.Lock()
+	t.stale = true
+	t.lk.Unlock()
+}
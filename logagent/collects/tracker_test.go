@@ -0,0 +1,81 @@
+package collects
+
+import (
+	"logagent/utils"
+	"testing"
+)
+
+// useTestRegistry 使用内存中的偏移量记录, 返回恢复原来记录的函数
+func useTestRegistry() func() {
+	old := fileRegistry
+	fileRegistry = &registry{entries: map[string]*registryEntry{}}
+	return func() { fileRegistry = old }
+}
+
+var testFileId = utils.FileId{Device: 1, Inode: 2}
+
+func checkRegistry(t *testing.T, offset int64, line int64) {
+	t.Helper()
+	o, l := fileRegistry.get("log", "/tmp/app.log", testFileId)
+	if o != offset || l != line {
+		t.Errorf("registry: got %d/%d, want %d/%d", o, l, offset, line)
+	}
+}
+
+func TestTrackerOutOfOrder(t *testing.T) {
+	defer useTestRegistry()()
+
+	tracker := newOffsetTracker("log", "/tmp/app.log", testFileId, 0, 0)
+	p1 := tracker.add(10, 1)
+	p2 := tracker.add(20, 2)
+	p3 := tracker.add(30, 3)
+
+	// 前面的行没有确认时不推进
+	tracker.ack(p3)
+	tracker.ack(p2)
+	checkRegistry(t, 0, 0)
+
+	// 第一行确认后推进到连续确认的最后一行
+	tracker.ack(p1)
+	checkRegistry(t, 30, 3)
+
+	p4 := tracker.add(40, 4)
+	tracker.ack(p4)
+	checkRegistry(t, 40, 4)
+}
+
+func TestTrackerAbandon(t *testing.T) {
+	defer useTestRegistry()()
+
+	tracker := newOffsetTracker("log", "/tmp/app.log", testFileId, 0, 0)
+	p1 := tracker.add(10, 1)
+	p2 := tracker.add(20, 2)
+	tracker.ack(p1)
+	checkRegistry(t, 10, 1)
+
+	// 放弃之后迟到的确认不再写入记录
+	tracker.abandon()
+	tracker.ack(p2)
+	checkRegistry(t, 10, 1)
+}
+
+func TestTrackerTruncate(t *testing.T) {
+	defer useTestRegistry()()
+
+	// 截断前读取的行还没有确认
+	old := newOffsetTracker("log", "/tmp/app.log", testFileId, 0, 0)
+	p1 := old.add(100, 1)
+	p2 := old.add(200, 2)
+
+	// 和harvester一样, 截断后放弃旧的tracker, 从头开始记录
+	old.abandon()
+	tracker := newOffsetTracker("log", "/tmp/app.log", testFileId, 0, 0)
+	p := tracker.add(10, 1)
+	tracker.ack(p)
+	checkRegistry(t, 10, 1)
+
+	// 截断前的行迟到的确认不能覆盖截断后的进度
+	old.ack(p2)
+	old.ack(p1)
+	checkRegistry(t, 10, 1)
+}
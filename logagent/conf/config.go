@@ -2,6 +2,7 @@ package conf
 
 import (
 	"logagent/utils"
+	"os"
 
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
@@ -13,9 +14,56 @@ type config struct {
 	FullName    string
 	Endpoints   []string
 	DialTimeOut int64
+	Ip          string // 本机ip
+	HostName    string // 本机主机名
+	NodeId      string // 节点标识, 作为etcd的key的一部分
+	NodeSource  string // 节点标识的来源
+
+	Username     string        // etcd用户名, 为空时不认证
+	Password     string        // etcd密码
+	PasswordFile string        // etcd密码文件, 优先于Password
+	TLS          etcdTLSConfig // etcd的tls配置
+}
+
+// etcdTLSConfig etcd的tls配置, 证书和私钥都是文件路径
+type etcdTLSConfig struct {
+	Enable             bool
+	CA                 string // CA证书, 为空时使用系统的CA
+	Cert               string // 客户端证书
+	Key                string // 客户端私钥
+	InsecureSkipVerify bool   // 不校验服务端证书
+}
+
+// registryConfig 本地偏移量记录的配置
+type registryConfig struct {
+	Path          string // 偏移量文件的路径
+	FlushInterval int64  // 定期刷盘的间隔(秒)
+}
+
+// spoolConfig 本地队列的配置
+type spoolConfig struct {
+	Enable  bool   // 是否启用本地队列
+	Dir     string // 本地队列的根目录, 每个收集器一个子目录
+	MaxSize int64  // 每个收集器的本地队列的最大字节数
+}
+
+// snapshotConfig etcd配置的本地快照, etcd不可用时使用
+type snapshotConfig struct {
+	Path string // 快照文件的路径
+}
+
+// httpConfig http服务的配置
+type httpConfig struct {
+	Listen     string // 监听地址, 为空时不启动http服务
+	AdminToken string // 管理接口的token, 为空时不校验
 }
 
 var Configs config
+var RegistryConfigs registryConfig
+var SpoolConfigs spoolConfig
+var KafkaConfigs KafkaInfo // 默认的kafka加密和认证配置
+var SnapshotConfigs snapshotConfig
+var HttpConfigs httpConfig
 
 func Init(path, name, t string) {
 	initConfigs(path, name, t)
@@ -39,11 +87,78 @@ func initConfigs(path, name, t string) {
 		logrus.Fatal("Viper unmarshal config error: ", err)
 	}
 
-	// 获取本机ip
-	ip, err := utils.OutBoundIp()
+	// 偏移量记录的配置
+	viper.SetDefault("logagent.registry.path", "data/registry.json")
+	viper.SetDefault("logagent.registry.flushinterval", 5)
+	err = viper.UnmarshalKey("logagent.registry", &RegistryConfigs)
+	if err != nil {
+		logrus.Fatal("Viper unmarshal registry config error: ", err)
+	}
+
+	// 本地队列的配置
+	viper.SetDefault("logagent.spool.enable", true)
+	viper.SetDefault("logagent.spool.dir", "data/spool")
+	viper.SetDefault("logagent.spool.maxsize", 100*1024*1024)
+	err = viper.UnmarshalKey("logagent.spool", &SpoolConfigs)
+	if err != nil {
+		logrus.Fatal("Viper unmarshal spool config error: ", err)
+	}
+
+	// etcd配置的本地快照
+	viper.SetDefault("logagent.snapshot.path", "data/etcd-snapshot.json")
+	err = viper.UnmarshalKey("logagent.snapshot", &SnapshotConfigs)
+	if err != nil {
+		logrus.Fatal("Viper unmarshal snapshot config error: ", err)
+	}
+
+	// http服务的配置
+	viper.SetDefault("logagent.http.listen", ":9102")
+	err = viper.UnmarshalKey("logagent.http", &HttpConfigs)
+	if err != nil {
+		logrus.Fatal("Viper unmarshal http config error: ", err)
+	}
+
+	// kafka的加密和认证配置
+	err = viper.UnmarshalKey("logagent.kafka", &KafkaConfigs)
+	if err != nil {
+		logrus.Fatal("Viper unmarshal kafka config error: ", err)
+	}
+
+	// 解析节点标识
+	var node utils.NodeOptions
+	err = viper.UnmarshalKey("logagent.node", &node)
+	if err != nil {
+		logrus.Fatal("Viper unmarshal node config error: ", err)
+	}
+	Configs.NodeId, Configs.NodeSource, err = utils.ResolveNode(node)
+	if err != nil {
+		logrus.Fatal("Resolve node id error: ", err)
+	}
+	// 生成etcd的key: /root/id/basename
+	Configs.FullName = Configs.Root + "/" + Configs.NodeId + "/" + Configs.BaseName
+	Configs.Ip = localIp(node)
+
+	// 获取主机名
+	Configs.HostName, err = os.Hostname()
+	if err != nil {
+		logrus.Error("get hostname error: ", err)
+	}
+	logrus.Infof("Node id: %s, source: %s, ip: %s, hostname: %s, etcd key: %s",
+		Configs.NodeId, Configs.NodeSource, Configs.Ip, Configs.HostName, Configs.FullName)
+}
+
+// localIp 本机ip, 只用于消息中的来源信息
+// 没有配置网卡时为空, 不为了来源信息去访问外网, 获取失败时也为空
+func localIp(node utils.NodeOptions) string {
+	if Configs.NodeSource == utils.NodeInterface || Configs.NodeSource == utils.NodeIp {
+		return Configs.NodeId
+	}
+	if node.Interface == "" {
+		return ""
+	}
+	ip, err := utils.InterfaceIp(node.Interface)
 	if err != nil {
-		logrus.Fatal("get out bound ip error: ", err)
+		logrus.Warn("get local ip error: ", err)
 	}
-	// 生成etcd的key: /root/ip/basename
-	Configs.FullName = Configs.Root + "/" + ip + "/" + Configs.BaseName
+	return ip
 }
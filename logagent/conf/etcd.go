@@ -3,16 +3,80 @@ package conf
 import (
 	"context"
 	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
 	"time"
 
 	"github.com/sirupsen/logrus"
 	"go.etcd.io/etcd/clientv3"
+	"go.etcd.io/etcd/pkg/transport"
 )
 
 type EtcdInfo struct {
-	Name    string   `json:"name"`
-	MqHosts []string `json:"mqhosts"`
-	Path    string   `json:"path"`
+	Name         string            `json:"name"`
+	MqHosts      []string          `json:"mqhosts"`
+	Path         string            `json:"path"`                 // 文件路径, 支持通配符(包括**)和目录
+	ScanInterval int64             `json:"scaninterval"`         // 重新扫描匹配文件的间隔(秒)
+	Multiline    *MultilineInfo    `json:"multiline,omitempty"`  // 多行合并的配置
+	Format       string            `json:"format"`               // 消息格式: raw(默认) 只发送日志内容, json 发送带有来源信息的信封
+	Fields       map[string]string `json:"fields,omitempty"`     // 自定义字段, json格式时添加到信封中
+	Processors   []ProcessorInfo   `json:"processors,omitempty"` // 发送前按顺序执行的处理器
+	Producer     ProducerInfo      `json:"producer"`             // kafka生产者的配置
+	Kafka        *KafkaInfo        `json:"kafka,omitempty"`      // kafka的加密和认证配置, 为空时使用本地配置
+}
+
+// KafkaInfo kafka的加密和认证配置, 证书和密码都可以使用本机上的文件, 避免保存在etcd中
+type KafkaInfo struct {
+	TLS  KafkaTLSInfo  `json:"tls"`
+	SASL KafkaSASLInfo `json:"sasl"`
+}
+
+// KafkaTLSInfo tls配置
+type KafkaTLSInfo struct {
+	Enable             bool   `json:"enable"`
+	CA                 string `json:"ca"`                 // CA证书文件, 为空时使用系统的CA
+	Cert               string `json:"cert"`               // 客户端证书文件
+	Key                string `json:"key"`                // 客户端私钥文件
+	InsecureSkipVerify bool   `json:"insecureskipverify"` // 不校验服务端证书
+}
+
+// KafkaSASLInfo sasl配置
+type KafkaSASLInfo struct {
+	Mechanism    string `json:"mechanism"`    // 为空时不认证: PLAIN, SCRAM-SHA-256, SCRAM-SHA-512
+	User         string `json:"user"`         // 用户名
+	Password     string `json:"password"`     // 密码, 建议使用passwordfile
+	PasswordFile string `json:"passwordfile"` // 密码文件, 优先于password
+}
+
+// ProducerInfo kafka生产者的配置
+type ProducerInfo struct {
+	Mode        string `json:"mode"`        // 发送方式: sync(默认) 每条消息等待确认, async 批量异步发送
+	BatchSize   int    `json:"batchsize"`   // async: 每批的消息数, 默认500
+	Linger      int64  `json:"linger"`      // async: 每批的最长等待时间(毫秒), 默认100
+	Compression string `json:"compression"` // 压缩方式: none(默认), gzip, snappy, lz4, zstd
+	Idempotent  bool   `json:"idempotent"`  // 幂等发送, 需要kafka 0.11以上
+	Acks        string `json:"acks"`        // 确认级别: all(默认), leader, none
+	Key         string `json:"key"`         // 分区的key: hostpath(默认) 主机名+文件路径, field:<name> 自定义字段的值, random 随机分区
+}
+
+// ProcessorInfo 处理器的配置, 根据类型使用不同的字段
+type ProcessorInfo struct {
+	Type     string            `json:"type"`     // include, exclude, add_fields, drop_fields, truncate, rename
+	Patterns []string          `json:"patterns"` // include/exclude: 日志内容的正则
+	Fields   map[string]string `json:"fields"`   // add_fields: 添加的字段, rename: 旧名称->新名称
+	Names    []string          `json:"names"`    // drop_fields: 删除的字段
+	MaxBytes int               `json:"maxbytes"` // truncate: 日志内容的最大字节数
+}
+
+// MultilineInfo 多行合并的配置
+type MultilineInfo struct {
+	Start    string `json:"start"`    // 事件第一行的正则, 匹配的行会开始一个新的事件
+	Continue string `json:"continue"` // 后续行的正则, 匹配的行会追加到当前事件
+	Negate   bool   `json:"negate"`   // 对正则的匹配结果取反
+	MaxLines int    `json:"maxlines"` // 单个事件的最大行数
+	MaxBytes int    `json:"maxbytes"` // 单个事件的最大字节数
+	Timeout  int64  `json:"timeout"`  // 超过该时间(毫秒)没有新的行, 则发送缓存的事件
 }
 
 type Option func()
@@ -20,90 +84,157 @@ type Option func()
 var etcdClient *clientv3.Client
 var EtcdInfos []EtcdInfo
 
+// offline 启动时etcd不可用, 使用的是本地快照, 由watchLk保护
+var offline bool
+
+// isOffline 是否还在使用本地快照
+func isOffline() bool {
+	watchLk.Lock()
+	defer watchLk.Unlock()
+	return offline
+}
+
+// 重新连接etcd的间隔
+const (
+	reconnectBackoffMin = time.Second
+	reconnectBackoffMax = 30 * time.Second
+)
+
 func initEtcd() {
-	var err error
-	// 初始化etcd客户端
-	etcdClient, err = clientv3.New(clientv3.Config{
-		Endpoints:   Configs.Endpoints,                                // etcd集群地址
-		DialTimeout: time.Duration(Configs.DialTimeOut) * time.Second, // 连接超时时间
-	})
+	// 连接etcd并且获取配置信息, 失败时使用本地快照
+	err := connectEtcd()
+	if err == nil {
+		err = loadEtcd()
+	}
 	if err != nil {
-		logrus.Fatal("Create etcd client error: ", err)
+		logrus.Errorf("Etcd is unavailable: %v, start from snapshot %s", err, SnapshotConfigs.Path)
+		infos, err := loadSnapshot()
+		if err != nil {
+			logrus.Fatal("Load etcd snapshot error: ", err)
+		}
+		EtcdInfos = infos
+		watchLk.Lock()
+		offline = true
+		watchLk.Unlock()
 	}
+}
 
-	// 检查etcd的健康状况
+// connectEtcd 创建etcd客户端 并且检查etcd的健康状况
+func connectEtcd() error {
+	etcdConfig, err := newEtcdConfig()
+	if err != nil {
+		logrus.Fatal("Etcd config error: ", err)
+	}
+	client, err := clientv3.New(etcdConfig)
+	if err != nil {
+		return fmt.Errorf("create etcd client error: %v", err)
+	}
+	if etcdClient != nil {
+		etcdClient.Close()
+	}
+	etcdClient = client
+
+	// 检查etcd的健康状况, 超过半数的节点可用即可
 	if !checkEtcdHealth() {
-		logrus.Fatal("Connect etcd fail.")
+		return fmt.Errorf("quorum is not available: %v", Configs.Endpoints)
 	}
+	return nil
+}
 
-	// 获取配置信息
+// loadEtcd 获取配置信息
+func loadEtcd() error {
 	resp, err := etcdClient.Get(context.TODO(), Configs.FullName)
 	if err != nil {
-		logrus.Error("Etcd get info error: ", err)
+		return fmt.Errorf("get etcd key %s error: %v", Configs.FullName, err)
 	}
 
 	// 如果配置不存在，初始化etcd的信息
 	// 如果配置存在，初始化消息队列的信息
 	kvs := resp.Kvs
 	if len(kvs) == 0 {
+		logrus.Warnf("Etcd key %s not exists, create an empty config, check the node id if this node has been configured", Configs.FullName)
 		etcdClient.Put(context.TODO(), Configs.FullName, "[]")
 	} else {
 		err = json.Unmarshal(kvs[0].Value, &EtcdInfos)
 		if err != nil {
 			logrus.Fatal("unmarshal json error: ", err)
 		}
+		lastValue = kvs[0].Value
 		logrus.Debugf("Unmarshal etcd json suc: %v", EtcdInfos)
 	}
+	setRevision(resp.Header.Revision)
+	saveSnapshot(EtcdInfos)
+	return nil
 }
 
-// checkEtcdHealth 检查etcd的健康状况
-func checkEtcdHealth() bool {
-	timeoutCtx, cancel := context.WithTimeout(context.Background(), time.Duration(Configs.DialTimeOut)*time.Second)
-	defer cancel()
-	for _, ip := range Configs.Endpoints {
-		_, err := etcdClient.Status(timeoutCtx, ip)
-		if err != nil {
-			return false
+// waitEtcd 启动时etcd不可用, 按照退避时间重新连接, 直到连接成功并且重新读取配置
+func waitEtcd() {
+	backoff := reconnectBackoffMin
+	for {
+		time.Sleep(backoff)
+		err := connectEtcd()
+		if err == nil {
+			_, err = reloadEtcd()
+		}
+		if err == nil {
+			watchLk.Lock()
+			offline = false
+			watchLk.Unlock()
+			logrus.Info("Etcd is available, reconcile with etcd config")
+			return
+		}
+		logrus.Warnf("Etcd is still unavailable: %v, retry after %v", err, backoff)
+		backoff *= 2
+		if backoff > reconnectBackoffMax {
+			backoff = reconnectBackoffMax
 		}
 	}
-	return true
 }
 
-// 重新读取etcd的配置信息
-func reloadEtcd() error {
-	resp, err := etcdClient.Get(context.TODO(), Configs.FullName)
-	if err != nil {
-		logrus.Error("Get etcd key: %s error: %v", Configs.FullName, err)
-		return err
+// newEtcdConfig 生成etcd客户端的配置
+func newEtcdConfig() (clientv3.Config, error) {
+	c := clientv3.Config{
+		Endpoints:   Configs.Endpoints,                                // etcd集群地址
+		DialTimeout: time.Duration(Configs.DialTimeOut) * time.Second, // 连接超时时间
+		Username:    Configs.Username,
+		Password:    Configs.Password,
 	}
-
-	kvs := resp.Kvs
-	if len(kvs) == 0 {
-		return nil
+	if Configs.PasswordFile != "" {
+		b, err := ioutil.ReadFile(Configs.PasswordFile)
+		if err != nil {
+			return c, fmt.Errorf("read etcd password file error: %v", err)
+		}
+		c.Password = strings.TrimSpace(string(b))
 	}
-
-	newEtcdInfos := []EtcdInfo{}
-	err = json.Unmarshal(kvs[0].Value, &newEtcdInfos)
-	if err != nil {
-		logrus.Error("Unmarshal etcd json error: ", err)
-		return err
+	if Configs.TLS.Enable {
+		tlsInfo := transport.TLSInfo{
+			CertFile:           Configs.TLS.Cert,
+			KeyFile:            Configs.TLS.Key,
+			TrustedCAFile:      Configs.TLS.CA,
+			InsecureSkipVerify: Configs.TLS.InsecureSkipVerify,
+		}
+		tlsConfig, err := tlsInfo.ClientConfig()
+		if err != nil {
+			return c, fmt.Errorf("etcd tls config error: %v", err)
+		}
+		c.TLS = tlsConfig
 	}
-
-	EtcdInfos = newEtcdInfos
-	logrus.Debugf("Reload etcd json suc: %v", EtcdInfos)
-	return nil
+	return c, nil
 }
 
-// 监听etcd的key 并且执行回调函数
-func WatchEtcd(option Option) {
-	watcher := clientv3.NewWatcher(etcdClient)
-	wCh := watcher.Watch(context.TODO(), Configs.FullName)
-	for wresp := range wCh {
-		if len(wresp.Events) == 0 {
+// checkEtcdHealth 检查etcd的健康状况, 超过半数的节点可用时认为etcd可用
+// 不可用的节点只记录警告, 客户端会自动切换到可用的节点
+func checkEtcdHealth() bool {
+	healthy := 0
+	for _, ip := range Configs.Endpoints {
+		timeoutCtx, cancel := context.WithTimeout(context.Background(), time.Duration(Configs.DialTimeOut)*time.Second)
+		_, err := etcdClient.Status(timeoutCtx, ip)
+		cancel()
+		if err != nil {
+			logrus.Warnf("Etcd endpoint %s is unhealthy: %v", ip, err)
 			continue
 		}
-		if err := reloadEtcd(); err == nil {
-			option()
-		}
+		healthy++
 	}
+	return healthy > len(Configs.Endpoints)/2
 }
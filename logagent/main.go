@@ -3,10 +3,13 @@ package main
 import (
 	"logagent/collects"
 	"logagent/conf"
+	"logagent/metrics"
 	"logagent/utils"
+	"net/http"
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
 	"github.com/sirupsen/logrus"
 )
@@ -18,16 +21,36 @@ func signalHandler() {
 	switch s {
 	case syscall.SIGINT:
 		logrus.Debug("SIGINT......")
+		conf.CloseStatus()
 		collects.CloseManagers()
 		logrus.Debug("EXIT.")
 	case syscall.SIGTERM:
 		logrus.Debug("SIGTERM...")
+		conf.CloseStatus()
 		collects.CloseManagers()
 		logrus.Debug("EXIT.")
 	}
 	os.Exit(1)
 }
 
+// startHttpServer 启动http服务, 提供/metrics、/healthz、/readyz以及管理接口
+func startHttpServer(listen, adminToken string) {
+	if listen == "" {
+		return
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics.Handler())
+	mux.HandleFunc("/healthz", healthz)
+	mux.HandleFunc("/readyz", readyz)
+	registerAdmin(mux, adminToken)
+	go func() {
+		logrus.Infof("Http server listen on %s", listen)
+		if err := http.ListenAndServe(listen, mux); err != nil {
+			logrus.Errorf("Http server error: %v", err)
+		}
+	}()
+}
+
 func main() {
 	defer collects.CloseManagers()
 	defer func() {
@@ -37,6 +60,7 @@ func main() {
 		}
 	}()
 	logrus.SetLevel(logrus.DebugLevel)
+	logrus.AddHook(errorRecorder)
 
 	// 监听信号
 	go signalHandler()
@@ -45,9 +69,19 @@ func main() {
 	dir := utils.Getpwd()
 	conf.Init(dir+"docs", "configs", "yml")
 
+	// 启动http服务
+	startHttpServer(conf.HttpConfigs.Listen, conf.HttpConfigs.AdminToken)
+
+	// 加载文件的读取进度
+	collects.InitRegistry(conf.RegistryConfigs.Path, time.Duration(conf.RegistryConfigs.FlushInterval)*time.Second)
+
 	// 进行收集
 	collects.UpdateManagers()
 
+	// 在etcd中注册实例状态
+	conf.KeepStatus("logagent", currentStatus)
+	defer conf.CloseStatus()
+
 	// 监听etcd变化
 	conf.WatchEtcd(collects.UpdateManagers)
 }
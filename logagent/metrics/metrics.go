@@ -0,0 +1,113 @@
+package metrics
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// 事件被丢弃的原因
+const (
+	DropEmpty    = "empty"    // 空行
+	DropFiltered = "filtered" // 被处理器过滤
+	DropEncode   = "encode"   // 编码失败
+)
+
+// 发送结果
+const (
+	ResultSuccess = "success" // 被kafka确认
+	ResultFailure = "failure" // 发送失败, 之后会写入本地队列或者重试
+)
+
+var (
+	// LinesRead 读取的行数
+	LinesRead = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "logagent",
+		Name:      "lines_read_total",
+		Help:      "Lines read from files.",
+	}, []string{"name"})
+
+	// BytesRead 读取的字节数, 包括换行符
+	BytesRead = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "logagent",
+		Name:      "bytes_read_total",
+		Help:      "Bytes read from files.",
+	}, []string{"name"})
+
+	// EventsDropped 没有发送的事件数
+	EventsDropped = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "logagent",
+		Name:      "events_dropped_total",
+		Help:      "Events dropped before sending.",
+	}, []string{"name", "reason"})
+
+	// MessagesSent 发送的消息数, 重试的消息每次发送都会计数
+	MessagesSent = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "logagent",
+		Name:      "messages_sent_total",
+		Help:      "Messages sent to kafka by result.",
+	}, []string{"name", "result"})
+
+	// MessagesSpooled 写入本地队列的消息数
+	MessagesSpooled = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "logagent",
+		Name:      "messages_spooled_total",
+		Help:      "Messages written to the local spool.",
+	}, []string{"name"})
+
+	// SendLatency 单次发送的耗时
+	SendLatency = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "logagent",
+		Name:      "send_latency_seconds",
+		Help:      "Latency of sending a message to kafka.",
+		Buckets:   prometheus.ExponentialBuckets(0.001, 2, 15),
+	}, []string{"name"})
+
+	// SpoolMessages 本地队列中没有发送的消息数
+	SpoolMessages = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "logagent",
+		Name:      "spool_messages",
+		Help:      "Messages waiting in the local spool.",
+	}, []string{"name"})
+
+	// FileOffset 文件的读取位置
+	FileOffset = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "logagent",
+		Name:      "file_offset_bytes",
+		Help:      "Current read offset of a file.",
+	}, []string{"name", "path"})
+
+	// FileSize 文件的大小, 每次扫描时更新
+	FileSize = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "logagent",
+		Name:      "file_size_bytes",
+		Help:      "Size of a file at the last scan.",
+	}, []string{"name", "path"})
+
+	// Managers 收集器的数量
+	Managers = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "logagent",
+		Name:      "managers",
+		Help:      "Number of active file managers.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(
+		LinesRead, BytesRead, EventsDropped,
+		MessagesSent, MessagesSpooled, SendLatency, SpoolMessages,
+		FileOffset, FileSize, Managers,
+	)
+}
+
+// DeleteFile 文件停止收集后删除文件的指标
+func DeleteFile(name, path string) {
+	FileOffset.DeleteLabelValues(name, path)
+	FileSize.DeleteLabelValues(name, path)
+}
+
+// Handler /metrics的处理函数
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
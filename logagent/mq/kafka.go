@@ -3,150 +3,555 @@ package mq
 import (
 	"context"
 	"errors"
+	"logagent/metrics"
+	"path/filepath"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/Shopify/sarama"
 	"github.com/sirupsen/logrus"
 )
 
+// 发送失败后的重试间隔
+const (
+	retryBackoffMin = 100 * time.Millisecond
+	retryBackoffMax = 10 * time.Second
+)
+
+// 本地队列不为空时打印队列深度的间隔
+const spoolReportInterval = 30 * time.Second
+
+// 发送中的消息数的上限, 同步发送时只有一条消息在发送中, 保证发送失败重试时的顺序
+const asyncInflight = 4096
+
+var errNotConnected = errors.New("kafka is not connected")
+
 // kafka 生产者结构体
 type kafkaProducer struct {
-	hosts       []string                     // kafka地址
-	prod        sarama.SyncProducer          // 生产者对象
-	sendChan    chan *sarama.ProducerMessage // 发送channel
+	name        string       // 生产者名称, 作为指标的标签
+	hosts       []string     // kafka地址
+	security    SecurityConf // 加密和认证配置
+	conf        ProducerConf // 发送配置
+	gen         int          // 连接的版本, 地址或者配置更新后增加
+	lk          sync.RWMutex // 保护conn、地址和配置, 更新连接时使用, 发送时不持有
+	conn        *kafkaConn   // 当前的连接, 没有连接上kafka时为nil
+	sendChan    chan *kafkaMessage
 	kafkaConfig *sarama.Config
+	inflight    chan struct{} // 发送中的消息, 达到上限时等待
+	spool       *spool        // 本地队列, kafka不可用时写入, 没有配置时为nil
+	ctx         context.Context
 	cancel      context.CancelFunc
+	done        chan struct{} // work退出后关闭
+
+	stateLk sync.Mutex // 保护failing和lastErr
+	failing bool       // 最近一次发送是否失败
+	lastErr string     // 最近一次连接或者发送的错误
 }
 
-// newKafkaProducer 初始化kafka生产者
-func newKafkaProducer(clusters []string) (*kafkaProducer, error) {
-	if len(clusters) == 0 {
-		return nil, errors.New("conf.Cluster is not exists")
+// kafkaMessage 等待发送的消息
+type kafkaMessage struct {
+	topic string
+	key   string
+	value string
+	ack   func()
+	slot  chan struct{} // 占用的发送中的位置
+}
+
+// producerMessage 生成sarama的消息, 每次发送都使用新的对象
+func (m *kafkaMessage) producerMessage() *sarama.ProducerMessage {
+	msg := &sarama.ProducerMessage{
+		Topic: m.topic,
+		Value: sarama.StringEncoder(m.value),
 	}
+	if m.key != "" {
+		msg.Key = sarama.StringEncoder(m.key)
+	}
+	return msg
+}
 
-	config := sarama.NewConfig()
-	config.Producer.RequiredAcks = sarama.WaitForAll
-	config.Producer.Partitioner = sarama.NewRandomPartitioner
-	config.Producer.Return.Successes = true
+// finish 释放发送中的位置 并且通知调用方
+func (m *kafkaMessage) finish() {
+	if m.slot != nil {
+		<-m.slot
+		m.slot = nil
+	}
+	if m.ack != nil {
+		m.ack()
+	}
+}
 
-	client, err := sarama.NewSyncProducer(clusters, config)
+// newKafkaProducer 初始化kafka生产者
+// kafka不可用时在后台重连, 配置了本地队列时消息先写入本地队列
+func newKafkaProducer(conf MqConf) (*kafkaProducer, error) {
+	if len(conf.Clusters) == 0 {
+		return nil, errors.New("conf.Cluster is not exists")
+	}
+	config, err := newKafkaConfig(conf)
 	if err != nil {
 		return nil, err
 	}
 
 	kafka := &kafkaProducer{}
-	kafka.sendChan = make(chan *sarama.ProducerMessage)
-	kafka.hosts = clusters
-	kafka.prod = client
+	kafka.sendChan = make(chan *kafkaMessage)
+	kafka.name = conf.Name
+	kafka.hosts = conf.Clusters
+	kafka.conf = conf.Producer
+	kafka.security = conf.Security
 	kafka.kafkaConfig = config
+	kafka.inflight = newInflight(conf.Producer)
+	kafka.done = make(chan struct{})
+
+	if conf.Spool.Dir != "" {
+		sp, err := openSpool(filepath.Join(conf.Spool.Dir, conf.Name), conf.Spool.MaxSize)
+		if err != nil {
+			return nil, err
+		}
+		kafka.spool = sp
+	}
 
-	ctx, cancel := context.WithCancel(context.Background())
-	kafka.cancel = cancel
-	go kafka.work(ctx)
+	kafka.ctx, kafka.cancel = context.WithCancel(context.Background())
+	go kafka.connect(kafka.ctx, kafka.gen)
+	go kafka.work(kafka.ctx)
 
-	logrus.Debugf("Connect kafka suc, clusters: %v", clusters)
 	return kafka, nil
 }
 
+func newInflight(pc ProducerConf) chan struct{} {
+	if pc.Async {
+		return make(chan struct{}, asyncInflight)
+	}
+	return make(chan struct{}, 1)
+}
+
+// connect 连接kafka, 失败后按照退避时间一直重试, 直到连接成功、配置被更新或者生产者被关闭
+func (kafka *kafkaProducer) connect(ctx context.Context, gen int) {
+	kafka.lk.RLock()
+	clusters, config, async := kafka.hosts, kafka.kafkaConfig, kafka.conf.Async
+	kafka.lk.RUnlock()
+
+	backoff := retryBackoffMin
+	for {
+		sender, err := newKafkaSender(clusters, config, async)
+		if err == nil {
+			kafka.lk.Lock()
+			// 配置已经被更新或者生产者已经关闭
+			if ctx.Err() != nil || kafka.gen != gen {
+				kafka.lk.Unlock()
+				sender.close()
+				return
+			}
+			kafka.conn = &kafkaConn{sender: sender}
+			kafka.lk.Unlock()
+			logrus.Debugf("Connect kafka suc, clusters: %v", clusters)
+			return
+		}
+
+		kafka.setError(err)
+		logrus.Errorf("Connect kafka %v error: %v, retry after %v", clusters, err, backoff)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		kafka.lk.RLock()
+		changed := kafka.gen != gen
+		kafka.lk.RUnlock()
+		if changed {
+			return
+		}
+		backoff = nextBackoff(backoff)
+	}
+}
+
+// nextBackoff 下一次重试的间隔
+func nextBackoff(backoff time.Duration) time.Duration {
+	backoff *= 2
+	if backoff > retryBackoffMax {
+		backoff = retryBackoffMax
+	}
+	return backoff
+}
+
 // work kafka生产者开始工作
+// 本地队列为空时直接发送, 发送失败的消息写入本地队列
+// 本地队列不为空时新的消息也写入本地队列, 并且按照写入顺序重新发送, 保证消息的顺序
+// 没有本地队列时, 发送失败的消息一直重试
 func (kafka *kafkaProducer) work(ctx context.Context) {
-	var prodMsg *sarama.ProducerMessage
-	var isBreak bool
-	for !isBreak {
+	defer close(kafka.done)
+
+	// 定期将本地队列刷盘
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	backoff := retryBackoffMin
+	var retry <-chan time.Time
+	var reported time.Time
+	for {
+		var depth int64
+		if kafka.spool != nil {
+			depth, _, _ = kafka.spool.stats()
+		}
+		if depth == 0 {
+			retry = nil
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if kafka.spool != nil {
+					kafka.spool.sync()
+					metrics.SpoolMessages.WithLabelValues(kafka.name).Set(0)
+				}
+			case m := <-kafka.sendChan:
+				if !kafka.dispatch(ctx, m) {
+					return
+				}
+			}
+			continue
+		}
+
+		if retry == nil {
+			retry = time.After(backoff)
+		}
 		select {
 		case <-ctx.Done():
-			isBreak = true
-		case prodMsg = <-kafka.sendChan:
-			if prodMsg == nil {
-				isBreak = true
-				break
+			return
+		case now := <-ticker.C:
+			kafka.spool.sync()
+			metrics.SpoolMessages.WithLabelValues(kafka.name).Set(float64(depth))
+			if now.Sub(reported) >= spoolReportInterval {
+				reported = now
+				_, size, dropped := kafka.spool.stats()
+				logrus.Infof("Spool %s depth: %d messages, %d bytes, dropped %d", kafka.spool.dir, depth, size, dropped)
+			}
+		case m := <-kafka.sendChan:
+			if !kafka.spoolMessage(ctx, m) {
+				return
+			}
+		case <-retry:
+			retry = nil
+			if kafka.drain() {
+				backoff = retryBackoffMin
+				retry = time.After(0)
+				continue
+			}
+			backoff = nextBackoff(backoff)
+		}
+	}
+}
+
+// dispatch 占用发送中的位置后发送消息, 达到上限时等待, 生产者被关闭时返回false
+func (kafka *kafkaProducer) dispatch(ctx context.Context, m *kafkaMessage) bool {
+	kafka.lk.RLock()
+	slot := kafka.inflight
+	kafka.lk.RUnlock()
+	select {
+	case <-ctx.Done():
+		return false
+	case slot <- struct{}{}:
+	}
+	m.slot = slot
+	kafka.sendMessage(ctx, m, retryBackoffMin)
+	return true
+}
+
+// sendMessage 发送一次消息, 结果交给sent处理
+func (kafka *kafkaProducer) sendMessage(ctx context.Context, m *kafkaMessage, backoff time.Duration) {
+	start := time.Now()
+	done := func(err error) {
+		kafka.observe(start, err)
+		kafka.sent(ctx, m, backoff, err)
+	}
+	if !kafka.trySend(m.producerMessage(), done) {
+		done(errNotConnected)
+	}
+}
+
+// sent 处理发送结果, 发送失败的消息写入本地队列
+// 没有本地队列或者写入失败时(比如磁盘已满), 按照退避时间重新发送, 直到发送成功或者生产者被关闭
+// 异步发送时之后的消息已经交给sarama, 失败的消息会排在这些消息之后, 同步发送时不会乱序
+func (kafka *kafkaProducer) sent(ctx context.Context, m *kafkaMessage, backoff time.Duration, err error) {
+	if err == nil {
+		m.finish()
+		return
+	}
+	if err != errNotConnected {
+		logrus.Errorf("Send kafka message to topic %s error: %v", m.topic, err)
+	}
+	if kafka.spool != nil {
+		err := kafka.spool.push(m.record())
+		if err == nil {
+			metrics.MessagesSpooled.WithLabelValues(kafka.name).Inc()
+			m.finish()
+			return
+		}
+		logrus.Errorf("Write message to spool %s error: %v", kafka.spool.dir, err)
+	}
+
+	logrus.Debugf("Retry kafka message to topic %s after %v", m.topic, backoff)
+	time.AfterFunc(backoff, func() {
+		if ctx.Err() != nil {
+			// 生产者已经关闭, 没有确认的消息会在重启后从文件中重新读取
+			return
+		}
+		kafka.sendMessage(ctx, m, nextBackoff(backoff))
+	})
+}
+
+// record 本地队列中的消息
+func (m *kafkaMessage) record() *spoolRecord {
+	return &spoolRecord{
+		Topic:   m.topic,
+		Key:     m.key,
+		Message: m.value,
+	}
+}
+
+// spoolMessage 将消息写入本地队列, 写入成功后即可通知调用方
+// 写入失败时(比如磁盘已满)直接发送
+func (kafka *kafkaProducer) spoolMessage(ctx context.Context, m *kafkaMessage) bool {
+	if err := kafka.spool.push(m.record()); err != nil {
+		logrus.Errorf("Write message to spool %s error: %v", kafka.spool.dir, err)
+		return kafka.dispatch(ctx, m)
+	}
+	metrics.MessagesSpooled.WithLabelValues(kafka.name).Inc()
+	m.finish()
+	return true
+}
+
+// drainBatch 每次最多从本地队列发送的消息数, 避免长时间不接收新的消息
+const drainBatch = 100
+
+// drain 按顺序发送本地队列中的一批消息, 等待全部返回结果
+// 只确认第一条发送失败的消息之前的消息, 之后的消息下次重新发送, 有消息发送失败时返回false
+func (kafka *kafkaProducer) drain() bool {
+	recs := []*spoolRecord{}
+	for len(recs) < drainBatch {
+		rec, err := kafka.spool.read()
+		if err != nil {
+			logrus.Errorf("Read spool %s error: %v", kafka.spool.dir, err)
+			break
+		}
+		if rec == nil {
+			break
+		}
+		recs = append(recs, rec)
+	}
+	if len(recs) == 0 {
+		if depth, _, _ := kafka.spool.stats(); depth > 0 {
+			return false
+		}
+		logrus.Infof("Spool %s drained", kafka.spool.dir)
+		return true
+	}
+
+	errs := make([]error, len(recs))
+	var wg sync.WaitGroup
+	wg.Add(len(recs))
+	for i, rec := range recs {
+		i := i
+		m := &kafkaMessage{topic: rec.Topic, key: rec.Key, value: rec.Message}
+		start := time.Now()
+		done := func(err error) {
+			kafka.observe(start, err)
+			errs[i] = err
+			wg.Done()
+		}
+		if !kafka.trySend(m.producerMessage(), done) {
+			done(errNotConnected)
+		}
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			if err != errNotConnected {
+				logrus.Errorf("Send spool %s message error: %v", kafka.spool.dir, err)
 			}
-			partition, offset, err := kafka.prod.SendMessage(prodMsg)
-			logrus.Debugf("Send kafka message, result: partition %v, offseet %v, err %v", partition, offset, err)
+			kafka.spool.rewind()
+			return false
 		}
+		kafka.spool.pop()
+	}
+	return true
+}
+
+// observe 记录发送结果、耗时以及最近一次发送的状态, 没有连接上kafka时没有真正发送, 不计数
+func (kafka *kafkaProducer) observe(start time.Time, err error) {
+	if err == errNotConnected {
+		return
+	}
+	metrics.SendLatency.WithLabelValues(kafka.name).Observe(time.Since(start).Seconds())
+	result := metrics.ResultSuccess
+	if err != nil {
+		result = metrics.ResultFailure
+	}
+	metrics.MessagesSent.WithLabelValues(kafka.name, result).Inc()
+
+	kafka.stateLk.Lock()
+	kafka.failing = err != nil
+	kafka.stateLk.Unlock()
+	if err != nil {
+		kafka.setError(err)
 	}
 }
 
-// send 将消息发送给channel
-func (kafka *kafkaProducer) produce(mqMsg MessageQueueMessage) {
+// setError 记录最近一次错误
+func (kafka *kafkaProducer) setError(err error) {
+	kafka.stateLk.Lock()
+	kafka.lastErr = err.Error()
+	kafka.stateLk.Unlock()
+}
+
+// kafkaConn 一个连接, 记录正在交给sender的消息, 关闭前等待这些消息交给sender
+type kafkaConn struct {
+	sender  kafkaSender
+	sending sync.WaitGroup
+}
+
+// close 关闭连接, 调用前连接已经从生产者中移除, 不会再有新的消息
+func (c *kafkaConn) close() {
+	c.sending.Wait()
+	c.sender.close()
+}
+
+// trySend 交给sender发送, 没有连接上kafka时直接返回false
+// 发送可能阻塞(同步发送等待确认, 异步发送等待sarama接收), 只在取连接时持有锁, 避免阻塞更新和状态查询
+func (kafka *kafkaProducer) trySend(msg *sarama.ProducerMessage, done func(error)) bool {
+	kafka.lk.RLock()
+	conn := kafka.conn
+	if conn != nil {
+		conn.sending.Add(1)
+	}
+	kafka.lk.RUnlock()
+	if conn == nil {
+		return false
+	}
+	defer conn.sending.Done()
+	conn.sender.send(msg, done)
+	return true
+}
+
+// produce 将消息发送给channel, ack在kafka确认收到消息后调用
+func (kafka *kafkaProducer) produce(ctx context.Context, mqMsg MessageQueueMessage, ack func()) error {
 	// 去除首尾空格
 	mqMsg["message"] = strings.Trim(mqMsg["message"], " ")
 	mqMsg["topic"] = strings.Trim(mqMsg["topic"], " ")
 	if mqMsg["message"] == "" || mqMsg["topic"] == "" {
-		return
+		// 无需发送的消息直接确认
+		if ack != nil {
+			ack()
+		}
+		return nil
 	}
 
-	kafkaMsg := &sarama.ProducerMessage{}
-	kafkaMsg.Topic = mqMsg["topic"]
-	kafkaMsg.Value = sarama.StringEncoder(mqMsg["message"])
+	// 相同key的消息写入同一个分区
+	kafkaMsg := &kafkaMessage{
+		topic: mqMsg["topic"],
+		key:   mqMsg["key"],
+		value: mqMsg["message"],
+		ack:   ack,
+	}
 
-	// 进行超时重试 用于处理重新初始化sendChan的情况
-	retry := true
-	for retry {
-		select {
-		case <-time.After(time.Second):
-			retry = false
-		case kafka.sendChan <- kafkaMsg:
-			retry = false
-		}
+	// 阻塞等待发送 不再丢弃消息
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-kafka.ctx.Done():
+		return errors.New("kafka producer has closed")
+	case kafka.sendChan <- kafkaMsg:
+		return nil
 	}
 }
 
+// status 生产者的状态
+func (kafka *kafkaProducer) status() Status {
+	kafka.lk.RLock()
+	st := Status{Connected: kafka.conn != nil}
+	kafka.lk.RUnlock()
+	kafka.stateLk.Lock()
+	st.Failing, st.LastError = kafka.failing, kafka.lastErr
+	kafka.stateLk.Unlock()
+	if kafka.spool != nil {
+		st.SpoolMessages, st.SpoolBytes, st.SpoolDropped = kafka.spool.stats()
+	}
+	return st
+}
+
 // close 释放资源
 func (kafka *kafkaProducer) close() {
 	// 停止生产
 	if kafka.cancel != nil {
 		kafka.cancel()
-		kafka.cancel = nil
 	}
-	// 释放连接
-	if kafka.prod != nil {
-		kafka.prod.Close()
-		kafka.prod = nil
+	<-kafka.done
+	// 释放连接, 异步发送时等待已经发送的消息返回结果, 失败的消息写入本地队列
+	kafka.lk.Lock()
+	conn := kafka.conn
+	kafka.conn = nil
+	kafka.gen++
+	kafka.lk.Unlock()
+	if conn != nil {
+		conn.close()
 	}
-	// 关闭channel
-	if kafka.sendChan != nil {
-		close(kafka.sendChan)
-		kafka.sendChan = nil
+	if kafka.spool != nil {
+		kafka.spool.close()
 	}
+	metrics.SpoolMessages.DeleteLabelValues(kafka.name)
 }
 
-// 更新
-func (kafka *kafkaProducer) update(clusters ...string) error {
-	if len(clusters) == len(kafka.hosts) {
-		// slice转换为map
-		m := map[string]struct{}{}
-		for _, host := range clusters {
-			m[host] = struct{}{}
-		}
-		// 检查是否有变化
-		var update bool
-		for _, old := range kafka.hosts {
-			if _, ok := m[old]; ok {
-				update = true
-				break
-			}
-		}
-		if !update {
-			return nil
+// sameHosts 两组地址是否相同
+func sameHosts(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	m := map[string]struct{}{}
+	for _, host := range a {
+		m[host] = struct{}{}
+	}
+	for _, host := range b {
+		if _, ok := m[host]; !ok {
+			return false
 		}
 	}
+	return true
+}
 
-	kafka.close()
-	kafka.hosts = []string{}
-
-	// 创建新的连接
-	client, err := sarama.NewSyncProducer(clusters, kafka.kafkaConfig)
+// 更新
+// 地址、发送配置或者加密和认证配置变化时在后台重新连接, 连接成功之前发送的消息会写入本地队列或者等待重试
+func (kafka *kafkaProducer) update(conf MqConf) error {
+	if len(conf.Clusters) == 0 {
+		return errors.New("conf.Cluster is not exists")
+	}
+	config, err := newKafkaConfig(conf)
 	if err != nil {
 		return err
 	}
-	kafka.hosts = clusters
-	kafka.prod = client
-	kafka.sendChan = make(chan *sarama.ProducerMessage)
 
-	ctx, cancel := context.WithCancel(context.Background())
-	go kafka.work(ctx)
-	kafka.cancel = cancel
+	kafka.lk.Lock()
+	if sameHosts(kafka.hosts, conf.Clusters) && kafka.conf == conf.Producer && kafka.security == conf.Security {
+		kafka.lk.Unlock()
+		return nil
+	}
+	// 旧的连接不再使用, 避免消息发送到旧的集群
+	old := kafka.conn
+	kafka.conn = nil
+	if kafka.conf.Async != conf.Producer.Async {
+		kafka.inflight = newInflight(conf.Producer)
+	}
+	kafka.hosts = conf.Clusters
+	kafka.conf = conf.Producer
+	kafka.security = conf.Security
+	kafka.kafkaConfig = config
+	kafka.gen++
+	gen := kafka.gen
+	kafka.lk.Unlock()
+
+	go kafka.connect(kafka.ctx, gen)
+	// 在锁外等待旧的连接上正在发送的消息返回, 失败的消息写入本地队列或者等待重试
+	if old != nil {
+		old.close()
+	}
+	logrus.Debugf("Update kafka producer, clusters: %v, producer: %+v", conf.Clusters, conf.Producer)
 	return nil
 }
@@ -0,0 +1,75 @@
+package mq
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+)
+
+// blockingSender 发送时阻塞, 直到release被关闭
+type blockingSender struct {
+	sending chan struct{}
+	release chan struct{}
+	closed  chan struct{}
+}
+
+func (s *blockingSender) send(msg *sarama.ProducerMessage, done func(error)) {
+	close(s.sending)
+	<-s.release
+	done(nil)
+}
+
+func (s *blockingSender) close() {
+	close(s.closed)
+}
+
+// TestSendWithoutLock 发送阻塞时不影响状态查询, 关闭连接时等待正在发送的消息
+func TestSendWithoutLock(t *testing.T) {
+	sender := &blockingSender{
+		sending: make(chan struct{}),
+		release: make(chan struct{}),
+		closed:  make(chan struct{}),
+	}
+	kafka := &kafkaProducer{conn: &kafkaConn{sender: sender}}
+
+	sent := make(chan error, 1)
+	go kafka.trySend(&sarama.ProducerMessage{}, func(err error) { sent <- err })
+	<-sender.sending
+
+	status := make(chan Status, 1)
+	go func() { status <- kafka.status() }()
+	select {
+	case st := <-status:
+		if !st.Connected {
+			t.Error("producer should be connected")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("status blocked by send")
+	}
+
+	// 和update一样, 在锁内移除连接, 在锁外关闭
+	kafka.lk.Lock()
+	conn := kafka.conn
+	kafka.conn = nil
+	kafka.lk.Unlock()
+	if kafka.trySend(&sarama.ProducerMessage{}, func(error) {}) {
+		t.Error("send without connection should fail")
+	}
+	go conn.close()
+	select {
+	case <-sender.closed:
+		t.Fatal("sender closed before send returned")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(sender.release)
+	if err := <-sent; err != nil {
+		t.Errorf("send error: %v", err)
+	}
+	select {
+	case <-sender.closed:
+	case <-time.After(time.Second):
+		t.Fatal("sender not closed")
+	}
+}
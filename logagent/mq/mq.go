@@ -1,6 +1,11 @@
 package mq
 
-import "fmt"
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
 
 // MqConf mq的配置
 type MqConf struct {
@@ -8,12 +13,47 @@ type MqConf struct {
 	Flag MqType
 	// 消息队列的集群
 	Clusters []string
+	// 生产者名称, 作为本地队列的目录名
+	Name string
+	// 本地队列的配置
+	Spool SpoolConf
+	// 发送的配置
+	Producer ProducerConf
+	// 加密和认证的配置
+	Security SecurityConf
+}
+
+// ProducerConf 生产者的发送配置
+type ProducerConf struct {
+	Async       bool          // 异步批量发送, 默认同步发送
+	BatchSize   int           // 异步发送时每批的消息数
+	Linger      time.Duration // 异步发送时每批的最长等待时间
+	Compression string        // 压缩方式: none(默认), gzip, snappy, lz4, zstd
+	Idempotent  bool          // 幂等发送, 需要kafka 0.11以上, 确认级别必须为all
+	Acks        string        // 确认级别: all(默认), leader, none
+}
+
+// SpoolConf 本地队列的配置, 消息队列不可用时消息先写入本地队列
+type SpoolConf struct {
+	Dir     string // 本地队列的根目录, 为空时不使用本地队列
+	MaxSize int64  // 每个生产者的本地队列的最大字节数, 超过后丢弃最旧的消息
+}
+
+// Status 生产者的状态
+type Status struct {
+	Connected     bool   `json:"connected"`      // 是否连接上消息队列
+	Failing       bool   `json:"failing"`        // 最近一次发送是否失败
+	LastError     string `json:"last_error"`     // 最近一次连接或者发送的错误
+	SpoolMessages int64  `json:"spool_messages"` // 本地队列中没有发送的消息数
+	SpoolBytes    int64  `json:"spool_bytes"`    // 本地队列中没有发送的字节数
+	SpoolDropped  int64  `json:"spool_dropped"`  // 本地队列超过上限后丢弃的消息数
 }
 
 // producerInterface 消费者接口
 type producerInterface interface {
-	produce(msg MessageQueueMessage)
-	update(clusters ...string) error
+	produce(ctx context.Context, msg MessageQueueMessage, ack func()) error
+	update(conf MqConf) error
+	status() Status
 	close()
 }
 
@@ -40,7 +80,7 @@ func NewMessageQueueProducer(conf MqConf) (*MessageQueueProducer, error) {
 
 	switch conf.Flag {
 	case KAFKA:
-		p, err = newKafkaProducer(conf.Clusters)
+		p, err = newKafkaProducer(conf)
 	default:
 		err = fmt.Errorf("Not implement for message queue type: %d", conf.Flag)
 	}
@@ -55,9 +95,21 @@ func NewMessageQueueProducer(conf MqConf) (*MessageQueueProducer, error) {
 	}, nil
 }
 
-// Produce 发送消息
-func (p *MessageQueueProducer) Produce(mqMsg MessageQueueMessage) {
-	p.producer.produce(mqMsg)
+// Produce 发送消息, 消息被消息队列确认后调用ack
+// 发送失败的消息会一直重试, 只有ctx取消或者生产者关闭时才返回错误
+func (p *MessageQueueProducer) Produce(ctx context.Context, mqMsg MessageQueueMessage, ack func()) error {
+	if p.producer == nil {
+		return errors.New("producer has closed")
+	}
+	return p.producer.produce(ctx, mqMsg, ack)
+}
+
+// Status 生产者的状态
+func (p *MessageQueueProducer) Status() Status {
+	if p.producer == nil {
+		return Status{}
+	}
+	return p.producer.status()
 }
 
 // Close 关闭生产者
@@ -71,6 +123,10 @@ func (p *MessageQueueProducer) Close() {
 
 // 更新生产者的信息
 func (p *MessageQueueProducer) Update(conf MqConf) error {
-	err := p.producer.update(conf.Clusters...)
-	return err
+	err := p.producer.update(conf)
+	if err != nil {
+		return err
+	}
+	p.conf = conf
+	return nil
 }
@@ -0,0 +1,156 @@
+package mq
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/Shopify/sarama"
+)
+
+// 异步发送的默认配置
+const (
+	defaultBatchSize = 500
+	defaultLinger    = 100 * time.Millisecond
+)
+
+// kafkaSender 发送消息, 发送完成后调用done
+type kafkaSender interface {
+	send(msg *sarama.ProducerMessage, done func(error))
+	close()
+}
+
+// newKafkaConfig 根据发送配置以及加密和认证配置生成sarama的配置
+func newKafkaConfig(conf MqConf) (*sarama.Config, error) {
+	pc := conf.Producer
+	config := sarama.NewConfig()
+	config.Producer.Return.Successes = true
+	config.Producer.Return.Errors = true
+	// 相同key的消息写入同一个分区, 没有key时随机分区
+	config.Producer.Partitioner = sarama.NewHashPartitioner
+	config.Net.DialTimeout = 5 * time.Second
+
+	switch pc.Acks {
+	case "", "all":
+		config.Producer.RequiredAcks = sarama.WaitForAll
+	case "leader":
+		config.Producer.RequiredAcks = sarama.WaitForLocal
+	case "none":
+		config.Producer.RequiredAcks = sarama.NoResponse
+	default:
+		return nil, fmt.Errorf("wrong producer acks: %s", pc.Acks)
+	}
+
+	switch pc.Compression {
+	case "", "none":
+		config.Producer.Compression = sarama.CompressionNone
+	case "gzip":
+		config.Producer.Compression = sarama.CompressionGZIP
+	case "snappy":
+		config.Producer.Compression = sarama.CompressionSnappy
+	case "lz4":
+		config.Producer.Compression = sarama.CompressionLZ4
+		config.Version = sarama.V0_10_0_0
+	case "zstd":
+		config.Producer.Compression = sarama.CompressionZSTD
+		config.Version = sarama.V2_1_0_0
+	default:
+		return nil, fmt.Errorf("wrong producer compression: %s", pc.Compression)
+	}
+
+	if pc.Idempotent {
+		if config.Producer.RequiredAcks != sarama.WaitForAll {
+			return nil, fmt.Errorf("idempotent producer requires acks all")
+		}
+		config.Producer.Idempotent = true
+		config.Net.MaxOpenRequests = 1
+		if !config.Version.IsAtLeast(sarama.V0_11_0_0) {
+			config.Version = sarama.V0_11_0_0
+		}
+	}
+
+	if pc.Async {
+		config.Producer.Flush.Messages = pc.BatchSize
+		if config.Producer.Flush.Messages <= 0 {
+			config.Producer.Flush.Messages = defaultBatchSize
+		}
+		// 只按照消息数触发时, 消息较少时会一直等待
+		config.Producer.Flush.Frequency = pc.Linger
+		if config.Producer.Flush.Frequency <= 0 {
+			config.Producer.Flush.Frequency = defaultLinger
+		}
+	}
+
+	if err := applySecurity(config, conf.Security); err != nil {
+		return nil, err
+	}
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// newKafkaSender 连接kafka
+func newKafkaSender(hosts []string, config *sarama.Config, async bool) (kafkaSender, error) {
+	if async {
+		prod, err := sarama.NewAsyncProducer(hosts, config)
+		if err != nil {
+			return nil, err
+		}
+		return newAsyncSender(prod), nil
+	}
+	prod, err := sarama.NewSyncProducer(hosts, config)
+	if err != nil {
+		return nil, err
+	}
+	return &syncSender{prod: prod}, nil
+}
+
+// syncSender 同步发送, 每条消息等待kafka确认
+type syncSender struct {
+	prod sarama.SyncProducer
+}
+
+func (s *syncSender) send(msg *sarama.ProducerMessage, done func(error)) {
+	_, _, err := s.prod.SendMessage(msg)
+	done(err)
+}
+
+func (s *syncSender) close() {
+	s.prod.Close()
+}
+
+// asyncSender 异步发送, sarama按照批次发送, 确认结果通过Metadata中的done返回
+type asyncSender struct {
+	prod sarama.AsyncProducer
+	wg   sync.WaitGroup
+}
+
+func newAsyncSender(prod sarama.AsyncProducer) *asyncSender {
+	s := &asyncSender{prod: prod}
+	s.wg.Add(2)
+	go func() {
+		defer s.wg.Done()
+		for msg := range prod.Successes() {
+			msg.Metadata.(func(error))(nil)
+		}
+	}()
+	go func() {
+		defer s.wg.Done()
+		for e := range prod.Errors() {
+			e.Msg.Metadata.(func(error))(e.Err)
+		}
+	}()
+	return s
+}
+
+func (s *asyncSender) send(msg *sarama.ProducerMessage, done func(error)) {
+	msg.Metadata = done
+	s.prod.Input() <- msg
+}
+
+// close 等待已经发送的消息全部返回结果
+func (s *asyncSender) close() {
+	s.prod.AsyncClose()
+	s.wg.Wait()
+}
@@ -0,0 +1,378 @@
+package mq
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+// 本地队列的默认配置
+const (
+	defaultSpoolMaxSize = 100 * 1024 * 1024
+	spoolSegments       = 10 // 按照最大字节数分成的文件数量, 丢弃时以文件为单位
+	spoolMinSegmentSize = 1024 * 1024
+	spoolSuffix         = ".spool"
+	spoolHeadFile       = "head" // 记录读取位置的文件
+)
+
+// spoolRecord 本地队列中的消息
+type spoolRecord struct {
+	Topic   string `json:"topic"`
+	Key     string `json:"key,omitempty"`
+	Message string `json:"message"`
+}
+
+// spoolSegment 本地队列的文件, 对于第一个文件size和count只计算还没有读取的部分
+type spoolSegment struct {
+	seq   int64
+	size  int64
+	count int64
+}
+
+// spool 有大小上限的本地磁盘队列, 超过上限时丢弃最旧的消息
+// 消息按照写入顺序读取, 每行一条json格式的消息, 写满一个文件后写入新的文件
+type spool struct {
+	lk      sync.Mutex
+	dir     string
+	maxSize int64
+	segSize int64
+
+	segs    []*spoolSegment // 从旧到新
+	size    int64           // 没有读取的字节数
+	count   int64           // 没有读取的消息数
+	dropped int64           // 超过上限被丢弃的消息数
+
+	writer   *os.File
+	reader   *bufio.Reader
+	readerF  *os.File
+	readOff  int64   // 第一个文件的读取位置, 只在pop时推进
+	inflight []int64 // read读取但是还没有pop的消息的字节数
+}
+
+// openSpool 打开本地队列, 目录中已有的消息会被继续读取
+func openSpool(dir string, maxSize int64) (*spool, error) {
+	if maxSize <= 0 {
+		maxSize = defaultSpoolMaxSize
+	}
+	segSize := maxSize / spoolSegments
+	if segSize < spoolMinSegmentSize {
+		segSize = spoolMinSegmentSize
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	s := &spool{
+		dir:     dir,
+		maxSize: maxSize,
+		segSize: segSize,
+	}
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	if err := s.openWriter(); err != nil {
+		return nil, err
+	}
+	if s.count > 0 {
+		logrus.Infof("Open spool %s, %d messages left", dir, s.count)
+	}
+	return s, nil
+}
+
+// load 读取目录中已有的文件以及读取位置
+func (s *spool) load() error {
+	files, err := filepath.Glob(filepath.Join(s.dir, "*"+spoolSuffix))
+	if err != nil {
+		return err
+	}
+	seqs := []int64{}
+	for _, file := range files {
+		seq, err := strconv.ParseInt(strings.TrimSuffix(filepath.Base(file), spoolSuffix), 10, 64)
+		if err != nil {
+			continue
+		}
+		seqs = append(seqs, seq)
+	}
+	sort.Slice(seqs, func(i, j int) bool { return seqs[i] < seqs[j] })
+
+	// 读取位置 {seq} {offset}
+	var headSeq, headOff int64
+	if b, err := ioutil.ReadFile(filepath.Join(s.dir, spoolHeadFile)); err == nil {
+		fmt.Sscanf(string(b), "%d %d", &headSeq, &headOff)
+	}
+
+	for _, seq := range seqs {
+		if seq < headSeq {
+			// 已经读取完成的文件
+			os.Remove(s.segPath(seq))
+			continue
+		}
+		skip := int64(0)
+		if seq == headSeq {
+			skip = headOff
+		}
+		seg, err := s.scan(seq, skip)
+		if err != nil {
+			return err
+		}
+		if len(s.segs) == 0 {
+			s.readOff = skip
+		}
+		s.segs = append(s.segs, seg)
+		s.size += seg.size
+		s.count += seg.count
+	}
+	return nil
+}
+
+// scan 统计文件中skip之后的消息
+// 写入时进程退出会在文件末尾留下不完整的消息, 截断这部分内容, 避免读取时一直读到不完整的行
+func (s *spool) scan(seq, skip int64) (*spoolSegment, error) {
+	f, err := os.Open(s.segPath(seq))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if _, err := f.Seek(skip, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	seg := &spoolSegment{seq: seq}
+	r := bufio.NewReader(f)
+	for {
+		line, err := r.ReadBytes('\n')
+		if len(line) > 0 && line[len(line)-1] == '\n' {
+			seg.size += int64(len(line))
+			seg.count++
+		} else if len(line) > 0 {
+			logrus.Warnf("Spool %s truncate incomplete message of %d bytes at the end of %s", s.dir, len(line), s.segPath(seq))
+			if err := os.Truncate(s.segPath(seq), skip+seg.size); err != nil {
+				return nil, err
+			}
+		}
+		if err != nil {
+			break
+		}
+	}
+	return seg, nil
+}
+
+func (s *spool) segPath(seq int64) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%020d%s", seq, spoolSuffix))
+}
+
+// openWriter 写入新的文件
+func (s *spool) openWriter() error {
+	seq := int64(1)
+	if len(s.segs) > 0 {
+		seq = s.segs[len(s.segs)-1].seq + 1
+	}
+	f, err := os.OpenFile(s.segPath(seq), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	if s.writer != nil {
+		s.writer.Sync()
+		s.writer.Close()
+	}
+	s.writer = f
+	s.segs = append(s.segs, &spoolSegment{seq: seq})
+	return nil
+}
+
+// push 写入消息, 超过上限时丢弃最旧的文件
+func (s *spool) push(rec *spoolRecord) error {
+	b, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+
+	s.lk.Lock()
+	defer s.lk.Unlock()
+
+	tail := s.segs[len(s.segs)-1]
+	if tail.size > 0 && tail.size+int64(len(b)) > s.segSize {
+		if err := s.openWriter(); err != nil {
+			return err
+		}
+		tail = s.segs[len(s.segs)-1]
+	}
+	for s.size+int64(len(b)) > s.maxSize && len(s.segs) > 1 {
+		s.dropHead()
+	}
+
+	if _, err := s.writer.Write(b); err != nil {
+		// 去掉写入了一部分的消息, 之后的消息不会接在不完整的消息后面
+		end := tail.size
+		if len(s.segs) == 1 {
+			end += s.readOff
+		}
+		s.writer.Truncate(end)
+		return err
+	}
+	tail.size += int64(len(b))
+	tail.count++
+	s.size += int64(len(b))
+	s.count++
+	return nil
+}
+
+// dropHead 丢弃最旧的文件
+func (s *spool) dropHead() {
+	seg := s.segs[0]
+	s.closeReader()
+	os.Remove(s.segPath(seg.seq))
+	s.segs = s.segs[1:]
+	s.size -= seg.size
+	s.count -= seg.count
+	s.dropped += seg.count
+	s.readOff = 0
+	s.saveHead()
+	logrus.Warnf("Spool %s is full, drop %d oldest messages", s.dir, seg.count)
+}
+
+// read 按顺序读取下一条消息, 读取的消息需要pop确认或者rewind重新读取
+// 没有可以读取的消息时返回nil, 只在第一个文件中读取, 第一个文件读完并且全部pop之后才读取下一个文件
+func (s *spool) read() (*spoolRecord, error) {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+
+	for {
+		if s.count == 0 {
+			return nil, nil
+		}
+		seg := s.segs[0]
+		if seg.count == 0 {
+			// 第一个文件已经读取完成, 写入中的文件不会为空
+			s.closeReader()
+			os.Remove(s.segPath(seg.seq))
+			s.segs = s.segs[1:]
+			s.readOff = 0
+			s.saveHead()
+			continue
+		}
+		if int64(len(s.inflight)) >= seg.count {
+			return nil, nil
+		}
+
+		if s.reader == nil {
+			f, err := os.Open(s.segPath(seg.seq))
+			if err != nil {
+				return nil, err
+			}
+			if _, err := f.Seek(s.readOff, io.SeekStart); err != nil {
+				f.Close()
+				return nil, err
+			}
+			s.readerF = f
+			s.reader = bufio.NewReader(f)
+		}
+
+		line, err := s.reader.ReadBytes('\n')
+		if err != nil {
+			// 写入的内容还没有完整读到, 重新读取
+			s.closeReader()
+			return nil, err
+		}
+		rec := &spoolRecord{}
+		if err := json.Unmarshal(line, rec); err != nil {
+			logrus.Errorf("Spool %s read wrong message: %v", s.dir, err)
+			if len(s.inflight) > 0 {
+				// 先确认前面的消息, 重新读取时再跳过
+				s.closeReader()
+				return nil, nil
+			}
+			// 损坏的消息直接跳过
+			s.advance(int64(len(line)))
+			continue
+		}
+		s.inflight = append(s.inflight, int64(len(line)))
+		return rec, nil
+	}
+}
+
+// pop 确认最早读取的消息已经发送
+func (s *spool) pop() {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+	if len(s.inflight) == 0 {
+		return
+	}
+	s.advance(s.inflight[0])
+	s.inflight = s.inflight[1:]
+}
+
+// rewind 没有pop的消息下次重新读取
+func (s *spool) rewind() {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+	s.closeReader()
+}
+
+// advance 推进第一个文件的读取位置
+func (s *spool) advance(n int64) {
+	seg := s.segs[0]
+	seg.size -= n
+	seg.count--
+	s.size -= n
+	s.count--
+	s.readOff += n
+}
+
+func (s *spool) closeReader() {
+	if s.readerF != nil {
+		s.readerF.Close()
+		s.readerF = nil
+	}
+	s.reader = nil
+	s.inflight = nil
+}
+
+// saveHead 记录读取位置
+func (s *spool) saveHead() {
+	content := fmt.Sprintf("%d %d", s.segs[0].seq, s.readOff)
+	if err := ioutil.WriteFile(filepath.Join(s.dir, spoolHeadFile), []byte(content), 0644); err != nil {
+		logrus.Errorf("Save spool %s head error: %v", s.dir, err)
+	}
+}
+
+// sync 将写入的消息刷盘 并且记录读取位置
+func (s *spool) sync() {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+	if s.writer != nil {
+		s.writer.Sync()
+	}
+	s.saveHead()
+}
+
+// stats 没有发送的消息数、字节数以及丢弃的消息数
+func (s *spool) stats() (count, size, dropped int64) {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+	return s.count, s.size, s.dropped
+}
+
+// close 释放资源
+func (s *spool) close() {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+	s.closeReader()
+	if s.writer != nil {
+		s.writer.Sync()
+		s.writer.Close()
+		s.writer = nil
+	}
+	s.saveHead()
+}
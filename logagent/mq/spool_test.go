@@ -0,0 +1,199 @@
+package mq
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+// tempDir 测试用的目录, 返回删除目录的函数
+func tempDir(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir, func() { os.RemoveAll(dir) }
+}
+
+// readAll 读取并且确认全部消息
+func readAll(t *testing.T, s *spool) []string {
+	msgs := []string{}
+	for {
+		rec, err := s.read()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rec == nil {
+			return msgs
+		}
+		msgs = append(msgs, rec.Message)
+		s.pop()
+	}
+}
+
+func TestSpoolRoundTrip(t *testing.T) {
+	dir, clean := tempDir(t)
+	defer clean()
+	s, err := openSpool(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.close()
+
+	for i := 0; i < 3; i++ {
+		if err := s.push(&spoolRecord{Topic: "log", Message: fmt.Sprintf("msg-%d", i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if count, _, _ := s.stats(); count != 3 {
+		t.Fatalf("got %d messages, want 3", count)
+	}
+
+	// 没有pop的消息在rewind之后重新读取
+	rec, _ := s.read()
+	s.pop()
+	if rec.Message != "msg-0" || rec.Topic != "log" {
+		t.Errorf("wrong first record: %+v", rec)
+	}
+	rec, _ = s.read()
+	if rec.Message != "msg-1" {
+		t.Errorf("wrong second record: %+v", rec)
+	}
+	s.rewind()
+
+	msgs := readAll(t, s)
+	if strings.Join(msgs, ",") != "msg-1,msg-2" {
+		t.Errorf("got %v after rewind", msgs)
+	}
+	if count, size, dropped := s.stats(); count != 0 || size != 0 || dropped != 0 {
+		t.Errorf("got stats %d %d %d after drain", count, size, dropped)
+	}
+}
+
+func TestSpoolDropOldest(t *testing.T) {
+	// 每个文件1MB, 最多2MB
+	maxSize := int64(2 * spoolMinSegmentSize)
+	dir, clean := tempDir(t)
+	defer clean()
+	s, err := openSpool(dir, maxSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.close()
+
+	payload := strings.Repeat("x", 100*1024)
+	total := 30
+	for i := 0; i < total; i++ {
+		if err := s.push(&spoolRecord{Topic: "log", Message: fmt.Sprintf("%03d-%s", i, payload)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	count, size, dropped := s.stats()
+	if dropped == 0 || size > maxSize {
+		t.Fatalf("spool is not bounded: count %d, size %d, dropped %d", count, size, dropped)
+	}
+	if count+dropped != int64(total) {
+		t.Errorf("count %d + dropped %d != %d", count, dropped, total)
+	}
+
+	// 丢弃的是最旧的消息, 剩下的消息依然按顺序读取
+	msgs := readAll(t, s)
+	if int64(len(msgs)) != count {
+		t.Fatalf("read %d messages, want %d", len(msgs), count)
+	}
+	for i, msg := range msgs {
+		want := fmt.Sprintf("%03d-", int(dropped)+i)
+		if !strings.HasPrefix(msg, want) {
+			t.Fatalf("message %d: got %s, want prefix %s", i, msg[:4], want)
+		}
+	}
+}
+
+func TestSpoolRecovery(t *testing.T) {
+	dir, clean := tempDir(t)
+	defer clean()
+	s, err := openSpool(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		if err := s.push(&spoolRecord{Topic: "log", Message: fmt.Sprintf("msg-%d", i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// 确认两条, 读取但是没有确认一条
+	for i := 0; i < 2; i++ {
+		s.read()
+		s.pop()
+	}
+	s.read()
+	s.close()
+
+	s, err = openSpool(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.close()
+	if count, _, _ := s.stats(); count != 3 {
+		t.Fatalf("got %d messages after restart, want 3", count)
+	}
+	// 重启后继续写入新的文件
+	if err := s.push(&spoolRecord{Topic: "log", Message: "msg-5"}); err != nil {
+		t.Fatal(err)
+	}
+	msgs := readAll(t, s)
+	if strings.Join(msgs, ",") != "msg-2,msg-3,msg-4,msg-5" {
+		t.Errorf("got %v after restart", msgs)
+	}
+}
+
+// TestSpoolIncompleteTail 写入时进程退出留下的不完整消息在打开时被截断
+func TestSpoolIncompleteTail(t *testing.T) {
+	dir, clean := tempDir(t)
+	defer clean()
+	s, err := openSpool(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := s.push(&spoolRecord{Topic: "log", Message: fmt.Sprintf("msg-%d", i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	path := s.segPath(s.segs[0].seq)
+	s.close()
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"topic":"log","mess`)
+	f.Close()
+	before, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err = openSpool(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.close()
+	after, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if after.Size() != before.Size()-int64(len(`{"topic":"log","mess`)) {
+		t.Errorf("incomplete message not truncated: size %d, before %d", after.Size(), before.Size())
+	}
+	if err := s.push(&spoolRecord{Topic: "log", Message: "msg-2"}); err != nil {
+		t.Fatal(err)
+	}
+	// readAll遇到错误时失败
+	msgs := readAll(t, s)
+	if strings.Join(msgs, ",") != "msg-0,msg-1,msg-2" {
+		t.Errorf("got %v after restart", msgs)
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"logagent/collects"
+	"logagent/conf"
+	"logagent/utils"
+	"os"
+	"time"
+)
+
+// version 版本号, 编译时通过`-ldflags "-X main.version=x.y.z"`设置
+var version = "dev"
+
+var startTime = time.Now()
+
+// errorRecorder 最近的错误日志, 写入实例状态
+var errorRecorder = utils.NewErrorRecorder(20)
+
+// instanceStatus 注册到etcd中的实例状态
+type instanceStatus struct {
+	Service    string             `json:"service"`
+	Version    string             `json:"version"`
+	StartTime  time.Time          `json:"start_time"`
+	UpdateTime time.Time          `json:"update_time"`
+	Node       string             `json:"node"`        // 节点标识
+	NodeSource string             `json:"node_source"` // 节点标识的来源
+	Hostname   string             `json:"hostname"`
+	Http       string             `json:"http"` // http服务的监听地址
+	Sources    []sourceStatus     `json:"sources"`
+	Errors     []utils.ErrorEntry `json:"errors"` // 最近的错误日志
+}
+
+// sourceStatus 收集器的状态以及文件的读取进度
+type sourceStatus struct {
+	Name      string                `json:"name"`
+	Path      string                `json:"path"`
+	State     string                `json:"state"`
+	LastError string                `json:"last_error"`
+	Files     []collects.FileStatus `json:"files"`
+}
+
+// currentStatus 生成当前的实例状态
+func currentStatus() interface{} {
+	hostname, _ := os.Hostname()
+	st := instanceStatus{
+		Service:    "logagent",
+		Version:    version,
+		StartTime:  startTime,
+		UpdateTime: time.Now(),
+		Node:       conf.Configs.NodeId,
+		NodeSource: conf.Configs.NodeSource,
+		Hostname:   hostname,
+		Http:       conf.HttpConfigs.Listen,
+		Sources:    []sourceStatus{},
+		Errors:     errorRecorder.Recent(),
+	}
+
+	files := map[string][]collects.FileStatus{}
+	for _, m := range collects.Managers() {
+		files[m.Config.Name] = m.Files
+	}
+	for _, m := range collects.Status() {
+		st.Sources = append(st.Sources, sourceStatus{
+			Name:      m.Name,
+			Path:      m.Path,
+			State:     m.State,
+			LastError: m.LastError,
+			Files:     files[m.Name],
+		})
+	}
+	return st
+}
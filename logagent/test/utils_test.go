@@ -1,8 +1,14 @@
 package test
 
 import (
+	"errors"
+	"io/ioutil"
 	"logagent/utils"
+	"os"
+	"path/filepath"
 	"testing"
+
+	"github.com/sirupsen/logrus"
 )
 
 func TestNetworkIps(t *testing.T) {
@@ -22,3 +28,125 @@ func TestOutBoundIp(t *testing.T) {
 	}
 	t.Log(ip)
 }
+
+func TestStatFileId(t *testing.T) {
+	f, err := ioutil.TempFile("", "fileid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.Close()
+
+	id1, _, err := utils.StatFileId(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	id2, _, err := utils.StatFileId(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id1 != id2 {
+		t.Fatalf("file id changed: %v, %v", id1, id2)
+	}
+	t.Log(id1)
+}
+
+func TestGlob(t *testing.T) {
+	dir, err := ioutil.TempDir("", "glob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := []string{"app-1.log", "app-2.log", "other.txt", "a/app-3.log", "a/b/app-4.log"}
+	for _, f := range files {
+		path := filepath.Join(dir, f)
+		os.MkdirAll(filepath.Dir(path), 0755)
+		if err := ioutil.WriteFile(path, []byte("log\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cases := map[string]int{
+		dir + "/app-*.log":    2,
+		dir + "/**/app-*.log": 4,
+		dir + "/**/*.txt":     1,
+		dir + "/a/**":         2,
+		dir:                   3,
+	}
+	for pattern, count := range cases {
+		matched, err := utils.Glob(pattern)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(matched) != count {
+			t.Errorf("pattern %s matched %v, want %d files", pattern, matched, count)
+		}
+	}
+}
+
+func TestResolveNode(t *testing.T) {
+	os.Setenv("LOGAGENT_TEST_NODE", "node-1")
+	defer os.Unsetenv("LOGAGENT_TEST_NODE")
+
+	cases := []struct {
+		opts   utils.NodeOptions
+		id     string
+		source string
+	}{
+		{utils.NodeOptions{Id: "agent-1", Env: "LOGAGENT_TEST_NODE"}, "agent-1", utils.NodeId},
+		{utils.NodeOptions{Env: "LOGAGENT_TEST_NODE"}, "node-1", utils.NodeEnv},
+		{utils.NodeOptions{Source: utils.NodeEnv, Env: "LOGAGENT_TEST_NODE"}, "node-1", utils.NodeEnv},
+	}
+	for _, c := range cases {
+		id, source, err := utils.ResolveNode(c.opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if id != c.id || source != c.source {
+			t.Errorf("resolve %+v: got %s(%s), want %s(%s)", c.opts, id, source, c.id, c.source)
+		}
+	}
+
+	// 没有任何配置时auto和之前的版本一样使用出口ip, 获取失败时使用主机名
+	want, err := utils.OutBoundIp()
+	wantSource := utils.NodeIp
+	if err != nil {
+		want, _ = os.Hostname()
+		wantSource = utils.NodeHostname
+	}
+	if id, source, err := utils.ResolveNode(utils.NodeOptions{}); err != nil || id != want || source != wantSource {
+		t.Errorf("auto should use outbound ip: got %s(%s), %v, want %s(%s)", id, source, err, want, wantSource)
+	}
+
+	// 环境变量不存在时auto跳过, 指定来源时返回错误
+	if _, source, err := utils.ResolveNode(utils.NodeOptions{Env: "LOGAGENT_TEST_NOT_EXIST"}); err != nil || source == utils.NodeEnv {
+		t.Errorf("auto should skip empty env: %s, %v", source, err)
+	}
+	if _, _, err := utils.ResolveNode(utils.NodeOptions{Source: utils.NodeEnv, Env: "LOGAGENT_TEST_NOT_EXIST"}); err == nil {
+		t.Error("empty env should fail")
+	}
+	if _, _, err := utils.ResolveNode(utils.NodeOptions{Id: "a/b", Source: utils.NodeId}); err == nil {
+		t.Error("node id with '/' should fail")
+	}
+}
+
+func TestErrorRecorder(t *testing.T) {
+	r := utils.NewErrorRecorder(2)
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+	logger.AddHook(r)
+
+	logger.Warn("warn is ignored")
+	logger.Error("first")
+	logger.WithError(errors.New("broken")).Error("second")
+	logger.Error("third")
+
+	entries := r.Recent()
+	if len(entries) != 2 {
+		t.Fatalf("got %d entries, want 2", len(entries))
+	}
+	if entries[0].Message != "second: broken" || entries[1].Message != "third" {
+		t.Errorf("got %+v", entries)
+	}
+}
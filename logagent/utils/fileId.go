@@ -0,0 +1,18 @@
+package utils
+
+import "os"
+
+// FileId 文件的唯一标识, 用于判断文件是否被轮转或者替换
+type FileId struct {
+	Device uint64 `json:"device"`
+	Inode  uint64 `json:"inode"`
+}
+
+// StatFileId 获取文件的唯一标识
+func StatFileId(path string) (FileId, os.FileInfo, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return FileId{}, nil, err
+	}
+	return fileIdOf(info), info, nil
+}
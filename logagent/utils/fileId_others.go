@@ -0,0 +1,21 @@
+//go:build !windows
+// +build !windows
+
+package utils
+
+import (
+	"os"
+	"syscall"
+)
+
+// fileIdOf 使用设备号和inode作为文件标识
+func fileIdOf(info os.FileInfo) FileId {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return FileId{}
+	}
+	return FileId{
+		Device: uint64(st.Dev),
+		Inode:  uint64(st.Ino),
+	}
+}
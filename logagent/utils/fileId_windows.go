@@ -0,0 +1,8 @@
+package utils
+
+import "os"
+
+// fileIdOf windows下没有inode, 只能依靠路径区分文件
+func fileIdOf(info os.FileInfo) FileId {
+	return FileId{}
+}
@@ -0,0 +1,100 @@
+package utils
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Glob 查找匹配的文件(不包括目录), 在filepath.Glob的基础上支持`**`匹配任意层级的目录
+// 如果pattern是一个目录, 则返回目录下的全部文件
+func Glob(pattern string) ([]string, error) {
+	pattern = filepath.ToSlash(pattern)
+	if info, err := os.Stat(pattern); err == nil && info.IsDir() {
+		pattern = strings.TrimSuffix(pattern, "/") + "/*"
+	}
+
+	if !strings.Contains(pattern, "**") {
+		matched, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, err
+		}
+		// 去掉匹配到的目录
+		files := []string{}
+		for _, path := range matched {
+			if info, err := os.Stat(path); err == nil && !info.IsDir() {
+				files = append(files, path)
+			}
+		}
+		return files, nil
+	}
+
+	// 找到第一个包含通配符的目录层级, 之前的部分作为遍历的起点
+	segs := strings.Split(pattern, "/")
+	i := 0
+	for ; i < len(segs); i++ {
+		if strings.ContainsAny(segs[i], "*?[\\") {
+			break
+		}
+	}
+	root := strings.Join(segs[:i], "/")
+	if root == "" {
+		if strings.HasPrefix(pattern, "/") {
+			root = "/"
+		} else {
+			root = "."
+		}
+	}
+	patSegs := segs[i:]
+
+	files := []string{}
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			// 没有权限等错误直接跳过
+			return nil
+		}
+		if info.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return nil
+		}
+		if matchSegments(patSegs, strings.Split(filepath.ToSlash(rel), "/")) {
+			files = append(files, path)
+		}
+		return nil
+	})
+	return files, err
+}
+
+// matchSegments 逐层匹配路径, `**`可以匹配零层或者多层目录
+func matchSegments(pattern []string, path []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			// 连续的`**`等价于一个
+			for len(pattern) > 0 && pattern[0] == "**" {
+				pattern = pattern[1:]
+			}
+			if len(pattern) == 0 {
+				return true
+			}
+			for i := 0; i <= len(path); i++ {
+				if matchSegments(pattern, path[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(path) == 0 {
+			return false
+		}
+		ok, err := filepath.Match(pattern[0], path[0])
+		if err != nil || !ok {
+			return false
+		}
+		pattern = pattern[1:]
+		path = path[1:]
+	}
+	return len(path) == 0
+}
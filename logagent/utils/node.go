@@ -0,0 +1,103 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// 节点标识的来源
+const (
+	NodeAuto      = "auto"      // 依次尝试id、环境变量、网卡、出口ip、主机名
+	NodeId        = "id"        // 配置文件中的id
+	NodeEnv       = "env"       // 环境变量
+	NodeInterface = "interface" // 指定网卡的ip
+	NodeIp        = "ip"        // 出口ip
+	NodeHostname  = "hostname"  // 主机名
+)
+
+// NodeOptions 节点标识的配置
+type NodeOptions struct {
+	Source    string // 标识的来源, 为空时为auto
+	Id        string // 节点id
+	Env       string // 存放节点id的环境变量名
+	Interface string // 网卡名
+}
+
+// ResolveNode 解析节点标识, 返回标识以及实际使用的来源
+// 标识作为etcd的key的一部分, 不能为空也不能包含`/`
+func ResolveNode(opts NodeOptions) (string, string, error) {
+	source := opts.Source
+	if source == "" {
+		source = NodeAuto
+	}
+	if source != NodeAuto {
+		id, err := nodeFrom(source, opts)
+		if err != nil {
+			return "", source, err
+		}
+		return id, source, checkNodeId(id)
+	}
+
+	// auto: 跳过没有配置或者获取失败的来源
+	// 之前的版本使用出口ip, 没有配置时依然优先使用出口ip, 升级后etcd的key不变, 出口ip获取失败时使用主机名
+	errs := []string{}
+	for _, s := range []string{NodeId, NodeEnv, NodeInterface, NodeIp, NodeHostname} {
+		if (s == NodeId && opts.Id == "") || (s == NodeEnv && opts.Env == "") || (s == NodeInterface && opts.Interface == "") {
+			continue
+		}
+		id, err := nodeFrom(s, opts)
+		if err == nil {
+			err = checkNodeId(id)
+		}
+		if err == nil {
+			return id, s, nil
+		}
+		errs = append(errs, fmt.Sprintf("%s: %v", s, err))
+	}
+	return "", source, fmt.Errorf("resolve node id error: %s", strings.Join(errs, "; "))
+}
+
+// nodeFrom 从指定的来源获取节点标识
+func nodeFrom(source string, opts NodeOptions) (string, error) {
+	switch source {
+	case NodeId:
+		return opts.Id, nil
+	case NodeEnv:
+		if opts.Env == "" {
+			return "", errors.New("env name is empty")
+		}
+		return os.Getenv(opts.Env), nil
+	case NodeInterface:
+		return InterfaceIp(opts.Interface)
+	case NodeIp:
+		return OutBoundIp()
+	case NodeHostname:
+		return os.Hostname()
+	}
+	return "", fmt.Errorf("wrong node source: %s", source)
+}
+
+func checkNodeId(id string) error {
+	if id == "" {
+		return errors.New("node id is empty")
+	}
+	if strings.Contains(id, "/") {
+		return fmt.Errorf("node id %q contains '/'", id)
+	}
+	return nil
+}
+
+// InterfaceIp 网卡上的第一个ipv4地址
+func InterfaceIp(name string) (string, error) {
+	ips, err := NetworkIps()
+	if err != nil {
+		return "", err
+	}
+	fields := strings.Fields(ips[name])
+	if len(fields) == 0 {
+		return "", fmt.Errorf("interface %s has no ipv4 address", name)
+	}
+	return fields[0], nil
+}
@@ -37,7 +37,7 @@ func NetworkIps() (map[string]string, error) {
 
 	// 去除首尾空格
 	for k := range ips {
-		strings.Trim(ips[k], " ")
+		ips[k] = strings.Trim(ips[k], " ")
 	}
 	return ips, nil
 }
@@ -48,6 +48,7 @@ func OutBoundIp() (ip string, err error) {
 	if err != nil {
 		return "", err
 	}
+	defer conn.Close()
 
 	localAddr := conn.LocalAddr().(*net.UDPAddr)
 	ip = strings.Split(localAddr.String(), ":")[0]
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"crypto/subtle"
+	"logtransfer/conf"
+	"logtransfer/mq"
+	"logtransfer/services"
+	"net/http"
+	"strconv"
+
+	"github.com/sirupsen/logrus"
+)
+
+// registerAdmin 注册管理接口, 请求需要带上`Authorization: Bearer {token}`
+// 管理接口可以暂停收集和重新读取配置, 没有配置token时不注册
+//
+//	GET  /admin/managers                                         管道的配置和状态
+//	POST /admin/managers/pause?title={title}                     暂停消费
+//	POST /admin/managers/resume?title={title}                    恢复消费
+//	POST /admin/managers/reread?title={title}&partition=&offset= 从指定的位置重新消费, 默认全部分区从最早的消息开始
+//	POST /admin/reload                                           立即重新读取etcd的配置
+func registerAdmin(mux *http.ServeMux, token string) {
+	if token == "" {
+		logrus.Warn("Admin token is empty, admin api is disabled")
+		return
+	}
+	handle := func(pattern, method string, h http.HandlerFunc) {
+		mux.HandleFunc(pattern, func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != method {
+				writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+				return
+			}
+			if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer "+token)) != 1 {
+				writeError(w, http.StatusUnauthorized, "unauthorized")
+				return
+			}
+			h(w, r)
+		})
+	}
+	handle("/admin/managers", http.MethodGet, listManagers)
+	handle("/admin/managers/pause", http.MethodPost, pauseManager)
+	handle("/admin/managers/resume", http.MethodPost, resumeManager)
+	handle("/admin/managers/reread", http.MethodPost, rereadManager)
+	handle("/admin/reload", http.MethodPost, reloadConfig)
+}
+
+func listManagers(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, services.Managers())
+}
+
+func pauseManager(w http.ResponseWriter, r *http.Request) {
+	writeResult(w, services.Pause(r.URL.Query().Get("title")))
+}
+
+func resumeManager(w http.ResponseWriter, r *http.Request) {
+	writeResult(w, services.Resume(r.URL.Query().Get("title")))
+}
+
+func rereadManager(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	partition := mq.AllPartitions
+	if s := q.Get("partition"); s != "" {
+		p, err := strconv.ParseInt(s, 10, 32)
+		if err != nil || p < 0 {
+			writeError(w, http.StatusBadRequest, "wrong partition: "+s)
+			return
+		}
+		partition = int32(p)
+	}
+	offset := mq.OffsetStart
+	if s := q.Get("offset"); s != "" && s != mq.OffsetOldest {
+		o, err := strconv.ParseInt(s, 10, 64)
+		if err != nil || o < 0 {
+			writeError(w, http.StatusBadRequest, "wrong offset: "+s)
+			return
+		}
+		offset = o
+	}
+	writeResult(w, services.Reread(q.Get("title"), partition, offset))
+}
+
+func reloadConfig(w http.ResponseWriter, r *http.Request) {
+	changed, err := conf.ReloadEtcd(services.UpdateManagers)
+	if err != nil {
+		writeError(w, http.StatusServiceUnavailable, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]bool{"changed": changed})
+}
+
+// writeResult 返回操作的结果
+func writeResult(w http.ResponseWriter, err error) {
+	switch {
+	case err == nil:
+		writeJSON(w, http.StatusOK, map[string]string{"result": "ok"})
+	case err == services.ErrManagerNotFound:
+		writeError(w, http.StatusNotFound, err.Error())
+	default:
+		writeError(w, http.StatusBadRequest, err.Error())
+	}
+}
+
+func writeError(w http.ResponseWriter, code int, msg string) {
+	writeJSON(w, code, map[string]string{"error": msg})
+}
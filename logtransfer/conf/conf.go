@@ -13,9 +13,39 @@ type config struct {
 	FullName    string   // etcd配置的全路径
 	Endpoints   []string // etcd的ip
 	DialTimeout int64    // etcd连接超时时间
+	NodeId      string   // 节点标识, 作为etcd的key的一部分
+	NodeSource  string   // 节点标识的来源
+
+	Username     string        // etcd用户名, 为空时不认证
+	Password     string        // etcd密码
+	PasswordFile string        // etcd密码文件, 优先于Password
+	TLS          etcdTLSConfig // etcd的tls配置
+}
+
+// etcdTLSConfig etcd的tls配置, 证书和私钥都是文件路径
+type etcdTLSConfig struct {
+	Enable             bool
+	CA                 string // CA证书, 为空时使用系统的CA
+	Cert               string // 客户端证书
+	Key                string // 客户端私钥
+	InsecureSkipVerify bool   // 不校验服务端证书
+}
+
+// snapshotConfig etcd配置的本地快照, etcd不可用时使用
+type snapshotConfig struct {
+	Path string // 快照文件的路径
+}
+
+// httpConfig http服务的配置
+type httpConfig struct {
+	Listen     string // 监听地址, 为空时不启动http服务
+	AdminToken string // 管理接口的token, 为空时不校验
 }
 
 var Configs config
+var SnapshotConfigs snapshotConfig
+var HttpConfigs httpConfig
+var KafkaConfigs KafkaInfo // 默认的kafka加密和认证配置
 
 func Init(path string, name string, filetype string) {
 	InitConfig(path, name, filetype)
@@ -40,11 +70,37 @@ func InitConfig(path string, name string, filetype string) {
 		logrus.Fatal("viper unmarshal config error: ", err)
 	}
 
-	// 获取ip
-	ip, err := utils.OutBoundIp()
+	// etcd配置的本地快照
+	viper.SetDefault("logtransfer.snapshot.path", "data/etcd-snapshot.json")
+	err = viper.UnmarshalKey("logtransfer.snapshot", &SnapshotConfigs)
+	if err != nil {
+		logrus.Fatal("viper unmarshal snapshot config error: ", err)
+	}
+
+	// http服务的配置
+	viper.SetDefault("logtransfer.http.listen", ":9103")
+	err = viper.UnmarshalKey("logtransfer.http", &HttpConfigs)
+	if err != nil {
+		logrus.Fatal("viper unmarshal http config error: ", err)
+	}
+
+	// kafka的加密和认证配置
+	err = viper.UnmarshalKey("logtransfer.kafka", &KafkaConfigs)
+	if err != nil {
+		logrus.Fatal("viper unmarshal kafka config error: ", err)
+	}
+
+	// 解析节点标识
+	var node utils.NodeOptions
+	err = viper.UnmarshalKey("logtransfer.node", &node)
+	if err != nil {
+		logrus.Fatal("viper unmarshal node config error: ", err)
+	}
+	Configs.NodeId, Configs.NodeSource, err = utils.ResolveNode(node)
 	if err != nil {
-		logrus.Fatal("get ip error: ", err)
+		logrus.Fatal("resolve node id error: ", err)
 	}
-	// 生成etcd的key: /root/ip/basename
-	Configs.FullName = Configs.Root + "/" + ip + "/" + Configs.BaseName
+	// 生成etcd的key: /root/id/basename
+	Configs.FullName = Configs.Root + "/" + Configs.NodeId + "/" + Configs.BaseName
+	logrus.Infof("Node id: %s, source: %s, etcd key: %s", Configs.NodeId, Configs.NodeSource, Configs.FullName)
 }
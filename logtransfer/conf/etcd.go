@@ -3,16 +3,84 @@ package conf
 import (
 	"context"
 	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
 	"time"
 
 	"github.com/coreos/etcd/clientv3"
+	"github.com/coreos/etcd/pkg/transport"
 	"github.com/sirupsen/logrus"
 )
 
 type EtcdInfo struct {
-	Title   string
-	MqHosts []string
-	DbHosts []string
+	Title         string
+	MqHosts       []string
+	DbHosts       []string
+	Group         string         `json:"group"`           // 消费者组, 为空时使用默认的消费者组
+	InitialOffset string         `json:"initial_offset"`  // 没有提交过偏移量时的初始位置: oldest, newest或者RFC3339格式的时间
+	InstanceId    string         `json:"instance_id"`     // 消费者实例id
+	Index         string         `json:"index"`           // 索引模板, 为空时使用管道名称
+	Parsers       []ParserInfo   `json:"parsers"`         // 存储之前按顺序执行的解析器
+	Timestamp     TimestampInfo  `json:"timestamp"`       // 事件时间的提取配置
+	Bulk          BulkInfo       `json:"bulk"`            // 批量写入的配置
+	DeadLetter    DeadLetterInfo `json:"deadletter"`      // 死信的配置
+	Kafka         *KafkaInfo     `json:"kafka,omitempty"` // kafka的加密和认证配置, 为空时使用本地配置
+}
+
+// KafkaInfo kafka的加密和认证配置, 证书和密码都可以使用本机上的文件, 避免保存在etcd中
+type KafkaInfo struct {
+	TLS  KafkaTLSInfo  `json:"tls"`
+	SASL KafkaSASLInfo `json:"sasl"`
+}
+
+// KafkaTLSInfo tls配置
+type KafkaTLSInfo struct {
+	Enable             bool   `json:"enable"`
+	CA                 string `json:"ca"`                 // CA证书文件, 为空时使用系统的CA
+	Cert               string `json:"cert"`               // 客户端证书文件
+	Key                string `json:"key"`                // 客户端私钥文件
+	InsecureSkipVerify bool   `json:"insecureskipverify"` // 不校验服务端证书
+}
+
+// KafkaSASLInfo sasl配置
+type KafkaSASLInfo struct {
+	Mechanism    string `json:"mechanism"`    // 为空时不认证: PLAIN, SCRAM-SHA-256, SCRAM-SHA-512
+	User         string `json:"user"`         // 用户名
+	Password     string `json:"password"`     // 密码, 建议使用passwordfile
+	PasswordFile string `json:"passwordfile"` // 密码文件, 优先于password
+}
+
+// BulkInfo 批量写入的配置, 为0时使用默认值
+type BulkInfo struct {
+	Actions  int   `json:"actions"`  // 达到该文档数量时写入
+	Size     int   `json:"size"`     // 达到该字节数时写入
+	Interval int64 `json:"interval"` // 距离上次写入超过该时间(毫秒)时写入
+}
+
+// ParserInfo 解析器的配置
+type ParserInfo struct {
+	Type     string            `json:"type"`     // json, logfmt, regex, grok
+	Field    string            `json:"field"`    // 解析的字段, 为空时解析msg
+	Target   string            `json:"target"`   // 解析结果存放的字段, 为空时作为文档的字段
+	Pattern  string            `json:"pattern"`  // regex和grok的表达式
+	Patterns map[string]string `json:"patterns"` // grok的自定义模式
+}
+
+// TimestampInfo 事件时间的提取配置
+type TimestampInfo struct {
+	Field    string   `json:"field"`    // 时间所在的字段, 为空时使用fallback
+	Layouts  []string `json:"layouts"`  // 时间格式, 支持go的时间格式以及UNIX、UNIX_MS
+	Timezone string   `json:"timezone"` // 时间中没有时区时使用的时区, 为空时为本地时区
+	Fallback string   `json:"fallback"` // 提取失败时使用的时间: readtime(默认), now
+}
+
+// DeadLetterInfo 死信的配置, 存储器拒绝的消息写入死信topic, 写入失败时写入本地文件
+type DeadLetterInfo struct {
+	Topic    string `json:"topic"`    // 死信topic, 为空时只写入本地文件
+	Dir      string `json:"dir"`      // 本地文件目录
+	MaxSize  int64  `json:"maxsize"`  // 单个本地文件的最大字节数
+	MaxFiles int    `json:"maxfiles"` // 最多保留的本地文件数量
 }
 
 type option func()
@@ -20,91 +88,158 @@ type option func()
 var etcdClient *clientv3.Client
 var EtcdInfos []EtcdInfo
 
+// offline 启动时etcd不可用, 使用的是本地快照, 由watchLk保护
+var offline bool
+
+// isOffline 是否还在使用本地快照
+func isOffline() bool {
+	watchLk.Lock()
+	defer watchLk.Unlock()
+	return offline
+}
+
+// 重新连接etcd的间隔
+const (
+	reconnectBackoffMin = time.Second
+	reconnectBackoffMax = 30 * time.Second
+)
+
 func initEtcdConfig() {
-	client, err := clientv3.New(clientv3.Config{
-		Endpoints:   Configs.Endpoints,
-		DialTimeout: time.Duration(Configs.DialTimeout) * time.Second,
-	})
+	// 连接etcd并且获取配置信息, 失败时使用本地快照
+	err := connectEtcd()
+	if err == nil {
+		err = loadEtcdConfigs()
+	}
+	if err != nil {
+		logrus.Errorf("Etcd is unavailable: %v, start from snapshot %s", err, SnapshotConfigs.Path)
+		infos, err := loadSnapshot()
+		if err != nil {
+			logrus.Fatal("load etcd snapshot error: ", err)
+		}
+		EtcdInfos = infos
+		watchLk.Lock()
+		offline = true
+		watchLk.Unlock()
+	}
+}
+
+// connectEtcd 创建etcd客户端 并且检查etcd的健康状况
+func connectEtcd() error {
+	etcdConfig, err := newEtcdConfig()
+	if err != nil {
+		logrus.Fatal("etcd config error: ", err)
+	}
+	client, err := clientv3.New(etcdConfig)
 	if err != nil {
-		logrus.Fatal("new etcd client error: ", err)
+		return fmt.Errorf("new etcd client error: %v", err)
+	}
+	if etcdClient != nil {
+		etcdClient.Close()
 	}
 	etcdClient = client
 
-	// 检查健康状况
+	// 检查健康状况, 超过半数的节点可用即可
 	if !checkEtcdHealth() {
-		logrus.Fatal("Connect etcd fail, clusters: %v", Configs.Endpoints)
+		return fmt.Errorf("quorum is not available, clusters: %v", Configs.Endpoints)
 	}
+	return nil
+}
 
-	resp, err := client.Get(context.TODO(), Configs.FullName)
+// loadEtcdConfigs 获取配置信息, 不存在时初始化为空的配置
+func loadEtcdConfigs() error {
+	resp, err := etcdClient.Get(context.TODO(), Configs.FullName)
 	if err != nil {
-		client.Close()
-		logrus.Fatalf("get etcd key %s error: %s", Configs.FullName, err.Error())
+		return fmt.Errorf("get etcd key %s error: %v", Configs.FullName, err)
 	}
 
 	kvs := resp.Kvs
 	if len(kvs) == 0 {
-		_, err = client.Put(context.TODO(), Configs.FullName, "[]")
+		logrus.Warnf("Etcd key %s not exists, create an empty config, check the node id if this node has been configured", Configs.FullName)
+		_, err = etcdClient.Put(context.TODO(), Configs.FullName, "[]")
 		if err != nil {
-			logrus.Fatalf("Put etcd key %s error: %s", Configs.FullName, err.Error())
+			return fmt.Errorf("put etcd key %s error: %v", Configs.FullName, err)
 		}
 	} else {
 		err = json.Unmarshal(kvs[0].Value, &EtcdInfos)
 		if err != nil {
 			logrus.Fatal("unmarshal json error: ", err)
 		}
+		lastValue = kvs[0].Value
 		logrus.Debugf("Unmarshal etcd json suc: %v", EtcdInfos)
 	}
+	setRevision(resp.Header.Revision)
+	saveSnapshot(EtcdInfos)
+	return nil
 }
 
-// 重新读取etcd的配置信息
-func reloadEtcdConfigs() error {
-	// EtcdInfos = []EtcdInfo{}
-	resp, err := etcdClient.Get(context.TODO(), Configs.FullName)
-	if err != nil {
-		logrus.Error("Get key: %s error: %v", Configs.FullName, err)
-		return err
+// waitEtcd 启动时etcd不可用, 按照退避时间重新连接, 直到连接成功并且重新读取配置
+func waitEtcd() {
+	backoff := reconnectBackoffMin
+	for {
+		time.Sleep(backoff)
+		err := connectEtcd()
+		if err == nil {
+			_, err = reloadEtcdConfigs()
+		}
+		if err == nil {
+			watchLk.Lock()
+			offline = false
+			watchLk.Unlock()
+			logrus.Info("Etcd is available, reconcile with etcd config")
+			return
+		}
+		logrus.Warnf("Etcd is still unavailable: %v, retry after %v", err, backoff)
+		backoff *= 2
+		if backoff > reconnectBackoffMax {
+			backoff = reconnectBackoffMax
+		}
 	}
+}
 
-	kvs := resp.Kvs
-	if len(kvs) == 0 {
-		return nil
+// newEtcdConfig 生成etcd客户端的配置
+func newEtcdConfig() (clientv3.Config, error) {
+	c := clientv3.Config{
+		Endpoints:   Configs.Endpoints,
+		DialTimeout: time.Duration(Configs.DialTimeout) * time.Second,
+		Username:    Configs.Username,
+		Password:    Configs.Password,
 	}
-
-	newEtcdInfos := []EtcdInfo{}
-	err = json.Unmarshal(kvs[0].Value, &newEtcdInfos)
-	if err != nil {
-		logrus.Error("unmarshal json error: ", err)
-		return err
+	if Configs.PasswordFile != "" {
+		b, err := ioutil.ReadFile(Configs.PasswordFile)
+		if err != nil {
+			return c, fmt.Errorf("read etcd password file error: %v", err)
+		}
+		c.Password = strings.TrimSpace(string(b))
 	}
-
-	EtcdInfos = newEtcdInfos
-	logrus.Debugf("Reload etcd json suc: %v", EtcdInfos)
-	return nil
+	if Configs.TLS.Enable {
+		tlsInfo := transport.TLSInfo{
+			CertFile:           Configs.TLS.Cert,
+			KeyFile:            Configs.TLS.Key,
+			TrustedCAFile:      Configs.TLS.CA,
+			InsecureSkipVerify: Configs.TLS.InsecureSkipVerify,
+		}
+		tlsConfig, err := tlsInfo.ClientConfig()
+		if err != nil {
+			return c, fmt.Errorf("etcd tls config error: %v", err)
+		}
+		c.TLS = tlsConfig
+	}
+	return c, nil
 }
 
-// checkEtcdHealth 检查etcd的健康状况
+// checkEtcdHealth 检查etcd的健康状况, 超过半数的节点可用时认为etcd可用
+// 不可用的节点只记录警告, 客户端会自动切换到可用的节点
 func checkEtcdHealth() bool {
-	timeoutCtx, cancel := context.WithTimeout(context.Background(), time.Duration(Configs.DialTimeout)*time.Second)
-	defer cancel()
+	healthy := 0
 	for _, ip := range Configs.Endpoints {
+		timeoutCtx, cancel := context.WithTimeout(context.Background(), time.Duration(Configs.DialTimeout)*time.Second)
 		_, err := etcdClient.Status(timeoutCtx, ip)
+		cancel()
 		if err != nil {
-			return false
-		}
-	}
-	return true
-}
-
-// 监听etcd的key 并且执行回调函数
-func WatchEtcd(option option) {
-	watcher := clientv3.NewWatcher(etcdClient)
-	wCh := watcher.Watch(context.TODO(), Configs.FullName)
-	for wresp := range wCh {
-		if len(wresp.Events) == 0 {
+			logrus.Warnf("Etcd endpoint %s is unhealthy: %v", ip, err)
 			continue
 		}
-		if err := reloadEtcdConfigs(); err == nil {
-			option()
-		}
+		healthy++
 	}
+	return healthy > len(Configs.Endpoints)/2
 }
@@ -0,0 +1,68 @@
+package conf
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// snapshot etcd配置的本地快照
+type snapshot struct {
+	Key   string     `json:"key"`  // etcd的key, 节点标识变化后不再使用旧的快照
+	Time  string     `json:"time"` // 保存时间
+	Infos []EtcdInfo `json:"infos"`
+}
+
+// saveSnapshot 保存成功读取的etcd配置, 先写入临时文件再重命名, 避免写入一半的快照
+// 快照中有kafka的密码等认证信息, 只有当前用户可以读写
+func saveSnapshot(infos []EtcdInfo) {
+	path := SnapshotConfigs.Path
+	if path == "" {
+		return
+	}
+	b, err := json.Marshal(snapshot{
+		Key:   Configs.FullName,
+		Time:  time.Now().Format(time.RFC3339),
+		Infos: infos,
+	})
+	if err == nil {
+		err = os.MkdirAll(filepath.Dir(path), 0755)
+	}
+	if err == nil {
+		// 之前的版本可能留下了其他用户可以读取的临时文件, WriteFile不会修改已有文件的权限
+		os.Remove(path + ".tmp")
+		err = ioutil.WriteFile(path+".tmp", b, 0600)
+	}
+	if err == nil {
+		err = os.Rename(path+".tmp", path)
+	}
+	if err != nil {
+		logrus.Errorf("Save etcd snapshot %s error: %v", path, err)
+	}
+}
+
+// loadSnapshot 读取本地快照
+func loadSnapshot() ([]EtcdInfo, error) {
+	path := SnapshotConfigs.Path
+	if path == "" {
+		return nil, fmt.Errorf("snapshot is disabled")
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	s := snapshot{}
+	if err := json.Unmarshal(b, &s); err != nil {
+		return nil, err
+	}
+	if s.Key != Configs.FullName {
+		return nil, fmt.Errorf("snapshot key %s is not %s", s.Key, Configs.FullName)
+	}
+	logrus.Infof("Load etcd snapshot %s suc, saved at %s", path, s.Time)
+	return s.Infos, nil
+}
@@ -0,0 +1,139 @@
+package conf
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/coreos/etcd/clientv3"
+	"github.com/sirupsen/logrus"
+)
+
+// 状态的租约时间(秒)以及更新间隔
+// 进程退出后租约最多在statusTTL秒后过期, key被etcd删除
+const (
+	statusTTL      = 30
+	statusInterval = 10 * time.Second
+)
+
+var (
+	statusCancel context.CancelFunc
+	statusDone   chan struct{}
+)
+
+// StatusKey 实例状态的key: /root/id/status, 值中的service为服务名称
+// 同一个节点上的logagent和logtransfer需要使用不同的节点标识, 否则只有先注册的服务可以写入状态
+func StatusKey() string {
+	return Configs.Root + "/" + Configs.NodeId + "/status"
+}
+
+// KeepStatus 在etcd中注册带租约的实例状态, 并且定期更新
+// etcd不可用、租约过期或者key被其他实例占用时按照退避时间重新注册, 注册成功后重置退避时间
+func KeepStatus(service string, status func() interface{}) {
+	ctx, cancel := context.WithCancel(context.Background())
+	statusCancel = cancel
+	statusDone = make(chan struct{})
+	go func() {
+		defer close(statusDone)
+		key := StatusKey()
+		backoff := reconnectBackoffMin
+		for {
+			registered, err := keepStatusOnce(ctx, key, service, status)
+			if ctx.Err() != nil {
+				return
+			}
+			if registered {
+				backoff = reconnectBackoffMin
+			}
+			logrus.Warnf("Keep status %s error: %v, retry after %v", key, err, backoff)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(backoff):
+			}
+			backoff *= 2
+			if backoff > reconnectBackoffMax {
+				backoff = reconnectBackoffMax
+			}
+		}
+	}()
+}
+
+// CloseStatus 停止更新并且撤销租约, key被立即删除
+func CloseStatus() {
+	if statusCancel == nil {
+		return
+	}
+	statusCancel()
+	<-statusDone
+	statusCancel = nil
+}
+
+// keepStatusOnce 申请租约并且写入状态, 直到租约续期失败、写入失败或者ctx取消, 返回是否注册成功过
+// 只有key不存在或者没有租约时才注册, 避免覆盖同一个节点标识的其他实例的状态, 之后只更新自己租约的key
+func keepStatusOnce(ctx context.Context, key string, service string, status func() interface{}) (bool, error) {
+	if WatchStatus().Offline {
+		return false, errors.New("etcd is unavailable")
+	}
+	// 不再使用本地快照之后etcdClient不会再变化
+	cli := etcdClient
+
+	lease, err := cli.Grant(ctx, statusTTL)
+	if err != nil {
+		return false, err
+	}
+	defer func() {
+		// 退出时撤销租约, 不需要等待租约过期
+		revokeCtx, cancel := context.WithTimeout(context.Background(), time.Duration(Configs.DialTimeout)*time.Second)
+		defer cancel()
+		if _, err := cli.Revoke(revokeCtx, lease.ID); err != nil {
+			logrus.Warnf("Revoke status lease of %s error: %v", key, err)
+		}
+	}()
+	keepAlive, err := cli.KeepAlive(ctx, lease.ID)
+	if err != nil {
+		return false, err
+	}
+
+	// owner为key当前的租约, 不一致说明key被其他实例占用
+	put := func(owner clientv3.LeaseID) error {
+		value, err := json.Marshal(status())
+		if err != nil {
+			return err
+		}
+		resp, err := cli.Txn(ctx).
+			If(clientv3.Compare(clientv3.LeaseValue(key), "=", owner)).
+			Then(clientv3.OpPut(key, string(value), clientv3.WithLease(lease.ID))).
+			Commit()
+		if err != nil {
+			return err
+		}
+		if !resp.Succeeded {
+			return fmt.Errorf("status key %s is held by another instance, %s on the same node needs a different node id", key, service)
+		}
+		return nil
+	}
+	if err := put(clientv3.NoLease); err != nil {
+		return false, err
+	}
+	logrus.Infof("Register status %s of %s with lease %x, ttl %ds", key, service, lease.ID, statusTTL)
+
+	ticker := time.NewTicker(statusInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return true, nil
+		case _, ok := <-keepAlive:
+			if !ok {
+				return true, errors.New("status lease keep alive closed")
+			}
+		case <-ticker.C:
+			if err := put(lease.ID); err != nil {
+				return true, err
+			}
+		}
+	}
+}
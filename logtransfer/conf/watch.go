@@ -0,0 +1,189 @@
+package conf
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/coreos/etcd/clientv3"
+	"github.com/sirupsen/logrus"
+)
+
+// WatchState etcd监听的状态
+type WatchState struct {
+	Offline   bool      `json:"offline"`    // 启动时etcd不可用, 使用的是本地快照
+	Watching  bool      `json:"watching"`   // 是否正在监听
+	Revision  int64     `json:"revision"`   // 已经处理的etcd版本
+	Retries   int       `json:"retries"`    // 连续重试的次数
+	LastError string    `json:"last_error"` // 最近一次监听中断的原因
+	LastEvent time.Time `json:"last_event"` // 最近一次配置变化的时间
+}
+
+var (
+	watchLk    sync.Mutex
+	watchState WatchState
+	lastValue  []byte     // 最近一次使用的配置, 用于忽略没有变化的事件
+	applyLk    sync.Mutex // 保证配置的更新和回调函数不会同时在监听和管理接口中执行
+)
+
+// WatchStatus etcd监听的状态
+func WatchStatus() WatchState {
+	watchLk.Lock()
+	defer watchLk.Unlock()
+	st := watchState
+	st.Offline = offline
+	return st
+}
+
+func setRevision(rev int64) {
+	watchLk.Lock()
+	watchState.Revision = rev
+	watchLk.Unlock()
+}
+
+// 重新读取etcd的配置信息, 配置没有变化时返回false
+func reloadEtcdConfigs() (bool, error) {
+	resp, err := etcdClient.Get(context.TODO(), Configs.FullName)
+	if err != nil {
+		logrus.Errorf("Get key: %s error: %v", Configs.FullName, err)
+		return false, err
+	}
+	setRevision(resp.Header.Revision)
+
+	kvs := resp.Kvs
+	if len(kvs) == 0 {
+		return false, nil
+	}
+	return applyValue(kvs[0].Value)
+}
+
+// applyValue 使用新的配置, 和当前配置相同时直接忽略
+func applyValue(value []byte) (bool, error) {
+	if bytes.Equal(value, lastValue) {
+		return false, nil
+	}
+
+	newEtcdInfos := []EtcdInfo{}
+	err := json.Unmarshal(value, &newEtcdInfos)
+	if err != nil {
+		logrus.Error("Unmarshal etcd json error: ", err)
+		return false, err
+	}
+
+	EtcdInfos = newEtcdInfos
+	lastValue = value
+	saveSnapshot(EtcdInfos)
+	watchLk.Lock()
+	watchState.LastEvent = time.Now()
+	watchLk.Unlock()
+	logrus.Debugf("Reload etcd json suc: %v", EtcdInfos)
+	return true, nil
+}
+
+// ReloadEtcd 立即重新读取etcd的配置并且执行回调函数, 不需要等待监听事件
+// 配置没有变化时也会执行回调函数, 可以用来重试创建失败的管道, 返回配置是否有变化
+func ReloadEtcd(option option) (bool, error) {
+	applyLk.Lock()
+	defer applyLk.Unlock()
+	if WatchStatus().Offline {
+		return false, errors.New("etcd is unavailable, using snapshot")
+	}
+	changed, err := reloadEtcdConfigs()
+	if err != nil {
+		return false, err
+	}
+	option()
+	return changed, nil
+}
+
+// 监听etcd的key 并且执行回调函数
+// 启动时使用的是本地快照时, 先等待etcd可用, 再按照etcd的配置执行一次回调函数
+// 监听中断后按照退避时间重新读取配置, 再从读取时的版本继续监听, 不会返回
+func WatchEtcd(option option) {
+	if isOffline() {
+		waitEtcd()
+		applyLk.Lock()
+		option()
+		applyLk.Unlock()
+	}
+
+	backoff := reconnectBackoffMin
+	for {
+		received, err := watchOnce(option)
+
+		watchLk.Lock()
+		watchState.Watching = false
+		watchState.Retries++
+		watchState.LastError = err.Error()
+		watchLk.Unlock()
+		if received {
+			backoff = reconnectBackoffMin
+		}
+		logrus.Errorf("Watch etcd key %s interrupted: %v, retry after %v", Configs.FullName, err, backoff)
+		time.Sleep(backoff)
+		backoff *= 2
+		if backoff > reconnectBackoffMax {
+			backoff = reconnectBackoffMax
+		}
+
+		// 重新读取配置, 监听中断期间的变化不会丢失, 版本被压缩时也从最新的版本开始监听
+		applyLk.Lock()
+		changed, err := reloadEtcdConfigs()
+		if err == nil && changed {
+			option()
+		}
+		applyLk.Unlock()
+	}
+}
+
+// watchOnce 从已经处理的版本之后开始监听, 监听中断时返回原因, 以及是否收到过响应
+func watchOnce(option option) (bool, error) {
+	// 没有leader时(比如网络分区)中断监听, 避免一直等待
+	ctx, cancel := context.WithCancel(clientv3.WithRequireLeader(context.Background()))
+	defer cancel()
+
+	rev := WatchStatus().Revision
+	wCh := etcdClient.Watch(ctx, Configs.FullName, clientv3.WithRev(rev+1))
+	watchLk.Lock()
+	watchState.Watching = true
+	watchLk.Unlock()
+	logrus.Debugf("Watch etcd key %s from revision %d", Configs.FullName, rev+1)
+
+	received := false
+	for wresp := range wCh {
+		// 版本被压缩、没有leader或者被取消
+		if err := wresp.Err(); err != nil {
+			return received, err
+		}
+		received = true
+
+		// 只使用最后一次写入的值, 删除配置时保留当前的配置
+		var value []byte
+		for _, ev := range wresp.Events {
+			switch ev.Type {
+			case clientv3.EventTypePut:
+				value = ev.Kv.Value
+			case clientv3.EventTypeDelete:
+				logrus.Warnf("Etcd key %s is deleted, keep current config", Configs.FullName)
+			}
+		}
+		if value != nil {
+			applyLk.Lock()
+			if changed, err := applyValue(value); err == nil && changed {
+				option()
+			} else if err == nil {
+				logrus.Debugf("Etcd key %s not changed, ignore", Configs.FullName)
+			}
+			applyLk.Unlock()
+		}
+
+		watchLk.Lock()
+		watchState.Revision = wresp.Header.Revision
+		watchState.Retries = 0
+		watchLk.Unlock()
+	}
+	return received, errors.New("watch channel closed")
+}
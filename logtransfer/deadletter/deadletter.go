@@ -0,0 +1,145 @@
+package deadletter
+
+import (
+	"encoding/json"
+	"errors"
+	"logtransfer/mq"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// 死信文件的默认配置
+const (
+	defaultDir      = "data/deadletter"
+	defaultMaxSize  = 100 * 1024 * 1024
+	defaultMaxFiles = 10
+)
+
+// Letter 存储器拒绝的消息
+type Letter struct {
+	Title     string `json:"title"`
+	Topic     string `json:"topic"`
+	Partition int32  `json:"partition"`
+	Offset    int64  `json:"offset"`
+	Error     string `json:"error"`
+	Time      string `json:"time"`
+	Payload   string `json:"payload"`
+}
+
+// Conf 死信的配置
+type Conf struct {
+	Title    string          // 管道名称, 也是本地文件的名称
+	Topic    string          // 死信topic, 为空时只写入本地文件
+	Hosts    []string        // kafka地址
+	Security mq.SecurityConf // kafka的加密和认证配置
+	Dir      string          // 本地文件目录
+	MaxSize  int64           // 单个本地文件的最大字节数
+	MaxFiles int             // 最多保留的本地文件数量
+}
+
+// DeadLetter 死信写入器, 优先写入kafka, kafka写入失败时写入本地文件
+type DeadLetter struct {
+	lk       sync.RWMutex
+	conf     Conf
+	producer *mq.MessageProducer
+	file     *fileWriter
+}
+
+// withDefault 填充默认配置
+func (c Conf) withDefault() Conf {
+	if c.Dir == "" {
+		c.Dir = defaultDir
+	}
+	if c.MaxSize <= 0 {
+		c.MaxSize = defaultMaxSize
+	}
+	if c.MaxFiles <= 0 {
+		c.MaxFiles = defaultMaxFiles
+	}
+	return c
+}
+
+// New 初始化死信写入器
+func New(conf Conf) (*DeadLetter, error) {
+	dl := &DeadLetter{}
+	if err := dl.Update(conf); err != nil {
+		return nil, err
+	}
+	return dl, nil
+}
+
+// newProducer 初始化死信topic的生产者
+// kafka不可用时依然可以写入本地文件, 所以这里只记录错误
+func newProducer(conf Conf) *mq.MessageProducer {
+	if conf.Topic == "" {
+		return nil
+	}
+	producer, err := mq.NewMessageProducer(mq.MqConf{
+		Flag:     mq.KAFKA,
+		Topic:    conf.Topic,
+		Hosts:    conf.Hosts,
+		Security: conf.Security,
+	})
+	if err != nil {
+		logrus.Errorf("Create dead letter producer error: %v, use local file.", err)
+		return nil
+	}
+	return producer
+}
+
+// Write 写入死信
+func (dl *DeadLetter) Write(l *Letter) error {
+	dl.lk.RLock()
+	defer dl.lk.RUnlock()
+
+	if l.Title == "" {
+		l.Title = dl.conf.Title
+	}
+	if l.Time == "" {
+		l.Time = time.Now().Format(time.RFC3339Nano)
+	}
+	b, err := json.Marshal(l)
+	if err != nil {
+		return err
+	}
+
+	if dl.producer != nil {
+		err = dl.producer.Produce(dl.conf.Topic, string(b))
+		if err == nil {
+			return nil
+		}
+		logrus.Errorf("Write dead letter to topic %s error: %v, use local file.", dl.conf.Topic, err)
+	}
+	return dl.file.write(b)
+}
+
+// Update 更新配置
+func (dl *DeadLetter) Update(conf Conf) error {
+	if conf.Title == "" {
+		return errors.New("dead letter title is empty")
+	}
+	conf = conf.withDefault()
+	producer := newProducer(conf)
+
+	dl.lk.Lock()
+	defer dl.lk.Unlock()
+	if dl.producer != nil {
+		dl.producer.Close()
+	}
+	dl.conf = conf
+	dl.producer = producer
+	dl.file = newFileWriter(conf.Dir, conf.Title, conf.MaxSize, conf.MaxFiles)
+	return nil
+}
+
+// Close 释放资源
+func (dl *DeadLetter) Close() {
+	dl.lk.Lock()
+	defer dl.lk.Unlock()
+	if dl.producer != nil {
+		dl.producer.Close()
+		dl.producer = nil
+	}
+}
@@ -0,0 +1,91 @@
+package deadletter
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// fileWriter 按照大小轮转的本地死信文件
+// 每次写入都重新打开文件, 重放时可以直接把文件移走
+type fileWriter struct {
+	lk       sync.Mutex
+	dir      string
+	name     string
+	maxSize  int64
+	maxFiles int
+}
+
+func newFileWriter(dir, name string, maxSize int64, maxFiles int) *fileWriter {
+	return &fileWriter{
+		dir:      dir,
+		name:     name,
+		maxSize:  maxSize,
+		maxFiles: maxFiles,
+	}
+}
+
+// path 当前写入的文件路径
+func (fw *fileWriter) path() string {
+	return filepath.Join(fw.dir, fw.name+".log")
+}
+
+// rotatedPath 轮转后的文件路径, 序号越大越旧
+func (fw *fileWriter) rotatedPath(i int) string {
+	return fmt.Sprintf("%s.%d", fw.path(), i)
+}
+
+// write 写入一行
+func (fw *fileWriter) write(b []byte) error {
+	fw.lk.Lock()
+	defer fw.lk.Unlock()
+
+	err := os.MkdirAll(fw.dir, 0755)
+	if err != nil {
+		return err
+	}
+	if info, err := os.Stat(fw.path()); err == nil && info.Size()+int64(len(b))+1 > fw.maxSize {
+		fw.rotate()
+	}
+
+	f, err := os.OpenFile(fw.path(), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(append(b, '\n'))
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// rotate 轮转文件, 超过数量的旧文件会被删除
+func (fw *fileWriter) rotate() {
+	os.Remove(fw.rotatedPath(fw.maxFiles - 1))
+	for i := fw.maxFiles - 2; i >= 1; i-- {
+		os.Rename(fw.rotatedPath(i), fw.rotatedPath(i+1))
+	}
+	if fw.maxFiles > 1 {
+		os.Rename(fw.path(), fw.rotatedPath(1))
+	} else {
+		os.Remove(fw.path())
+	}
+}
+
+// files 全部死信文件, 按照从旧到新的顺序
+func (fw *fileWriter) files() []string {
+	files := []string{}
+	for i := fw.maxFiles - 1; i >= 1; i-- {
+		if _, err := os.Stat(fw.rotatedPath(i)); err == nil {
+			files = append(files, fw.rotatedPath(i))
+		}
+	}
+	if _, err := os.Stat(fw.path()); err == nil {
+		files = append(files, fw.path())
+	}
+	return files
+}
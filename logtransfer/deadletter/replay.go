@@ -0,0 +1,121 @@
+package deadletter
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"logtransfer/mq"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// replayingSuffix 正在重放的本地文件的后缀
+const replayingSuffix = ".replaying"
+
+// Replay 将死信重新写入原来的topic, 先重放本地文件, 再重放死信topic
+// 返回重放成功的死信数量
+func Replay(conf Conf) (int, error) {
+	conf = conf.withDefault()
+	producer, err := mq.NewMessageProducer(mq.MqConf{
+		Flag:     mq.KAFKA,
+		Topic:    conf.Title,
+		Hosts:    conf.Hosts,
+		Security: conf.Security,
+	})
+	if err != nil {
+		return 0, err
+	}
+	defer producer.Close()
+
+	handler := func(value string) error {
+		l := &Letter{}
+		if err := json.Unmarshal([]byte(value), l); err != nil {
+			// 格式错误的死信无法重放, 直接跳过
+			logrus.Errorf("Unmarshal dead letter error: %v, letter: %s", err, value)
+			return nil
+		}
+		topic := l.Topic
+		if topic == "" {
+			topic = conf.Title
+		}
+		return producer.Produce(topic, l.Payload)
+	}
+
+	fw := newFileWriter(conf.Dir, conf.Title, conf.MaxSize, conf.MaxFiles)
+	count, err := replayFiles(fw, handler)
+	if err != nil {
+		return count, err
+	}
+	if conf.Topic == "" {
+		return count, nil
+	}
+
+	n, err := mq.ReadTopic(mq.MqConf{
+		Flag:     mq.KAFKA,
+		Topic:    conf.Topic,
+		Hosts:    conf.Hosts,
+		Group:    conf.Topic + "-replay",
+		Security: conf.Security,
+	}, handler)
+	return count + n, err
+}
+
+// replayFiles 重放本地文件
+// 文件先重命名再读取, 重放期间新写入的死信会写到新的文件中
+func replayFiles(fw *fileWriter, handler func(value string) error) (int, error) {
+	// 上次没有重放完成的文件
+	files, err := filepath.Glob(fw.path() + "*" + replayingSuffix)
+	if err != nil {
+		return 0, err
+	}
+	for _, file := range fw.files() {
+		replaying := file + replayingSuffix
+		if err := os.Rename(file, replaying); err != nil {
+			return 0, err
+		}
+		files = append(files, replaying)
+	}
+
+	count := 0
+	for _, file := range files {
+		n, err := replayFile(file, handler)
+		count += n
+		if err != nil {
+			return count, err
+		}
+		os.Remove(file)
+		logrus.Debugf("Replay dead letter file %s suc, %d letters", file, n)
+	}
+	return count, nil
+}
+
+// replayFile 重放单个文件, 失败时把没有重放的死信写回文件
+func replayFile(file string, handler func(value string) error) (int, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return 0, err
+	}
+
+	lines := []string{}
+	scanner := bufio.NewScanner(strings.NewReader(string(b)))
+	scanner.Buffer(make([]byte, 64*1024), len(b)+1)
+	for scanner.Scan() {
+		if line := scanner.Text(); line != "" {
+			lines = append(lines, line)
+		}
+	}
+
+	for i, line := range lines {
+		if err := handler(line); err != nil {
+			rest := strings.Join(lines[i:], "\n") + "\n"
+			if werr := ioutil.WriteFile(file, []byte(rest), 0644); werr != nil {
+				logrus.Errorf("Write back dead letter file %s error: %v", file, werr)
+			}
+			return i, err
+		}
+	}
+	return len(lines), nil
+}
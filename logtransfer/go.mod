@@ -13,7 +13,9 @@ require (
 	github.com/dustin/go-humanize v1.0.0 // indirect
 	github.com/google/uuid v1.2.0 // indirect
 	github.com/olivere/elastic/v7 v7.0.23
+	github.com/prometheus/client_golang v1.10.0
 	github.com/sirupsen/logrus v1.8.1
 	github.com/spf13/viper v1.7.1
+	github.com/xdg/scram v0.0.0-20180814205039-7eeb5667e42c
 	sigs.k8s.io/yaml v1.2.0 // indirect
 )
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"encoding/json"
+	"logtransfer/conf"
+	"logtransfer/services"
+	"net/http"
+
+	"github.com/sirupsen/logrus"
+)
+
+// readiness 就绪检查的结果
+type readiness struct {
+	Ready    bool                     `json:"ready"`
+	Etcd     conf.WatchState          `json:"etcd"`
+	Managers []services.ManagerStatus `json:"managers"`
+}
+
+// healthz 存活检查, 进程能够响应请求即为存活
+func healthz(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// readyz 就绪检查, 正在监听etcd, 并且全部管道都加入了消费者组、存储设备可用时为就绪, 否则返回503
+func readyz(w http.ResponseWriter, r *http.Request) {
+	rd := readiness{
+		Etcd:     conf.WatchStatus(),
+		Managers: services.Status(),
+	}
+	rd.Ready = !rd.Etcd.Offline && rd.Etcd.Watching
+	for _, m := range rd.Managers {
+		// 通过管理接口暂停的管道不影响就绪
+		if m.State != services.StateRunning && m.State != services.StatePaused {
+			rd.Ready = false
+		}
+	}
+
+	code := http.StatusOK
+	if !rd.Ready {
+		code = http.StatusServiceUnavailable
+	}
+	writeJSON(w, code, rd)
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		logrus.Errorf("Write http response error: %v", err)
+	}
+}
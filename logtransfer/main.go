@@ -1,9 +1,12 @@
 package main
 
 import (
+	"flag"
 	"logtransfer/conf"
+	"logtransfer/metrics"
 	"logtransfer/services"
 	"logtransfer/utils"
+	"net/http"
 	"os"
 	"os/signal"
 	"syscall"
@@ -18,17 +21,62 @@ func signalHandler() {
 	switch s {
 	case syscall.SIGINT:
 		logrus.Debug("SIGINT......")
+		conf.CloseStatus()
 		services.CloseManagers()
 		logrus.Debug("EXIT.")
 	case syscall.SIGTERM:
 		logrus.Debug("SIGTERM......")
+		conf.CloseStatus()
 		services.CloseManagers()
 		logrus.Debug("EXIT.")
 	}
 	os.Exit(1)
 }
 
+// startHttpServer 启动http服务, 提供/metrics、/healthz、/readyz以及管理接口
+func startHttpServer(listen, adminToken string) {
+	if listen == "" {
+		return
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics.Handler())
+	mux.HandleFunc("/healthz", healthz)
+	mux.HandleFunc("/readyz", readyz)
+	registerAdmin(mux, adminToken)
+	go func() {
+		logrus.Infof("Http server listen on %s", listen)
+		if err := http.ListenAndServe(listen, mux); err != nil {
+			logrus.Errorf("Http server error: %v", err)
+		}
+	}()
+}
+
+// replay 重放死信的子命令: logtransfer replay -title {title}
+func replay(args []string) {
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+	title := fs.String("title", "", "pipeline title")
+	fs.Parse(args)
+	if *title == "" {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	dir := utils.GetPwd()
+	conf.Init(dir+"docs", "configs", "yml")
+
+	count, err := services.ReplayDeadLetters(*title)
+	if err != nil {
+		logrus.Fatalf("Replay dead letters of %s error: %v, replayed %d", *title, err, count)
+	}
+	logrus.Infof("Replay dead letters of %s suc, replayed %d", *title, count)
+}
+
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "replay" {
+		replay(os.Args[2:])
+		return
+	}
+
 	defer services.CloseManagers()
 	defer func() {
 		err := recover()
@@ -37,6 +85,7 @@ func main() {
 		}
 	}()
 	logrus.SetLevel(logrus.DebugLevel)
+	logrus.AddHook(errorRecorder)
 	// 监听信号
 	go signalHandler()
 
@@ -44,9 +93,16 @@ func main() {
 	dir := utils.GetPwd()
 	conf.Init(dir+"docs", "configs", "yml")
 
+	// 启动http服务
+	startHttpServer(conf.HttpConfigs.Listen, conf.HttpConfigs.AdminToken)
+
 	// 初始化服务
 	services.InitManagers()
 
+	// 在etcd中注册实例状态
+	conf.KeepStatus("logtransfer", currentStatus)
+	defer conf.CloseStatus()
+
 	// 监听配置变化
 	conf.WatchEtcd(services.UpdateManagers)
 }
@@ -0,0 +1,83 @@
+package metrics
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	// MessagesConsumed 从kafka消费的消息数
+	MessagesConsumed = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "logtransfer",
+		Name:      "messages_consumed_total",
+		Help:      "Messages consumed from kafka.",
+	}, []string{"title"})
+
+	// DocumentsSaved 存储成功的文档数
+	DocumentsSaved = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "logtransfer",
+		Name:      "documents_saved_total",
+		Help:      "Documents saved by the saver.",
+	}, []string{"title"})
+
+	// DocumentsFailed 存储器拒绝的文档数, 这些文档会写入死信
+	DocumentsFailed = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "logtransfer",
+		Name:      "documents_failed_total",
+		Help:      "Documents rejected by the saver.",
+	}, []string{"title"})
+
+	// SaveLatency 从交给存储器到存储器确认的耗时, 包括批量等待的时间
+	SaveLatency = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "logtransfer",
+		Name:      "save_latency_seconds",
+		Help:      "Latency from inserting a document to the saver result.",
+		Buckets:   prometheus.ExponentialBuckets(0.001, 2, 15),
+	}, []string{"title"})
+
+	// Rebalances 消费者组重平衡的次数
+	Rebalances = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "logtransfer",
+		Name:      "rebalances_total",
+		Help:      "Consumer group sessions started.",
+	}, []string{"title"})
+
+	// ConsumeRetries 消费出错后重试的次数
+	ConsumeRetries = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "logtransfer",
+		Name:      "consume_retries_total",
+		Help:      "Consumer group consume retries after errors.",
+	}, []string{"title"})
+
+	// ConsumerLag 分区的最新位置和提交的位置之间的消息数
+	ConsumerLag = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "logtransfer",
+		Name:      "consumer_lag",
+		Help:      "High water mark minus committed offset of a claimed partition.",
+	}, []string{"title", "partition"})
+)
+
+func init() {
+	prometheus.MustRegister(
+		MessagesConsumed, DocumentsSaved, DocumentsFailed, SaveLatency,
+		Rebalances, ConsumeRetries, ConsumerLag,
+	)
+}
+
+// Handler /metrics的处理函数
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
+
+// Delete 删除管道的指标, 管道删除后调用
+// 分区积压在分区的消费结束时删除
+func Delete(title string) {
+	MessagesConsumed.DeleteLabelValues(title)
+	DocumentsSaved.DeleteLabelValues(title)
+	DocumentsFailed.DeleteLabelValues(title)
+	SaveLatency.DeleteLabelValues(title)
+	Rebalances.DeleteLabelValues(title)
+	ConsumeRetries.DeleteLabelValues(title)
+}
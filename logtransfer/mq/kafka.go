@@ -1,164 +1,484 @@
-package mq
-
-import (
-	"context"
-	"errors"
-	"time"
-
-	"github.com/Shopify/sarama"
-	"github.com/sirupsen/logrus"
-)
-
-// kafkaConsumerGroup kafka消费者组
-type kafkaConsumerGroup struct {
-	topic    string               // kafka topic
-	hosts    []string             // kafka brokers
-	version  string               // kafka version
-	group    sarama.ConsumerGroup // kafka consumer group
-	sendChan chan string          // consume message channel
-	cancel   context.CancelFunc   // context
-	config   *sarama.Config       // kafka consumer configs
-}
-
-// newKafkaConsumerGroup 初始化
-func newKafkaConsumerGroup(topic, groupId string, hosts ...string) (*kafkaConsumerGroup, error) {
-	config := sarama.NewConfig()
-	config.Version = sarama.V2_4_0_0 // sarama版本
-	config.Consumer.Return.Errors = true
-	config.Consumer.Group.Rebalance.Strategy = sarama.BalanceStrategySticky // 重平衡策略
-	config.Consumer.Offsets.Initial = sarama.OffsetNewest
-
-	group, err := sarama.NewConsumerGroup(hosts, groupId, config)
-	if err != nil {
-		return nil, err
-	}
-
-	kConsumerGroup := &kafkaConsumerGroup{
-		topic:    topic,                   // kafka topic
-		hosts:    hosts,                   // kafka brokers
-		version:  config.Version.String(), // kafka consumer version
-		group:    group,                   // kafka consumer group
-		sendChan: make(chan string),       // message channel
-		config:   config,                  // kafka consumer config
-	}
-
-	// 监听错误信息
-	go func() {
-		for err := range group.Errors() {
-			logrus.Error("kafka consumer group error: ", err)
-		}
-		logrus.Debug("kafka group errors group exit.")
-	}()
-
-	// 消费消息
-	ctx, cancel := context.WithCancel(context.Background())
-	go kConsumerGroup.work(ctx)
-	kConsumerGroup.cancel = cancel
-
-	return kConsumerGroup, nil
-}
-
-// Setup saram 要求的方法
-func (*kafkaConsumerGroup) Setup(_ sarama.ConsumerGroupSession) error {
-	return nil
-}
-
-// Cleanup sarama 要求的方法
-func (*kafkaConsumerGroup) Cleanup(_ sarama.ConsumerGroupSession) error {
-	return nil
-}
-
-// ConsumeClaim sarama 要求的方法
-func (kg *kafkaConsumerGroup) ConsumeClaim(sess sarama.ConsumerGroupSession, claim sarama.ConsumerGroupClaim) error {
-	for msg := range claim.Messages() {
-		logrus.Debugf("Message topic:%q partition:%d offset:%d", msg.Topic, msg.Partition, msg.Offset)
-		kg.sendChan <- string(msg.Value)
-		sess.MarkMessage(msg, "")
-	}
-	return nil
-}
-
-// work 消费者组开始从kafka消费消息
-func (kg *kafkaConsumerGroup) work(ctx context.Context) {
-	// 错误重试次数
-	counts := 0
-	for {
-		select {
-		case <-ctx.Done():
-			logrus.Debug("Kafka parents context cancel, work stop.")
-			return
-		default:
-			err := kg.group.Consume(context.Background(), []string{kg.topic}, kg)
-			if err != nil {
-				logrus.Error("kafka consume messages error: ", err)
-				time.Sleep(time.Second) // 如果消费出错 则等待1s
-				counts++
-			}
-		}
-		// 错误重试次数为100
-		if counts >= 100 {
-			break
-		}
-	}
-
-	logrus.Errorf("kafka consumer group consume message error counts is %d, exit.", counts)
-}
-
-// consumer 从channel获取消息
-func (kg *kafkaConsumerGroup) consume() (string, error) {
-	msg, ok := <-kg.sendChan
-	if !ok {
-		return "", errors.New("send channel has closed")
-	}
-	return msg, nil
-}
-
-// update 更新消费者组
-func (kg *kafkaConsumerGroup) update(topic, groupId string, hosts ...string) error {
-	if kg.config == nil {
-		return errors.New("kafkaConsumerGroup config must be created.")
-	}
-	// 先释放资源
-	kg.group.Close()
-	kg.group = nil
-	kg.cancel()
-	kg.cancel = nil
-
-	// 重新创建消费者组
-	group, err := sarama.NewConsumerGroup(hosts, groupId, kg.config)
-	if err != nil {
-		return err
-	}
-	// 更新数据
-	kg.hosts = hosts
-	kg.group = group
-	// 监听错误信息
-	go func() {
-		for err := range group.Errors() {
-			logrus.Error("kafka consumer group error: ", err)
-		}
-	}()
-
-	// 消费消息
-	ctx, cancel := context.WithCancel(context.Background())
-	go kg.work(ctx)
-	kg.cancel = cancel
-
-	return nil
-}
-
-// close 释放资源
-func (kg *kafkaConsumerGroup) close() {
-	if kg.sendChan != nil {
-		close(kg.sendChan)
-		kg.sendChan = nil
-	}
-	if kg.group != nil {
-		kg.group.Close()
-		kg.group = nil
-	}
-	if kg.cancel != nil {
-		kg.cancel()
-		kg.cancel = nil
-	}
-}
+package mq
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"logtransfer/metrics"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// 更新分区积压的间隔
+	lagInterval = 10 * time.Second
+
+	// 消费出错后重试的间隔
+	retryBackoffMin = time.Second
+	retryBackoffMax = 30 * time.Second
+)
+
+// kafkaConsumerGroup kafka消费者组
+type kafkaConsumerGroup struct {
+	topic    string               // kafka topic
+	hosts    []string             // kafka brokers
+	version  string               // kafka version
+	groupId  string               // kafka consumer group id
+	since    time.Time            // 没有提交过偏移量的分区从该时间开始消费, 为零值时使用config中的初始位置
+	client   sarama.Client        // kafka client
+	group    sarama.ConsumerGroup // kafka consumer group
+	sendChan chan *Message        // consume message channel
+	cancel   context.CancelFunc   // context
+	config   *sarama.Config       // kafka consumer configs
+	closed   chan struct{}        // 消费者组关闭后关闭
+	mqconf   MqConf               // 当前的配置, 恢复消费时使用
+
+	stateLk    sync.Mutex                // 保护paused、connected、lastErr、resets和partitions
+	paused     bool                      // 已经暂停消费
+	connected  bool                      // 是否已经加入消费者组
+	lastErr    string                    // 最近一次消费的错误
+	resets     map[int32]int64           // 下次加入消费者组时需要重置的分区偏移量
+	partitions map[int32]PartitionStatus // 正在消费的分区的进度
+}
+
+// newKafkaConfig 生成消费者组的配置
+func newKafkaConfig(mqconf MqConf) (*sarama.Config, time.Time, error) {
+	config := sarama.NewConfig()
+	config.Version = sarama.V2_4_0_0 // sarama版本
+	config.Consumer.Return.Errors = true
+	config.Consumer.Group.Rebalance.Strategy = sarama.BalanceStrategySticky // 重平衡策略
+	config.Consumer.Offsets.Initial = sarama.OffsetNewest
+	if mqconf.InstanceId != "" {
+		config.ClientID = mqconf.InstanceId
+	}
+
+	var since time.Time
+	switch mqconf.InitialOffset {
+	case "", OffsetNewest:
+	case OffsetOldest:
+		config.Consumer.Offsets.Initial = sarama.OffsetOldest
+	default:
+		t, err := time.Parse(time.RFC3339, mqconf.InitialOffset)
+		if err != nil {
+			return nil, since, fmt.Errorf("Wrong initial offset %s: %v", mqconf.InitialOffset, err)
+		}
+		since = t
+	}
+
+	if err := applySecurity(config, mqconf.Security); err != nil {
+		return nil, since, err
+	}
+	if err := config.Validate(); err != nil {
+		return nil, since, err
+	}
+	return config, since, nil
+}
+
+// groupId 消费者组, 为空时使用默认值
+func groupId(mqconf MqConf) string {
+	if mqconf.Group == "" {
+		return GROUP_ID
+	}
+	return mqconf.Group
+}
+
+// newKafkaConsumerGroup 初始化
+func newKafkaConsumerGroup(mqconf MqConf) (*kafkaConsumerGroup, error) {
+	kConsumerGroup := &kafkaConsumerGroup{
+		sendChan: make(chan *Message), // message channel
+		closed:   make(chan struct{}),
+	}
+	err := kConsumerGroup.start(mqconf)
+	if err != nil {
+		return nil, err
+	}
+	return kConsumerGroup, nil
+}
+
+// start 创建消费者组并且开始消费
+func (kg *kafkaConsumerGroup) start(mqconf MqConf) error {
+	config, since, err := newKafkaConfig(mqconf)
+	if err != nil {
+		return err
+	}
+
+	client, err := sarama.NewClient(mqconf.Hosts, config)
+	if err != nil {
+		return err
+	}
+	group, err := sarama.NewConsumerGroupFromClient(groupId(mqconf), client)
+	if err != nil {
+		client.Close()
+		return err
+	}
+
+	// 更新数据
+	kg.topic = mqconf.Topic
+	kg.hosts = mqconf.Hosts
+	kg.version = config.Version.String()
+	kg.groupId = groupId(mqconf)
+	kg.since = since
+	kg.mqconf = mqconf
+	kg.client = client
+	kg.group = group
+	kg.config = config
+
+	// 监听错误信息
+	go func() {
+		for err := range group.Errors() {
+			logrus.Error("kafka consumer group error: ", err)
+			kg.setError(err)
+		}
+		logrus.Debug("kafka group errors group exit.")
+	}()
+
+	// 消费消息
+	ctx, cancel := context.WithCancel(context.Background())
+	go kg.work(ctx, group)
+	kg.cancel = cancel
+
+	return nil
+}
+
+// Setup saram 要求的方法
+// 先按照初始位置处理没有提交过偏移量的分区, 再重置管理接口指定的分区
+func (kg *kafkaConsumerGroup) Setup(sess sarama.ConsumerGroupSession) error {
+	// 每次重平衡都会开始新的会话
+	metrics.Rebalances.WithLabelValues(kg.topic).Inc()
+	kg.setConnected(true)
+	if err := kg.resetSince(sess); err != nil {
+		return err
+	}
+	return kg.resetOffsets(sess)
+}
+
+// resetSince 初始位置为时间时, 没有提交过偏移量的分区从该时间之后的第一条消息开始消费
+func (kg *kafkaConsumerGroup) resetSince(sess sarama.ConsumerGroupSession) error {
+	if kg.since.IsZero() {
+		return nil
+	}
+
+	// admin和消费者组共用client, 不需要关闭
+	admin, err := sarama.NewClusterAdminFromClient(kg.client)
+	if err != nil {
+		return err
+	}
+	resp, err := admin.ListConsumerGroupOffsets(kg.groupId, sess.Claims())
+	if err != nil {
+		return err
+	}
+
+	for topic, partitions := range sess.Claims() {
+		for _, partition := range partitions {
+			block := resp.GetBlock(topic, partition)
+			if block == nil || block.Err != sarama.ErrNoError || block.Offset >= 0 {
+				continue
+			}
+			offset, err := kg.client.GetOffset(topic, partition, kg.since.UnixNano()/int64(time.Millisecond))
+			if err != nil {
+				return err
+			}
+			// 该时间之后没有消息时从最新位置开始消费
+			if offset < 0 {
+				continue
+			}
+			logrus.Debugf("Reset topic %s partition %d offset to %d, since %v", topic, partition, offset, kg.since)
+			sess.ResetOffset(topic, partition, offset, "")
+		}
+	}
+	return nil
+}
+
+// resetOffsets 重置需要重新消费的分区, 只处理本次会话分配到的分区, 其他分区的重置被丢弃
+func (kg *kafkaConsumerGroup) resetOffsets(sess sarama.ConsumerGroupSession) error {
+	kg.stateLk.Lock()
+	resets := kg.resets
+	kg.resets = nil
+	kg.stateLk.Unlock()
+	if len(resets) == 0 {
+		return nil
+	}
+
+	for topic, partitions := range sess.Claims() {
+		for _, partition := range partitions {
+			offset, ok := resets[partition]
+			if !ok {
+				offset, ok = resets[AllPartitions]
+			}
+			if !ok {
+				continue
+			}
+			if offset == OffsetStart {
+				var err error
+				offset, err = kg.client.GetOffset(topic, partition, sarama.OffsetOldest)
+				if err != nil {
+					return err
+				}
+			}
+			// ResetOffset只能往前移动, MarkOffset只能往后移动
+			sess.ResetOffset(topic, partition, offset, "")
+			sess.MarkOffset(topic, partition, offset, "")
+			logrus.Infof("Reread topic %s partition %d from offset %d", topic, partition, offset)
+		}
+	}
+	return nil
+}
+
+// Cleanup sarama 要求的方法
+func (*kafkaConsumerGroup) Cleanup(_ sarama.ConsumerGroupSession) error {
+	return nil
+}
+
+// ConsumeClaim sarama 要求的方法
+// 消息处理完成后才提交偏移量, 重平衡或者重启后没有处理完成的消息会被重新消费
+func (kg *kafkaConsumerGroup) ConsumeClaim(sess sarama.ConsumerGroupSession, claim sarama.ConsumerGroupClaim) error {
+	tracker := newPartitionTracker(sess, claim.Topic(), claim.Partition(), claim.InitialOffset())
+
+	// 定期更新分区的积压: 最新位置和已经提交的位置之差
+	partition := strconv.Itoa(int(claim.Partition()))
+	lag := metrics.ConsumerLag.WithLabelValues(kg.topic, partition)
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	defer func() {
+		// 等待更新退出后再删除, 避免删除后又被更新
+		close(done)
+		<-stopped
+		metrics.ConsumerLag.DeleteLabelValues(kg.topic, partition)
+		kg.stateLk.Lock()
+		delete(kg.partitions, claim.Partition())
+		kg.stateLk.Unlock()
+	}()
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(lagInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if committed := tracker.offset(); committed >= 0 {
+					highWater := claim.HighWaterMarkOffset()
+					kg.setLag(claim.Partition(), committed, highWater)
+					lag.Set(float64(highWater - committed))
+				}
+			}
+		}
+	}()
+
+	for msg := range claim.Messages() {
+		logrus.Debugf("Message topic:%q partition:%d offset:%d", msg.Topic, msg.Partition, msg.Offset)
+		pending := tracker.add(msg.Offset)
+		message := &Message{
+			Topic:     msg.Topic,
+			Partition: msg.Partition,
+			Offset:    msg.Offset,
+			Value:     string(msg.Value),
+			ack: func() {
+				tracker.ack(pending)
+			},
+		}
+		select {
+		case <-sess.Context().Done():
+			return nil
+		case kg.sendChan <- message:
+		}
+	}
+	return nil
+}
+
+// work 消费者组开始从kafka消费消息
+// 消费出错时按照退避时间一直重试, 直到消费者组停止
+func (kg *kafkaConsumerGroup) work(ctx context.Context, group sarama.ConsumerGroup) {
+	backoff := retryBackoffMin
+	for {
+		err := group.Consume(ctx, []string{kg.topic}, kg)
+		if ctx.Err() != nil {
+			logrus.Debug("Kafka parents context cancel, work stop.")
+			return
+		}
+		if err == nil {
+			// 会话正常结束(比如重平衡), 重新加入消费者组
+			backoff = retryBackoffMin
+			continue
+		}
+
+		metrics.ConsumeRetries.WithLabelValues(kg.topic).Inc()
+		kg.setConnected(false)
+		kg.setError(err)
+		logrus.Errorf("kafka consume messages of %s error: %v, retry after %v", kg.topic, err, backoff)
+		select {
+		case <-ctx.Done():
+			logrus.Debug("Kafka parents context cancel, work stop.")
+			return
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if backoff > retryBackoffMax {
+			backoff = retryBackoffMax
+		}
+	}
+}
+
+// isPaused 是否已经暂停消费
+func (kg *kafkaConsumerGroup) isPaused() bool {
+	kg.stateLk.Lock()
+	defer kg.stateLk.Unlock()
+	return kg.paused
+}
+
+// setPaused 记录是否已经暂停消费
+func (kg *kafkaConsumerGroup) setPaused(paused bool) {
+	kg.stateLk.Lock()
+	kg.paused = paused
+	kg.stateLk.Unlock()
+}
+
+// setConnected 记录是否已经加入消费者组
+func (kg *kafkaConsumerGroup) setConnected(connected bool) {
+	kg.stateLk.Lock()
+	kg.connected = connected
+	kg.stateLk.Unlock()
+}
+
+// setError 记录最近一次错误
+func (kg *kafkaConsumerGroup) setError(err error) {
+	kg.stateLk.Lock()
+	kg.lastErr = err.Error()
+	kg.stateLk.Unlock()
+}
+
+// setLag 记录分区的消费进度
+func (kg *kafkaConsumerGroup) setLag(partition int32, committed, highWater int64) {
+	kg.stateLk.Lock()
+	defer kg.stateLk.Unlock()
+	if kg.partitions == nil {
+		kg.partitions = map[int32]PartitionStatus{}
+	}
+	kg.partitions[partition] = PartitionStatus{
+		Partition: partition,
+		Committed: committed,
+		HighWater: highWater,
+		Lag:       highWater - committed,
+	}
+}
+
+// status 消费者组的状态
+func (kg *kafkaConsumerGroup) status() Status {
+	kg.stateLk.Lock()
+	defer kg.stateLk.Unlock()
+	st := Status{
+		Connected:  kg.connected,
+		Paused:     kg.paused,
+		LastError:  kg.lastErr,
+		Partitions: []PartitionStatus{},
+	}
+	for _, p := range kg.partitions {
+		st.Partitions = append(st.Partitions, p)
+	}
+	sort.Slice(st.Partitions, func(i, j int) bool {
+		return st.Partitions[i].Partition < st.Partitions[j].Partition
+	})
+	return st
+}
+
+// consumer 从channel获取消息
+func (kg *kafkaConsumerGroup) consume() (*Message, error) {
+	select {
+	case <-kg.closed:
+		return nil, errors.New("kafka consumer group has closed")
+	case msg := <-kg.sendChan:
+		return msg, nil
+	}
+}
+
+// pause 暂停消费, 退出消费者组
+func (kg *kafkaConsumerGroup) pause() {
+	if kg.isPaused() {
+		return
+	}
+	kg.stop()
+	kg.setPaused(true)
+	logrus.Infof("Pause kafka consumer group of %s", kg.topic)
+}
+
+// resume 重新加入消费者组
+func (kg *kafkaConsumerGroup) resume() error {
+	if !kg.isPaused() {
+		return nil
+	}
+	if err := kg.start(kg.mqconf); err != nil {
+		return err
+	}
+	kg.setPaused(false)
+	logrus.Infof("Resume kafka consumer group of %s", kg.topic)
+	return nil
+}
+
+// reread 记录需要重置的分区, 然后重新加入消费者组, 在Setup中重置
+// 暂停时在恢复消费后重置
+func (kg *kafkaConsumerGroup) reread(partition int32, offset int64) error {
+	kg.stateLk.Lock()
+	if kg.resets == nil {
+		kg.resets = map[int32]int64{}
+	}
+	kg.resets[partition] = offset
+	kg.stateLk.Unlock()
+	if kg.isPaused() {
+		return nil
+	}
+
+	kg.stop()
+	return kg.start(kg.mqconf)
+}
+
+// update 更新消费者组, 暂停时只保存配置
+func (kg *kafkaConsumerGroup) update(mqconf MqConf) error {
+	if kg.config == nil {
+		return errors.New("kafkaConsumerGroup config must be created.")
+	}
+	if kg.isPaused() {
+		if _, _, err := newKafkaConfig(mqconf); err != nil {
+			return err
+		}
+		kg.mqconf = mqconf
+		return nil
+	}
+	// 先释放资源
+	kg.stop()
+
+	// 重新创建消费者组
+	return kg.start(mqconf)
+}
+
+// stop 停止消费并且释放消费者组
+func (kg *kafkaConsumerGroup) stop() {
+	kg.setConnected(false)
+	if kg.cancel != nil {
+		kg.cancel()
+		kg.cancel = nil
+	}
+	if kg.group != nil {
+		kg.group.Close()
+		kg.group = nil
+	}
+	if kg.client != nil {
+		kg.client.Close()
+		kg.client = nil
+	}
+}
+
+// close 释放资源
+func (kg *kafkaConsumerGroup) close() {
+	select {
+	case <-kg.closed:
+	default:
+		close(kg.closed)
+	}
+	kg.stop()
+}
@@ -1,78 +1,156 @@
-package mq
-
-import (
-	"fmt"
-)
-
-// 消息队列客户端接口
-type consumer interface {
-	consume() (string, error)
-	update(string, string, ...string) error
-	close()
-}
-
-type MqConf struct {
-	Flag  Flag
-	Topic string
-	Hosts []string
-}
-
-// 消息队列
-type MessageQueue struct {
-	Topic    string
-	Hosts    []string
-	Consumer consumer
-}
-
-// 消息队列的类型
-type Flag int
-
-// 支持的消息队列类型
-const (
-	KAFKA Flag = iota
-)
-
-// group 暂时写死
-var GROUP_ID = "my-group"
-
-// NewMessageQueue 初始化消息队列
-func NewMessageQueue(mqconf MqConf) (*MessageQueue, error) {
-	var c consumer
-	var err error
-
-	switch mqconf.Flag {
-	case KAFKA:
-		// groupId 暂时写死
-		c, err = newKafkaConsumerGroup(mqconf.Topic, GROUP_ID, mqconf.Hosts...)
-	default:
-		err = fmt.Errorf("Not implement flag: %d", mqconf.Flag)
-	}
-
-	if err != nil {
-		return nil, err
-	}
-
-	mq := &MessageQueue{
-		Topic:    mqconf.Topic,
-		Hosts:    mqconf.Hosts,
-		Consumer: c,
-	}
-	return mq, nil
-}
-
-// Consume 消费消息
-func (mq *MessageQueue) Consume() (string, error) {
-	return mq.Consumer.consume()
-}
-
-// Update 更新资源
-func (mq *MessageQueue) Update(config MqConf) error {
-	return mq.Consumer.update(config.Topic, GROUP_ID, config.Hosts...)
-}
-
-// Close 释放资源
-func (mq *MessageQueue) Close() {
-	if mq.Consumer != nil {
-		mq.Consumer.close()
-	}
-}
+package mq
+
+import (
+	"fmt"
+)
+
+// 消息队列客户端接口
+type consumer interface {
+	consume() (*Message, error)
+	update(MqConf) error
+	status() Status
+	pause()
+	resume() error
+	reread(partition int32, offset int64) error
+	close()
+}
+
+// Status 消费者的状态
+type Status struct {
+	Connected  bool              `json:"connected"`  // 是否已经加入消费者组
+	Paused     bool              `json:"paused"`     // 是否已经暂停消费
+	LastError  string            `json:"last_error"` // 最近一次消费的错误
+	Partitions []PartitionStatus `json:"partitions"` // 本实例正在消费的分区
+}
+
+// PartitionStatus 分区的消费进度
+type PartitionStatus struct {
+	Partition int32 `json:"partition"`
+	Committed int64 `json:"committed"`  // 已经提交的偏移量
+	HighWater int64 `json:"high_water"` // 分区的最新位置
+	Lag       int64 `json:"lag"`        // 积压的消息数
+}
+
+// Message 消息队列中的消息
+type Message struct {
+	Topic     string
+	Partition int32
+	Offset    int64
+	Value     string
+	ack       func()
+}
+
+// Ack 消息已经处理完成, 可以提交该消息的偏移量
+// 没有调用Ack的消息在重启或者重平衡后会被重新消费
+func (m *Message) Ack() {
+	if m.ack != nil {
+		m.ack()
+	}
+}
+
+type MqConf struct {
+	Flag          Flag
+	Topic         string
+	Hosts         []string
+	Group         string       // 消费者组, 为空时使用GROUP_ID
+	InitialOffset string       // 没有提交过偏移量时的初始位置: oldest, newest或者RFC3339格式的时间, 为空时为newest
+	InstanceId    string       // 消费者实例id, 为空时使用默认值
+	Security      SecurityConf // 加密和认证配置
+}
+
+// 消息队列
+type MessageQueue struct {
+	Topic    string
+	Hosts    []string
+	Consumer consumer
+}
+
+// 消息队列的类型
+type Flag int
+
+// 支持的消息队列类型
+const (
+	KAFKA Flag = iota
+)
+
+// GROUP_ID 默认的消费者组
+var GROUP_ID = "my-group"
+
+// 初始位置
+const (
+	OffsetOldest = "oldest"
+	OffsetNewest = "newest"
+)
+
+// 重新消费的分区和位置
+const (
+	AllPartitions int32 = -1 // 全部分区
+	OffsetStart   int64 = -2 // 分区中最早的消息
+)
+
+// NewMessageQueue 初始化消息队列
+func NewMessageQueue(mqconf MqConf) (*MessageQueue, error) {
+	var c consumer
+	var err error
+
+	switch mqconf.Flag {
+	case KAFKA:
+		c, err = newKafkaConsumerGroup(mqconf)
+	default:
+		err = fmt.Errorf("Not implement flag: %d", mqconf.Flag)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	mq := &MessageQueue{
+		Topic:    mqconf.Topic,
+		Hosts:    mqconf.Hosts,
+		Consumer: c,
+	}
+	return mq, nil
+}
+
+// Consume 消费消息, 消息处理完成后需要调用Ack
+func (mq *MessageQueue) Consume() (*Message, error) {
+	return mq.Consumer.consume()
+}
+
+// Status 消费者的状态
+func (mq *MessageQueue) Status() Status {
+	if mq.Consumer == nil {
+		return Status{}
+	}
+	return mq.Consumer.status()
+}
+
+// Pause 暂停消费, 退出消费者组, 分区会分配给其他消费者
+func (mq *MessageQueue) Pause() {
+	mq.Consumer.pause()
+}
+
+// Resume 恢复消费
+func (mq *MessageQueue) Resume() error {
+	return mq.Consumer.resume()
+}
+
+// Reread 从指定的位置重新消费分区, partition为AllPartitions时重新消费全部分区, offset为OffsetStart时从最早的消息开始
+func (mq *MessageQueue) Reread(partition int32, offset int64) error {
+	if offset < 0 && offset != OffsetStart {
+		return fmt.Errorf("Wrong offset: %d", offset)
+	}
+	return mq.Consumer.reread(partition, offset)
+}
+
+// Update 更新资源
+func (mq *MessageQueue) Update(config MqConf) error {
+	return mq.Consumer.update(config)
+}
+
+// Close 释放资源
+func (mq *MessageQueue) Close() {
+	if mq.Consumer != nil {
+		mq.Consumer.close()
+	}
+}
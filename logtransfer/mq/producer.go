@@ -0,0 +1,96 @@
+package mq
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/Shopify/sarama"
+)
+
+// 消息队列生产者接口, 用于写入死信以及重放死信
+type producer interface {
+	produce(topic string, value string) error
+	close()
+}
+
+// MessageProducer 消息队列生产者
+type MessageProducer struct {
+	Hosts    []string
+	Producer producer
+}
+
+// NewMessageProducer 初始化生产者
+func NewMessageProducer(mqconf MqConf) (*MessageProducer, error) {
+	var p producer
+	var err error
+
+	switch mqconf.Flag {
+	case KAFKA:
+		p, err = newKafkaProducer(mqconf)
+	default:
+		err = fmt.Errorf("Not implement flag: %d", mqconf.Flag)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &MessageProducer{
+		Hosts:    mqconf.Hosts,
+		Producer: p,
+	}, nil
+}
+
+// Produce 同步发送消息
+func (mp *MessageProducer) Produce(topic string, value string) error {
+	if mp.Producer == nil {
+		return errors.New("producer has closed")
+	}
+	return mp.Producer.produce(topic, value)
+}
+
+// Close 释放资源
+func (mp *MessageProducer) Close() {
+	if mp.Producer != nil {
+		mp.Producer.close()
+		mp.Producer = nil
+	}
+}
+
+// kafkaProducer kafka同步生产者
+type kafkaProducer struct {
+	prod sarama.SyncProducer
+}
+
+// newKafkaProducer 初始化kafka生产者
+func newKafkaProducer(mqconf MqConf) (*kafkaProducer, error) {
+	if len(mqconf.Hosts) == 0 {
+		return nil, errors.New("kafka hosts is empty")
+	}
+	config := sarama.NewConfig()
+	config.Producer.RequiredAcks = sarama.WaitForAll
+	config.Producer.Return.Successes = true
+	if err := applySecurity(config, mqconf.Security); err != nil {
+		return nil, err
+	}
+
+	prod, err := sarama.NewSyncProducer(mqconf.Hosts, config)
+	if err != nil {
+		return nil, err
+	}
+	return &kafkaProducer{prod: prod}, nil
+}
+
+// produce 发送消息
+func (kp *kafkaProducer) produce(topic string, value string) error {
+	_, _, err := kp.prod.SendMessage(&sarama.ProducerMessage{
+		Topic: topic,
+		Value: sarama.StringEncoder(value),
+	})
+	return err
+}
+
+// close 释放资源
+func (kp *kafkaProducer) close() {
+	kp.prod.Close()
+}
@@ -0,0 +1,122 @@
+package mq
+
+import (
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/sirupsen/logrus"
+)
+
+// readIdleTimeout 读取分区时等待下一条消息的时间
+// 压缩、事务的控制消息会在分区中留下空洞, 超时后认为已经读取到最新位置
+const readIdleTimeout = 10 * time.Second
+
+// ReadTopic 从消费者组上次提交的位置开始, 读取topic中的消息直到开始读取时的最新位置
+// 使用mqconf中的Hosts、Topic、Group以及加密和认证配置
+// handler返回错误时停止读取, 处理成功的消息会提交偏移量, 返回处理成功的消息数量
+func ReadTopic(mqconf MqConf, handler func(value string) error) (int, error) {
+	config := sarama.NewConfig()
+	config.Version = sarama.V2_4_0_0
+	config.Consumer.Offsets.Initial = sarama.OffsetOldest
+	config.Consumer.Return.Errors = true
+	if err := applySecurity(config, mqconf.Security); err != nil {
+		return 0, err
+	}
+
+	topic, groupId := mqconf.Topic, groupId(mqconf)
+	client, err := sarama.NewClient(mqconf.Hosts, config)
+	if err != nil {
+		return 0, err
+	}
+	defer client.Close()
+
+	om, err := sarama.NewOffsetManagerFromClient(groupId, client)
+	if err != nil {
+		return 0, err
+	}
+	// 关闭时提交偏移量
+	defer om.Close()
+
+	consumer, err := sarama.NewConsumerFromClient(client)
+	if err != nil {
+		return 0, err
+	}
+	defer consumer.Close()
+
+	partitions, err := client.Partitions(topic)
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for _, partition := range partitions {
+		n, err := readPartition(client, om, consumer, topic, partition, handler)
+		count += n
+		if err != nil {
+			return count, err
+		}
+	}
+	return count, nil
+}
+
+// readPartition 读取单个分区
+func readPartition(client sarama.Client, om sarama.OffsetManager, consumer sarama.Consumer, topic string, partition int32, handler func(value string) error) (int, error) {
+	newest, err := client.GetOffset(topic, partition, sarama.OffsetNewest)
+	if err != nil {
+		return 0, err
+	}
+	pom, err := om.ManagePartition(topic, partition)
+	if err != nil {
+		return 0, err
+	}
+	defer pom.AsyncClose()
+
+	next, _ := pom.NextOffset()
+	if next < 0 {
+		next, err = client.GetOffset(topic, partition, sarama.OffsetOldest)
+		if err != nil {
+			return 0, err
+		}
+	}
+	if next >= newest {
+		return 0, nil
+	}
+
+	pc, err := consumer.ConsumePartition(topic, partition, next)
+	if err != nil {
+		return 0, err
+	}
+	defer pc.Close()
+
+	// 偏移量不一定连续, 不能只靠最后一条消息的偏移量判断是否读取完成
+	count := 0
+	for next < newest {
+		select {
+		case msg, ok := <-pc.Messages():
+			if !ok {
+				return count, nil
+			}
+			if msg.Offset >= newest {
+				next = msg.Offset
+				break
+			}
+			if err := handler(string(msg.Value)); err != nil {
+				return count, err
+			}
+			next = msg.Offset + 1
+			pom.MarkOffset(next, "")
+			count++
+		case err := <-pc.Errors():
+			return count, err
+		case <-time.After(readIdleTimeout):
+			logrus.Warnf("Read topic %s partition %d timeout at offset %d, high water mark %d, newest %d", topic, partition, next, pc.HighWaterMarkOffset(), newest)
+			return count, nil
+		}
+		// 已经读取到分区的高水位
+		if hwm := pc.HighWaterMarkOffset(); hwm > 0 && next >= hwm {
+			break
+		}
+	}
+	logrus.Debugf("Read topic %s partition %d suc, %d messages", topic, partition, count)
+	return count, nil
+}
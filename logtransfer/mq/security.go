@@ -0,0 +1,144 @@
+package mq
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/Shopify/sarama"
+	"github.com/xdg/scram"
+)
+
+// SASL认证方式
+const (
+	SASLPlain       = "PLAIN"
+	SASLScramSHA256 = "SCRAM-SHA-256"
+	SASLScramSHA512 = "SCRAM-SHA-512"
+)
+
+// SecurityConf kafka的加密和认证配置
+type SecurityConf struct {
+	TLS  TLSConf
+	SASL SASLConf
+}
+
+// TLSConf tls配置, 证书和私钥都是文件路径
+type TLSConf struct {
+	Enable             bool
+	CA                 string // CA证书, 为空时使用系统的CA
+	Cert               string // 客户端证书, 双向认证时使用
+	Key                string // 客户端私钥
+	InsecureSkipVerify bool   // 不校验服务端证书
+}
+
+// SASLConf sasl配置, 配置了PasswordFile时从文件中读取密码
+type SASLConf struct {
+	Mechanism    string // 为空时不认证: PLAIN, SCRAM-SHA-256, SCRAM-SHA-512
+	User         string
+	Password     string
+	PasswordFile string
+}
+
+// applySecurity 将加密和认证配置写入sarama的配置
+func applySecurity(config *sarama.Config, sc SecurityConf) error {
+	if sc.TLS.Enable {
+		tlsConfig, err := newTLSConfig(sc.TLS)
+		if err != nil {
+			return err
+		}
+		config.Net.TLS.Enable = true
+		config.Net.TLS.Config = tlsConfig
+	}
+
+	if sc.SASL.Mechanism == "" {
+		return nil
+	}
+	password := sc.SASL.Password
+	if sc.SASL.PasswordFile != "" {
+		b, err := ioutil.ReadFile(sc.SASL.PasswordFile)
+		if err != nil {
+			return fmt.Errorf("read sasl password file error: %v", err)
+		}
+		password = strings.TrimSpace(string(b))
+	}
+	config.Net.SASL.Enable = true
+	config.Net.SASL.User = sc.SASL.User
+	config.Net.SASL.Password = password
+	config.Net.SASL.Handshake = true
+
+	switch sc.SASL.Mechanism {
+	case SASLPlain:
+		config.Net.SASL.Mechanism = sarama.SASLTypePlaintext
+	case SASLScramSHA256:
+		config.Net.SASL.Mechanism = sarama.SASLTypeSCRAMSHA256
+		config.Net.SASL.SCRAMClientGeneratorFunc = func() sarama.SCRAMClient {
+			return &scramClient{hashGenerator: scram.HashGeneratorFcn(sha256.New)}
+		}
+	case SASLScramSHA512:
+		config.Net.SASL.Mechanism = sarama.SASLTypeSCRAMSHA512
+		config.Net.SASL.SCRAMClientGeneratorFunc = func() sarama.SCRAMClient {
+			return &scramClient{hashGenerator: scram.HashGeneratorFcn(sha512.New)}
+		}
+	default:
+		return fmt.Errorf("wrong sasl mechanism: %s", sc.SASL.Mechanism)
+	}
+	// scram需要kafka 0.10.2以上
+	if !config.Version.IsAtLeast(sarama.V0_10_2_0) {
+		config.Version = sarama.V0_10_2_0
+	}
+	return nil
+}
+
+// newTLSConfig 读取证书
+func newTLSConfig(c TLSConf) (*tls.Config, error) {
+	tlsConfig := &tls.Config{InsecureSkipVerify: c.InsecureSkipVerify}
+	if c.CA != "" {
+		b, err := ioutil.ReadFile(c.CA)
+		if err != nil {
+			return nil, fmt.Errorf("read tls ca error: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(b) {
+			return nil, errors.New("wrong tls ca")
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if c.Cert != "" || c.Key != "" {
+		cert, err := tls.LoadX509KeyPair(c.Cert, c.Key)
+		if err != nil {
+			return nil, fmt.Errorf("load tls cert error: %v", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
+}
+
+// scramClient 实现sarama.SCRAMClient
+type scramClient struct {
+	*scram.Client
+	*scram.ClientConversation
+	hashGenerator scram.HashGeneratorFcn
+}
+
+func (c *scramClient) Begin(userName, password, authzID string) error {
+	client, err := c.hashGenerator.NewClient(userName, password, authzID)
+	if err != nil {
+		return err
+	}
+	c.Client = client
+	c.ClientConversation = client.NewConversation()
+	return nil
+}
+
+func (c *scramClient) Step(challenge string) (string, error) {
+	return c.ClientConversation.Step(challenge)
+}
+
+func (c *scramClient) Done() bool {
+	return c.ClientConversation.Done()
+}
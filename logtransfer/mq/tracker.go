@@ -0,0 +1,72 @@
+package mq
+
+import (
+	"sync"
+
+	"github.com/Shopify/sarama"
+)
+
+// pendingMessage 已经消费但是还没有处理完成的消息
+type pendingMessage struct {
+	offset int64
+	acked  bool
+}
+
+// partitionTracker 记录单个分区中还没有处理完成的消息
+// 只有前面的消息全部处理完成后才提交偏移量, 保证不会跳过没有存储成功的消息
+type partitionTracker struct {
+	lk        sync.Mutex
+	sess      sarama.ConsumerGroupSession
+	topic     string
+	partition int32
+	pending   []*pendingMessage
+	committed int64 // 已经提交的偏移量
+}
+
+func newPartitionTracker(sess sarama.ConsumerGroupSession, topic string, partition int32, initial int64) *partitionTracker {
+	return &partitionTracker{
+		sess:      sess,
+		topic:     topic,
+		partition: partition,
+		committed: initial,
+	}
+}
+
+// offset 已经提交的偏移量
+func (t *partitionTracker) offset() int64 {
+	t.lk.Lock()
+	defer t.lk.Unlock()
+	return t.committed
+}
+
+// add 记录新消费的消息
+func (t *partitionTracker) add(offset int64) *pendingMessage {
+	p := &pendingMessage{offset: offset}
+	t.lk.Lock()
+	// 没有提交过偏移量时, 从第一条消费的消息开始计算积压
+	if t.committed < 0 {
+		t.committed = offset
+	}
+	t.pending = append(t.pending, p)
+	t.lk.Unlock()
+	return p
+}
+
+// ack 消息已经处理完成
+func (t *partitionTracker) ack(p *pendingMessage) {
+	t.lk.Lock()
+	defer t.lk.Unlock()
+	p.acked = true
+
+	var next int64 = -1
+	for len(t.pending) > 0 && t.pending[0].acked {
+		next = t.pending[0].offset + 1
+		t.pending[0] = nil
+		t.pending = t.pending[1:]
+	}
+	if next >= 0 {
+		// 提交的是下一条需要消费的消息的偏移量
+		t.sess.MarkOffset(t.topic, t.partition, next, "")
+		t.committed = next
+	}
+}
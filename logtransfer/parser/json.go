@@ -0,0 +1,16 @@
+package parser
+
+import (
+	"encoding/json"
+)
+
+// jsonParser 解析json对象
+type jsonParser struct{}
+
+func (*jsonParser) parse(text string) (map[string]interface{}, error) {
+	fields := map[string]interface{}{}
+	if err := json.Unmarshal([]byte(text), &fields); err != nil {
+		return nil, err
+	}
+	return fields, nil
+}
@@ -0,0 +1,84 @@
+package parser
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+)
+
+// logfmtParser 解析logfmt格式, 例如`level=info msg="request done" duration=12ms`
+// 没有值的key解析为true, 至少需要一个key=value, 避免把普通文本解析为字段
+type logfmtParser struct{}
+
+func (*logfmtParser) parse(text string) (map[string]interface{}, error) {
+	fields := map[string]interface{}{}
+	pairs := 0
+	i := 0
+	for {
+		// 跳过空白
+		for i < len(text) && isSpace(text[i]) {
+			i++
+		}
+		if i >= len(text) {
+			break
+		}
+
+		// key
+		start := i
+		for i < len(text) && text[i] != '=' && !isSpace(text[i]) {
+			i++
+		}
+		key := text[start:i]
+		if key == "" {
+			return nil, fmt.Errorf("empty key at %d", start)
+		}
+		if i >= len(text) || text[i] != '=' {
+			fields[key] = true
+			continue
+		}
+		i++
+		pairs++
+
+		// value
+		if i < len(text) && text[i] == '"' {
+			end := quotedEnd(text, i)
+			if end < 0 {
+				return nil, errors.New("unterminated quoted value of " + key)
+			}
+			value, err := strconv.Unquote(text[i : end+1])
+			if err != nil {
+				return nil, fmt.Errorf("wrong quoted value of %s: %v", key, err)
+			}
+			fields[key] = value
+			i = end + 1
+			continue
+		}
+		start = i
+		for i < len(text) && !isSpace(text[i]) {
+			i++
+		}
+		fields[key] = text[start:i]
+	}
+
+	if pairs == 0 {
+		return nil, errors.New("no logfmt fields")
+	}
+	return fields, nil
+}
+
+// quotedEnd 引号开始的值的结束位置, 没有结束引号时返回-1
+func quotedEnd(text string, start int) int {
+	for i := start + 1; i < len(text); i++ {
+		switch text[i] {
+		case '\\':
+			i++
+		case '"':
+			return i
+		}
+	}
+	return -1
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t'
+}
@@ -0,0 +1,137 @@
+package parser
+
+import (
+	"fmt"
+
+	"github.com/sirupsen/logrus"
+)
+
+// 解析器的类型
+type Flag string
+
+// 支持的解析器类型
+const (
+	JSON   Flag = "json"
+	LOGFMT Flag = "logfmt"
+	REGEX  Flag = "regex"
+	GROK   Flag = "grok"
+)
+
+// 默认解析的字段
+const defaultField = "msg"
+
+// 解析失败时记录错误的字段
+const ErrorField = "parse_error"
+
+// reservedFields 文档的固定字段(消息内容、信封中的来源信息和时间), 文档中已经有这些字段时解析出的同名字段不会覆盖它们
+// 日志中的@timestamp可以写入文档, 没有配置事件时间的字段时作为事件时间
+var reservedFields = map[string]bool{
+	"msg":         true,
+	"time":        true,
+	"fields":      true,
+	"name":        true,
+	"hostname":    true,
+	"ip":          true,
+	"node":        true,
+	"path":        true,
+	"offset":      true,
+	"line":        true,
+	"readtime":    true,
+	"ingest_time": true,
+	ErrorField:    true,
+}
+
+// 解析器接口, 将文本解析为字段
+type parser interface {
+	parse(text string) (map[string]interface{}, error)
+}
+
+// 解析器配置
+type Conf struct {
+	Flag     Flag
+	Field    string            // 解析的字段, 为空时解析msg
+	Target   string            // 解析结果存放的字段, 为空时作为文档的字段
+	Pattern  string            // regex和grok的表达式
+	Patterns map[string]string // grok的自定义模式
+}
+
+// step 按顺序执行的解析步骤
+type step struct {
+	flag   Flag
+	field  string
+	target string
+	parser parser
+}
+
+// Parser 解析器链, 按照配置的顺序解析文档
+type Parser struct {
+	steps []step
+}
+
+// NewParser 初始化解析器链, 没有配置时不做任何解析
+func NewParser(configs []Conf) (*Parser, error) {
+	p := &Parser{}
+	for i, c := range configs {
+		var ps parser
+		var err error
+
+		switch c.Flag {
+		case JSON:
+			ps = &jsonParser{}
+		case LOGFMT:
+			ps = &logfmtParser{}
+		case REGEX:
+			ps, err = newRegexParser(c.Pattern)
+		case GROK:
+			ps, err = newGrokParser(c.Pattern, c.Patterns)
+		default:
+			err = fmt.Errorf("wrong parser flag: %s", c.Flag)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("parser %d: %v", i, err)
+		}
+		if reservedFields[c.Target] {
+			return nil, fmt.Errorf("parser %d: target %s is a reserved field", i, c.Target)
+		}
+
+		field := c.Field
+		if field == "" {
+			field = defaultField
+		}
+		p.steps = append(p.steps, step{
+			flag:   c.Flag,
+			field:  field,
+			target: c.Target,
+			parser: ps,
+		})
+	}
+	return p, nil
+}
+
+// Parse 解析文档, 解析出的字段写入文档, 和已有字段同名时覆盖已有字段, 但是跳过文档已有的固定字段
+// 解析失败时在parse_error中记录错误, 并且继续执行后面的解析器
+func (p *Parser) Parse(doc map[string]interface{}) {
+	for _, s := range p.steps {
+		text, ok := doc[s.field].(string)
+		if !ok {
+			continue
+		}
+		fields, err := s.parser.parse(text)
+		if err != nil {
+			doc[ErrorField] = fmt.Sprintf("%s: %v", s.flag, err)
+			continue
+		}
+
+		if s.target == "" {
+			for k, v := range fields {
+				if _, ok := doc[k]; ok && reservedFields[k] {
+					logrus.Debugf("Skip reserved field %s parsed by %s", k, s.flag)
+					continue
+				}
+				doc[k] = v
+			}
+			continue
+		}
+		doc[s.target] = fields
+	}
+}
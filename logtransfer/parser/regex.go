@@ -0,0 +1,164 @@
+package parser
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// grok模式的最大嵌套层数
+const grokMaxDepth = 32
+
+// grok模式的引用, 例如%{IP:client}、%{NUMBER:bytes:int}
+var grokRef = regexp.MustCompile(`%\{(\w+)(?::([^:}]+))?(?::(int|float))?\}`)
+
+var errNotMatch = errors.New("not match")
+
+// regexParser 使用正则的命名分组解析, 例如`(?P<level>\w+) (?P<body>.*)`
+type regexParser struct {
+	re *regexp.Regexp
+}
+
+func newRegexParser(pattern string) (*regexParser, error) {
+	if pattern == "" {
+		return nil, errors.New("regex pattern is empty")
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+	named := false
+	for _, name := range re.SubexpNames() {
+		if name != "" {
+			named = true
+			break
+		}
+	}
+	if !named {
+		return nil, fmt.Errorf("regex %s has no named group", pattern)
+	}
+	return &regexParser{re: re}, nil
+}
+
+func (p *regexParser) parse(text string) (map[string]interface{}, error) {
+	m := p.re.FindStringSubmatch(text)
+	if m == nil {
+		return nil, errNotMatch
+	}
+	fields := map[string]interface{}{}
+	for i, name := range p.re.SubexpNames() {
+		if name == "" || m[i] == "" {
+			continue
+		}
+		fields[name] = m[i]
+	}
+	return fields, nil
+}
+
+// grokCapture grok模式中需要保存的字段
+type grokCapture struct {
+	group string // 正则的分组名称
+	index int    // 正则的分组序号
+	field string // 字段名称
+	typ   string // 类型转换: int, float, 为空时为字符串
+}
+
+// grokParser grok模式解析, 模式会被展开为正则
+type grokParser struct {
+	re       *regexp.Regexp
+	captures []grokCapture
+}
+
+func newGrokParser(pattern string, custom map[string]string) (*grokParser, error) {
+	if pattern == "" {
+		return nil, errors.New("grok pattern is empty")
+	}
+	p := &grokParser{}
+	expanded, err := p.expand(pattern, custom, 0)
+	if err != nil {
+		return nil, err
+	}
+	re, err := regexp.Compile(expanded)
+	if err != nil {
+		return nil, fmt.Errorf("compile grok %s error: %v", pattern, err)
+	}
+	if len(p.captures) == 0 {
+		return nil, fmt.Errorf("grok %s has no field", pattern)
+	}
+	for i := range p.captures {
+		p.captures[i].index = re.SubexpIndex(p.captures[i].group)
+	}
+	p.re = re
+	return p, nil
+}
+
+// expand 展开grok模式中的引用, 自定义模式优先于内置模式
+func (p *grokParser) expand(pattern string, custom map[string]string, depth int) (string, error) {
+	if depth > grokMaxDepth {
+		return "", errors.New("grok patterns nested too deep")
+	}
+
+	var err error
+	expanded := grokRef.ReplaceAllStringFunc(pattern, func(ref string) string {
+		if err != nil {
+			return ""
+		}
+		m := grokRef.FindStringSubmatch(ref)
+		name, field, typ := m[1], m[2], m[3]
+
+		sub, ok := custom[name]
+		if !ok {
+			sub, ok = grokPatterns[name]
+		}
+		if !ok {
+			err = fmt.Errorf("grok pattern %s not found", name)
+			return ""
+		}
+		// 先记录外层的字段, 保证分组的序号和字段的顺序一致
+		group := ""
+		if field != "" {
+			group = "g" + strconv.Itoa(len(p.captures))
+			p.captures = append(p.captures, grokCapture{group: group, field: field, typ: typ})
+		}
+		sub, err = p.expand(sub, custom, depth+1)
+		if err != nil {
+			return ""
+		}
+		if group == "" {
+			return "(?:" + sub + ")"
+		}
+		return "(?P<" + group + ">" + sub + ")"
+	})
+	return expanded, err
+}
+
+func (p *grokParser) parse(text string) (map[string]interface{}, error) {
+	m := p.re.FindStringSubmatch(text)
+	if m == nil {
+		return nil, errNotMatch
+	}
+
+	fields := map[string]interface{}{}
+	for _, c := range p.captures {
+		value := m[c.index]
+		if value == "" {
+			continue
+		}
+		switch c.typ {
+		case "int":
+			if n, err := strconv.ParseInt(strings.TrimSpace(value), 10, 64); err == nil {
+				fields[c.field] = n
+				continue
+			}
+		case "float":
+			if f, err := strconv.ParseFloat(strings.TrimSpace(value), 64); err == nil {
+				fields[c.field] = f
+				continue
+			}
+		}
+		fields[c.field] = value
+	}
+	return fields, nil
+}
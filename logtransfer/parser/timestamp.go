@@ -0,0 +1,190 @@
+package parser
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+)
+
+// TimestampField 事件时间的字段, 精确到毫秒
+const TimestampField = "@timestamp"
+
+// 事件时间的格式
+const timestampLayout = "2006-01-02T15:04:05.000Z07:00"
+
+// 提取失败时使用的时间
+const (
+	FallbackReadTime = "readtime" // logagent的读取时间, 没有时为当前时间
+	FallbackNow      = "now"      // 当前时间
+)
+
+// 特殊的时间格式, 其他格式使用go的时间格式
+const (
+	layoutUnix   = "UNIX"    // 秒级时间戳
+	layoutUnixMs = "UNIX_MS" // 毫秒级时间戳
+)
+
+// 没有配置时间格式时依次尝试的格式
+var defaultLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02 15:04:05.999999999",
+	"2006-01-02 15:04:05,999999999",
+	"02/Jan/2006:15:04:05 -0700",
+	"2006/01/02 15:04:05",
+	time.Stamp,
+}
+
+// 具名的时间格式
+var namedLayouts = map[string]string{
+	"RFC3339":     time.RFC3339,
+	"RFC3339Nano": time.RFC3339Nano,
+	"RFC1123":     time.RFC1123,
+	"RFC1123Z":    time.RFC1123Z,
+	"ANSIC":       time.ANSIC,
+	"Stamp":       time.Stamp,
+	"StampMilli":  time.StampMilli,
+}
+
+// 事件时间的配置
+type TimestampConf struct {
+	Field    string   // 时间所在的字段, 为空时直接使用fallback
+	Layouts  []string // 时间格式, 按顺序尝试
+	Timezone string   // 时间中没有时区时使用的时区, 为空时为本地时区
+	Fallback string   // 提取失败时使用的时间: readtime, now
+}
+
+// Timestamp 从文档中提取事件时间
+type Timestamp struct {
+	field    string
+	layouts  []string
+	loc      *time.Location
+	fallback string
+}
+
+// NewTimestamp 初始化
+func NewTimestamp(c TimestampConf) (*Timestamp, error) {
+	ts := &Timestamp{
+		field:    c.Field,
+		layouts:  defaultLayouts,
+		loc:      time.Local,
+		fallback: c.Fallback,
+	}
+
+	if len(c.Layouts) > 0 {
+		ts.layouts = []string{}
+		for _, layout := range c.Layouts {
+			if named, ok := namedLayouts[layout]; ok {
+				layout = named
+			}
+			ts.layouts = append(ts.layouts, layout)
+		}
+	}
+	if c.Timezone != "" {
+		loc, err := time.LoadLocation(c.Timezone)
+		if err != nil {
+			return nil, err
+		}
+		ts.loc = loc
+	}
+	switch c.Fallback {
+	case "":
+		ts.fallback = FallbackReadTime
+	case FallbackReadTime, FallbackNow:
+	default:
+		return nil, fmt.Errorf("wrong timestamp fallback: %s", c.Fallback)
+	}
+	return ts, nil
+}
+
+// Extract 提取事件时间, 写入@timestamp
+// 提取失败时使用fallback的时间, 并且在parse_error中记录错误
+// 没有配置字段并且文档中已经有合法的@timestamp时(比如json日志中解析出的@timestamp)保留原来的值
+func (ts *Timestamp) Extract(doc map[string]interface{}) {
+	if ts.field == "" {
+		if s, ok := doc[TimestampField].(string); ok {
+			if _, err := time.Parse(time.RFC3339Nano, s); err == nil {
+				return
+			}
+		}
+	}
+	if ts.field != "" {
+		if v, ok := doc[ts.field]; ok {
+			t, err := ts.parse(v)
+			if err == nil {
+				doc[TimestampField] = t.Format(timestampLayout)
+				return
+			}
+			if _, ok := doc[ErrorField]; !ok {
+				doc[ErrorField] = fmt.Sprintf("timestamp: %v", err)
+			}
+		}
+	}
+	doc[TimestampField] = ts.fallbackTime(doc).Format(timestampLayout)
+}
+
+// parse 按顺序尝试各个格式
+func (ts *Timestamp) parse(v interface{}) (time.Time, error) {
+	var s string
+	switch value := v.(type) {
+	case string:
+		s = value
+	case float64:
+		s = strconv.FormatFloat(value, 'f', -1, 64)
+	case int64:
+		s = strconv.FormatInt(value, 10)
+	case json.Number:
+		s = value.String()
+	default:
+		return time.Time{}, fmt.Errorf("wrong value type %T", v)
+	}
+
+	for _, layout := range ts.layouts {
+		switch layout {
+		case layoutUnix, layoutUnixMs:
+			f, err := strconv.ParseFloat(s, 64)
+			if err != nil {
+				continue
+			}
+			// 只需要精确到毫秒, 先取整避免浮点数误差
+			ms := f
+			if layout == layoutUnix {
+				ms = f * 1e3
+			}
+			return time.Unix(0, int64(math.Round(ms))*int64(time.Millisecond)).In(ts.loc), nil
+		default:
+			t, err := time.ParseInLocation(layout, s, ts.loc)
+			if err != nil {
+				continue
+			}
+			return withYear(t, ts.loc), nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("%q not match layouts", s)
+}
+
+// withYear syslog等格式没有年份, 使用当前年份, 结果晚于当前时间一天以上时使用上一年
+func withYear(t time.Time, loc *time.Location) time.Time {
+	if t.Year() != 0 {
+		return t
+	}
+	now := time.Now().In(loc)
+	t = t.AddDate(now.Year(), 0, 0)
+	if t.After(now.Add(24 * time.Hour)) {
+		t = t.AddDate(-1, 0, 0)
+	}
+	return t
+}
+
+// fallbackTime 提取失败时使用的时间
+func (ts *Timestamp) fallbackTime(doc map[string]interface{}) time.Time {
+	if ts.fallback == FallbackReadTime {
+		if s, ok := doc["readtime"].(string); ok {
+			if t, err := time.Parse(time.RFC3339Nano, s); err == nil {
+				return t
+			}
+		}
+	}
+	return time.Now()
+}
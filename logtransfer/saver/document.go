@@ -0,0 +1,99 @@
+package saver
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+)
+
+// Envelope logagent发送的json信封, 根据`@logagent`字段识别
+type Envelope struct {
+	Version   int               `json:"@logagent"`
+	Name      string            `json:"name"`
+	HostName  string            `json:"hostname"`
+	Ip        string            `json:"ip"`
+	Node      string            `json:"node"`
+	Path      string            `json:"path"`
+	Offset    int64             `json:"offset"`
+	Line      int64             `json:"line"`
+	Timestamp string            `json:"timestamp"`
+	Fields    map[string]string `json:"fields"`
+	Message   string            `json:"message"`
+}
+
+// parseEnvelope 解析信封, 不是信封格式时返回nil
+func parseEnvelope(content string) *Envelope {
+	if !strings.HasPrefix(content, "{") || !strings.Contains(content, `"@logagent"`) {
+		return nil
+	}
+	env := &Envelope{}
+	if err := json.Unmarshal([]byte(content), env); err != nil || env.Version == 0 {
+		return nil
+	}
+	return env
+}
+
+// Document 存储的文档
+type Document map[string]interface{}
+
+// IngestField 精确到毫秒的存储时间
+const IngestField = "ingest_time"
+
+// NewDocument 生成存储的文档, 信封中的来源信息作为文档的字段
+// 消息去掉换行符后为空时返回nil
+func NewDocument(content string) Document {
+	content = trimContent(content)
+	if content == "" {
+		return nil
+	}
+	// time为秒级的存储时间, 解析出的同名字段会覆盖它, 精确的存储时间由SetIngestTime写入
+	// 事件时间由解析阶段写入@timestamp
+	doc := Document{
+		"time": time.Now().Unix(),
+		"msg":  content,
+	}
+
+	env := parseEnvelope(content)
+	if env == nil {
+		return doc
+	}
+	doc["msg"] = env.Message
+	doc["name"] = env.Name
+	doc["hostname"] = env.HostName
+	doc["ip"] = env.Ip
+	if env.Node != "" {
+		doc["node"] = env.Node
+	}
+	doc["path"] = env.Path
+	doc["offset"] = env.Offset
+	doc["line"] = env.Line
+	doc["readtime"] = env.Timestamp
+	if len(env.Fields) > 0 {
+		doc["fields"] = env.Fields
+	}
+	return doc
+}
+
+// SetIngestTime 写入存储时间, 在解析和提取事件时间之后调用, 解析出的字段不会覆盖存储时间
+func SetIngestTime(doc Document) {
+	doc[IngestField] = time.Now().UnixNano() / int64(time.Millisecond)
+}
+
+// documentTime 文档的时间, 优先使用事件时间@timestamp, 其次是日志的读取时间, 都没有时使用当前时间
+func documentTime(doc Document) time.Time {
+	for _, field := range []string{"@timestamp", "readtime"} {
+		if s, ok := doc[field].(string); ok {
+			if t, err := time.Parse(time.RFC3339Nano, s); err == nil {
+				return t
+			}
+		}
+	}
+	return time.Now()
+}
+
+// trimContent 去掉消息末尾的换行符
+func trimContent(content string) string {
+	content = strings.TrimSuffix(content, "\n")
+	content = strings.TrimSuffix(content, "\r")
+	return content
+}
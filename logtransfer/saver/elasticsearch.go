@@ -3,73 +3,272 @@ package saver
 import (
 	"context"
 	"encoding/json"
-	"strings"
+	"fmt"
+	"sync"
 	"time"
 
 	"github.com/olivere/elastic/v7"
 	"github.com/sirupsen/logrus"
 )
 
-type ElasticMessage struct {
-	Time int64  `json:"time"`
-	Msg  string `json:"msg"`
+// 批量写入的默认配置
+const (
+	defaultBulkActions  = 500
+	defaultBulkSize     = 5 * 1024 * 1024
+	defaultBulkInterval = time.Second
+)
+
+// 写入失败后的重试间隔
+const (
+	retryBackoffMin = 100 * time.Millisecond
+	retryBackoffMax = 30 * time.Second
+)
+
+// bulkItem 等待批量写入的文档
+type bulkItem struct {
+	index    string
+	body     json.RawMessage
+	callback Callback
 }
 
 type ElasticSaver struct {
+	lk     sync.RWMutex // 保护client和bulk
 	client *elastic.Client
 	hosts  []string
+	bulk   BulkConf
+
+	items  chan *bulkItem
+	ctx    context.Context
+	cancel context.CancelFunc
+	done   chan struct{} // 写入协程退出后关闭
+
+	stateLk     sync.Mutex // 保护unreachable和lastErr
+	unreachable bool       // 最近一次批量写入是否失败
+	lastErr     string     // 最近一次批量写入的错误
 }
 
 // newLeasticsearch
-func newElasticsearch(urls ...string) (*ElasticSaver, error) {
+func newElasticsearch(config SaverConf) (*ElasticSaver, error) {
 	client, err := elastic.NewClient(
-		elastic.SetURL(urls...),
+		elastic.SetURL(config.Hosts...),
 		elastic.SetSniff(false),
 	)
 	if err != nil {
 		return nil, err
 	}
 
-	return &ElasticSaver{
+	es := &ElasticSaver{
 		client: client,
-		hosts:  urls,
-	}, nil
+		hosts:  config.Hosts,
+		bulk:   bulkConfWithDefault(config.Bulk),
+		items:  make(chan *bulkItem),
+		done:   make(chan struct{}),
+	}
+	es.ctx, es.cancel = context.WithCancel(context.Background())
+	go es.work()
+
+	return es, nil
 }
 
-// insert 插入数据
-func (es *ElasticSaver) insert(index string, content string) error {
-	if content == "" {
-		logrus.Warn("es: Insert invalid message")
-		return nil
+// bulkConfWithDefault 填充默认配置
+func bulkConfWithDefault(bulk BulkConf) BulkConf {
+	if bulk.Actions <= 0 {
+		bulk.Actions = defaultBulkActions
+	}
+	if bulk.Size <= 0 {
+		bulk.Size = defaultBulkSize
+	}
+	if bulk.Interval <= 0 {
+		bulk.Interval = defaultBulkInterval
 	}
-	if strings.HasSuffix(content, "\r") {
-		content = strings.TrimSuffix(content, "\r")
+	return bulk
+}
+
+// insert 插入数据, 数据会先缓存起来批量写入
+// 批量请求中的每个文档使用各自的索引
+func (es *ElasticSaver) insert(index string, doc Document, callback Callback) error {
+	b, err := json.Marshal(doc)
+	if err != nil {
+		return err
 	}
-	if strings.HasSuffix(content, "\r\n") {
-		content = strings.TrimSuffix(content, "\r\b")
+
+	item := &bulkItem{
+		index:    index,
+		body:     b,
+		callback: callback,
 	}
-	if strings.HasSuffix(content, "\n") {
-		content = strings.TrimSuffix(content, "\n")
+	select {
+	case <-es.ctx.Done():
+		return ErrClosed
+	case es.items <- item:
+		return nil
 	}
-	esMsg := ElasticMessage{
-		Time: time.Now().Unix(),
-		Msg:  content,
+}
+
+// work 缓存文档, 达到数量、大小或者时间间隔后批量写入
+func (es *ElasticSaver) work() {
+	defer close(es.done)
+
+	es.lk.RLock()
+	interval := es.bulk.Interval
+	es.lk.RUnlock()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var batch []*bulkItem
+	var size int
+	for {
+		select {
+		case <-es.ctx.Done():
+			es.abort(batch)
+			return
+		case item := <-es.items:
+			batch = append(batch, item)
+			size += len(item.body)
+			es.lk.RLock()
+			full := len(batch) >= es.bulk.Actions || size >= es.bulk.Size
+			es.lk.RUnlock()
+			if !full {
+				continue
+			}
+		case <-ticker.C:
+			if len(batch) == 0 {
+				continue
+			}
+		}
+
+		if !es.flush(batch) {
+			return
+		}
+		batch = nil
+		size = 0
+
+		// 配置可能已经更新
+		es.lk.RLock()
+		if es.bulk.Interval != interval {
+			interval = es.bulk.Interval
+			ticker.Reset(interval)
+		}
+		es.lk.RUnlock()
 	}
-	b, err := json.Marshal(esMsg)
+}
+
+// flush 批量写入, 写入失败的文档按照退避时间重试, 直到全部写入或者存储器被关闭
+// 文档本身的错误(比如mapping冲突)不会重试, 通过callback通知调用方
+func (es *ElasticSaver) flush(batch []*bulkItem) bool {
+	backoff := retryBackoffMin
+	for len(batch) > 0 {
+		retry, err := es.doBulk(batch)
+		es.setError(err)
+		if err == nil && len(retry) == 0 {
+			return true
+		}
+		if err != nil {
+			logrus.Errorf("es bulk %d documents error: %v, retry after %v", len(batch), err, backoff)
+		} else {
+			logrus.Warnf("es bulk %d/%d documents rejected, retry after %v", len(retry), len(batch), backoff)
+			batch = retry
+		}
+
+		select {
+		case <-es.ctx.Done():
+			es.abort(batch)
+			return false
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if backoff > retryBackoffMax {
+			backoff = retryBackoffMax
+		}
+	}
+	return true
+}
+
+// doBulk 执行一次批量写入, 返回需要重试的文档
+// 返回错误说明整个请求失败, 全部文档都需要重试
+func (es *ElasticSaver) doBulk(batch []*bulkItem) ([]*bulkItem, error) {
+	es.lk.RLock()
+	client := es.client
+	es.lk.RUnlock()
+
+	bulk := client.Bulk()
+	for _, item := range batch {
+		bulk.Add(elastic.NewBulkIndexRequest().Index(item.index).Doc(item.body))
+	}
+	resp, err := bulk.Do(es.ctx)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	if len(resp.Items) != len(batch) {
+		return nil, fmt.Errorf("bulk response items %d not match requests %d", len(resp.Items), len(batch))
 	}
-	_, err = es.client.Index().Index(index).BodyJson(string(b)).Do(context.Background())
+
+	var retry []*bulkItem
+	for i, item := range batch {
+		result := resp.Items[i]["index"]
+		switch {
+		case result == nil:
+			retry = append(retry, item)
+		case result.Status >= 200 && result.Status < 300:
+			item.callback(nil)
+		case isRetryStatus(result.Status):
+			retry = append(retry, item)
+		default:
+			item.callback(bulkItemError(result))
+		}
+	}
+	return retry, nil
+}
+
+// setError 记录批量写入的结果, err为nil时保留最近一次错误
+func (es *ElasticSaver) setError(err error) {
+	es.stateLk.Lock()
+	defer es.stateLk.Unlock()
+	es.unreachable = err != nil
 	if err != nil {
-		return err
+		es.lastErr = err.Error()
 	}
+}
 
-	return nil
+// status 存储器的状态
+func (es *ElasticSaver) status() Status {
+	es.stateLk.Lock()
+	defer es.stateLk.Unlock()
+	return Status{Reachable: !es.unreachable, LastError: es.lastErr}
+}
+
+// isRetryStatus 可以重试的状态码, 429表示es负载过高
+func isRetryStatus(status int) bool {
+	switch status {
+	case 429, 502, 503, 504:
+		return true
+	}
+	return false
+}
+
+// bulkItemError 单个文档的写入错误
+func bulkItemError(result *elastic.BulkResponseItem) error {
+	if result.Error == nil {
+		return fmt.Errorf("es index %s status %d", result.Index, result.Status)
+	}
+	return fmt.Errorf("es index %s status %d: %s: %s", result.Index, result.Status, result.Error.Type, result.Error.Reason)
+}
+
+// abort 存储器关闭时通知还没有写入的文档
+func (es *ElasticSaver) abort(batch []*bulkItem) {
+	for _, item := range batch {
+		item.callback(ErrClosed)
+	}
 }
 
 // update 更新连接
-func (es *ElasticSaver) update(urls ...string) error {
+func (es *ElasticSaver) update(config SaverConf) error {
+	es.lk.Lock()
+	es.bulk = bulkConfWithDefault(config.Bulk)
+	es.lk.Unlock()
+
 	// 检查配置是否有变化
+	urls := config.Hosts
 	if len(urls) == len(es.hosts) {
 		m := map[string]bool{}
 		for _, url := range urls {
@@ -97,11 +296,17 @@ func (es *ElasticSaver) update(urls ...string) error {
 	if err != nil {
 		return err
 	}
+	es.lk.Lock()
 	es.hosts = urls
 	es.client = client
+	es.lk.Unlock()
 	return nil
 }
 
-// close 释放资源
+// close 释放资源, 还没有写入的文档通过callback返回ErrClosed
 func (es *ElasticSaver) close() {
+	if es.cancel != nil {
+		es.cancel()
+	}
+	<-es.done
 }
@@ -0,0 +1,222 @@
+package saver
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// 索引名称中的变量
+const (
+	indexTitle = "title"  // 管道名称
+	indexField = "field:" // 文档字段, 先查找fields, 再查找文档本身的字段
+)
+
+// 字段不存在时使用的值
+const indexUnknown = "unknown"
+
+// 缓存的索引名称数量, 超过后清空
+const indexCacheSize = 1024
+
+// es索引名称的最大字节数
+const indexMaxBytes = 255
+
+// indexSegment 索引模板的片段, 常量、管道名称、字段或者日期
+type indexSegment struct {
+	text  string // 常量或者日期格式
+	field string // 字段名称
+	date  bool
+}
+
+// indexPattern 索引模板, 例如`logs-{title}-{yyyy.MM.dd}`、`{field:service}-{yyyy.ww}`
+// 日期使用文档的时间, 按照UTC计算
+type indexPattern struct {
+	pattern  string
+	segments []indexSegment
+
+	lk    sync.Mutex
+	cache map[string]string // 解析结果 -> 合法的索引名称
+}
+
+// newIndexPattern 解析索引模板, 模板为空时使用管道名称
+func newIndexPattern(pattern, title string) (*indexPattern, error) {
+	if pattern == "" {
+		pattern = "{" + indexTitle + "}"
+	}
+
+	ip := &indexPattern{
+		pattern: pattern,
+		cache:   map[string]string{},
+	}
+	rest := pattern
+	for rest != "" {
+		start := strings.Index(rest, "{")
+		if start < 0 {
+			ip.segments = append(ip.segments, indexSegment{text: rest})
+			break
+		}
+		end := strings.Index(rest[start:], "}")
+		if end < 0 {
+			return nil, fmt.Errorf("Wrong index pattern %s: unclosed {", pattern)
+		}
+		end += start
+		if start > 0 {
+			ip.segments = append(ip.segments, indexSegment{text: rest[:start]})
+		}
+
+		name := rest[start+1 : end]
+		switch {
+		case name == indexTitle:
+			ip.segments = append(ip.segments, indexSegment{text: title})
+		case strings.HasPrefix(name, indexField):
+			field := strings.TrimPrefix(name, indexField)
+			if field == "" {
+				return nil, fmt.Errorf("Wrong index pattern %s: empty field", pattern)
+			}
+			ip.segments = append(ip.segments, indexSegment{field: field})
+		case isDateFormat(name):
+			ip.segments = append(ip.segments, indexSegment{text: name, date: true})
+		default:
+			return nil, fmt.Errorf("Wrong index pattern %s: unknown variable {%s}", pattern, name)
+		}
+		rest = rest[end+1:]
+	}
+	return ip, nil
+}
+
+// resolve 根据文档生成索引名称
+func (ip *indexPattern) resolve(doc Document) string {
+	var t time.Time
+	var b strings.Builder
+	for _, seg := range ip.segments {
+		switch {
+		case seg.date:
+			if t.IsZero() {
+				t = documentTime(doc).UTC()
+			}
+			b.WriteString(formatDate(seg.text, t))
+		case seg.field != "":
+			b.WriteString(documentField(doc, seg.field))
+		default:
+			b.WriteString(seg.text)
+		}
+	}
+	return ip.sanitize(b.String())
+}
+
+// sanitize 转换为es合法的索引名称, 结果会被缓存
+func (ip *indexPattern) sanitize(name string) string {
+	ip.lk.Lock()
+	defer ip.lk.Unlock()
+	if index, ok := ip.cache[name]; ok {
+		return index
+	}
+
+	index := strings.Map(func(r rune) rune {
+		switch r {
+		case '\\', '/', '*', '?', '"', '<', '>', '|', ' ', ',', '#', ':':
+			return '_'
+		}
+		return r
+	}, strings.ToLower(name))
+	index = strings.TrimLeft(index, "-_+")
+	// 超过最大字节数时截断, 不截断多字节字符
+	if len(index) > indexMaxBytes {
+		n := indexMaxBytes
+		for n > 0 && !utf8.RuneStart(index[n]) {
+			n--
+		}
+		index = index[:n]
+	}
+	if index == "" || index == "." || index == ".." {
+		index = indexUnknown
+	}
+
+	if len(ip.cache) >= indexCacheSize {
+		ip.cache = map[string]string{}
+	}
+	ip.cache[name] = index
+	return index
+}
+
+// documentField 文档的字段, 先查找fields, 再查找文档本身的字段
+func documentField(doc Document, name string) string {
+	if fields, ok := doc["fields"].(map[string]string); ok {
+		if v := fields[name]; v != "" {
+			return v
+		}
+	}
+	if v, ok := doc[name]; ok {
+		if s := fmt.Sprint(v); s != "" {
+			return s
+		}
+	}
+	return indexUnknown
+}
+
+// isDateFormat 是否是日期格式, 支持yyyy、yy、MM、dd、HH、ww(ISO周)
+func isDateFormat(format string) bool {
+	hasDate := false
+	for i := 0; i < len(format); {
+		n := dateToken(format[i:])
+		if n > 0 {
+			hasDate = true
+			i += n
+			continue
+		}
+		switch format[i] {
+		case '.', '-', '_':
+			i++
+		default:
+			return false
+		}
+	}
+	return hasDate
+}
+
+// dateToken 日期格式开头的占位符长度, 不是占位符时返回0
+func dateToken(format string) int {
+	for _, token := range []string{"yyyy", "yy", "MM", "dd", "HH", "ww"} {
+		if strings.HasPrefix(format, token) {
+			return len(token)
+		}
+	}
+	return 0
+}
+
+// formatDate 格式化日期, 包含ww时年份使用ISO周所在的年份
+func formatDate(format string, t time.Time) string {
+	year := t.Year()
+	isoYear, week := t.ISOWeek()
+	if strings.Contains(format, "ww") {
+		year = isoYear
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(format); {
+		n := dateToken(format[i:])
+		if n == 0 {
+			b.WriteByte(format[i])
+			i++
+			continue
+		}
+		switch format[i : i+n] {
+		case "yyyy":
+			fmt.Fprintf(&b, "%04d", year)
+		case "yy":
+			fmt.Fprintf(&b, "%02d", year%100)
+		case "MM":
+			fmt.Fprintf(&b, "%02d", int(t.Month()))
+		case "dd":
+			fmt.Fprintf(&b, "%02d", t.Day())
+		case "HH":
+			fmt.Fprintf(&b, "%02d", t.Hour())
+		case "ww":
+			fmt.Fprintf(&b, "%02d", week)
+		}
+		i += n
+	}
+	return b.String()
+}
@@ -0,0 +1,52 @@
+package saver
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestIndexPattern(t *testing.T) {
+	cases := []struct {
+		pattern string
+		doc     Document
+		want    string
+	}{
+		{"", Document{}, "log"},
+		{"logs-{title}-{yyyy.MM.dd}", Document{"@timestamp": "2021-04-19T10:00:00Z"}, "logs-log-2021.04.19"},
+		// 按照UTC计算日期
+		{"{yyyy.MM.dd}", Document{"@timestamp": "2021-01-01T07:00:00+08:00"}, "2020.12.31"},
+		// 没有事件时间时使用读取时间
+		{"{yyyy.MM}", Document{"readtime": "2021-04-19T10:00:00Z"}, "2021.04"},
+		// ISO周所在的年份和日历年份不同
+		{"{yyyy.ww}", Document{"@timestamp": "2021-01-01T00:00:00Z"}, "2020.53"},
+		{"{yyyy.ww}", Document{"@timestamp": "2024-12-30T00:00:00Z"}, "2025.01"},
+		{"{yyyy.ww}", Document{"@timestamp": "2021-01-04T00:00:00Z"}, "2021.01"},
+		// 先查找fields, 再查找文档本身的字段
+		{"{field:service}", Document{"fields": map[string]string{"service": "api"}, "service": "web"}, "api"},
+		{"{field:service}", Document{"fields": map[string]string{"env": "prod"}, "service": "web"}, "web"},
+		{"{field:status}", Document{"status": int64(200)}, "200"},
+		// 字段不存在或者为空时使用unknown
+		{"{field:service}-{title}", Document{}, "unknown-log"},
+		{"{field:service}", Document{"fields": map[string]string{"service": ""}, "service": ""}, "unknown"},
+		// 转换为合法的索引名称
+		{"{field:service}", Document{"service": "_My App/V1"}, "my_app_v1"},
+		// 超过255字节时截断, 不截断多字节字符
+		{"{field:service}", Document{"service": strings.Repeat("a", 300)}, strings.Repeat("a", 255)},
+		{"{field:service}", Document{"service": "a" + strings.Repeat("中", 100)}, "a" + strings.Repeat("中", 84)},
+	}
+	for _, c := range cases {
+		ip, err := newIndexPattern(c.pattern, "log")
+		if err != nil {
+			t.Fatalf("pattern %s: %v", c.pattern, err)
+		}
+		if got := ip.resolve(c.doc); got != c.want {
+			t.Errorf("pattern %s, doc %v: got %s, want %s", c.pattern, c.doc, got, c.want)
+		}
+	}
+
+	for _, pattern := range []string{"logs-{yyyy", "{field:}", "{unknown}", "{yyyy/MM}"} {
+		if _, err := newIndexPattern(pattern, "log"); err == nil {
+			t.Errorf("pattern %s should fail", pattern)
+		}
+	}
+}
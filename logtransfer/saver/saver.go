@@ -3,18 +3,36 @@ package saver
 import (
 	"errors"
 	"fmt"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
 )
 
+// ErrClosed 存储器已经关闭, 消息没有被存储
+var ErrClosed = errors.New("saver has closed")
+
+// Callback 消息的存储结果, err为nil表示消息已经被持久化
+type Callback func(err error)
+
 // 存储器的客户端接口
 type dbclt interface {
-	insert(index string, content string) error
-	update(hosts ...string) error
+	insert(index string, doc Document, callback Callback) error
+	update(config SaverConf) error
+	status() Status
 	close()
 }
 
+// Status 存储器的状态
+type Status struct {
+	Reachable bool   `json:"reachable"`  // 最近一次批量写入是否成功, 失败时说明存储设备不可用
+	LastError string `json:"last_error"` // 最近一次批量写入的错误
+}
+
 // 存储器
 type Saver struct {
-	index string
+	lk    sync.RWMutex // 保护index
+	index *indexPattern
 	hosts []string
 	clt   dbclt
 }
@@ -22,11 +40,20 @@ type Saver struct {
 // 存储器的类型
 type FLAG int
 
+// 批量写入的配置
+type BulkConf struct {
+	Actions  int           // 达到该文档数量时写入
+	Size     int           // 达到该字节数时写入
+	Interval time.Duration // 距离上次写入超过该时间时写入
+}
+
 // 存储器配置
 type SaverConf struct {
 	Flag  FLAG
-	Index string
+	Title string // 管道名称
+	Index string // 索引模板, 为空时使用管道名称
 	Hosts []string
+	Bulk  BulkConf
 }
 
 // 指定支持的存储器类型
@@ -36,12 +63,16 @@ const (
 
 // NewSaver 初始化存储器
 func NewSaver(configs SaverConf) (*Saver, error) {
+	index, err := newIndexPattern(configs.Index, configs.Title)
+	if err != nil {
+		return nil, err
+	}
+
 	var clt dbclt
-	var err error
 
 	switch configs.Flag {
 	case ElasticSearch:
-		clt, err = newElasticsearch(configs.Hosts...)
+		clt, err = newElasticsearch(configs)
 	default:
 		err = fmt.Errorf("wrong saver flag: %d", configs.Flag)
 	}
@@ -51,29 +82,55 @@ func NewSaver(configs SaverConf) (*Saver, error) {
 	}
 
 	return &Saver{
-		index: configs.Index,
+		index: index,
 		hosts: configs.Hosts,
 		clt:   clt,
 	}, nil
 }
 
-// Insert 插入资源
-func (s *Saver) Insert(content string) error {
-	if s.clt != nil {
-		return s.clt.insert(s.index, content)
+// Insert 插入文档, 文档被持久化或者确定无法存储时调用callback
+// 返回错误说明文档没有被接收, callback不会被调用
+func (s *Saver) Insert(doc Document, callback Callback) error {
+	if s.clt == nil {
+		return errors.New("insert() not implemented")
+	}
+	if len(doc) == 0 {
+		logrus.Warn("saver: Insert invalid document")
+		callback(nil)
+		return nil
 	}
 
-	return errors.New("insert() not implemented")
+	// 索引名称根据文档生成
+	s.lk.RLock()
+	index := s.index.resolve(doc)
+	s.lk.RUnlock()
+	return s.clt.insert(index, doc, callback)
 }
 
 // Update 更新资源
 func (s *Saver) Update(config SaverConf) error {
+	index, err := newIndexPattern(config.Index, config.Title)
+	if err != nil {
+		return err
+	}
+	s.lk.Lock()
+	s.index = index
+	s.lk.Unlock()
+
 	if s.clt != nil {
-		return s.clt.update(config.Hosts...)
+		return s.clt.update(config)
 	}
 	return nil
 }
 
+// Status 存储器的状态
+func (s *Saver) Status() Status {
+	if s.clt == nil {
+		return Status{}
+	}
+	return s.clt.status()
+}
+
 // Close 释放资源
 func (s *Saver) Close() {
 	if s.clt != nil {
@@ -2,60 +2,215 @@ package services
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"logtransfer/conf"
+	"logtransfer/deadletter"
+	"logtransfer/metrics"
 	"logtransfer/mq"
+	"logtransfer/parser"
 	"logtransfer/saver"
+	"sort"
+	"sync"
 	"time"
 
 	"github.com/sirupsen/logrus"
 )
 
 type manager struct {
-	topic    string
-	consumer *mq.MessageQueue
-	saver    *saver.Saver
-	cancel   context.CancelFunc
+	topic      string
+	consumer   *mq.MessageQueue
+	lk         sync.RWMutex // 保护parser和timestamp
+	parser     *parser.Parser
+	timestamp  *parser.Timestamp
+	saver      *saver.Saver
+	deadLetter *deadletter.DeadLetter
+	cancel     context.CancelFunc
+	done       chan struct{} // 消费协程退出后关闭
+	closing    chan struct{} // 开始关闭时关闭, 停止重试写入死信
+	info       conf.EtcdInfo // 当前的配置
 }
 
-var logManagers map[string]*manager
+// 死信写入失败后的重试间隔
+const (
+	deadLetterBackoffMin = 100 * time.Millisecond
+	deadLetterBackoffMax = 30 * time.Second
+)
+
+// 管道的状态
+const (
+	StateRunning      = "running"      // 正常消费和存储
+	StateDisconnected = "disconnected" // 没有加入消费者组, 正在重试
+	StateUnreachable  = "unreachable"  // 存储设备不可用, 正在重试
+	StateFailed       = "failed"       // 创建或者更新失败, 没有消费
+	StatePaused       = "paused"       // 通过管理接口暂停消费
+)
+
+// ErrManagerNotFound 管道不存在
+var ErrManagerNotFound = errors.New("manager not found")
+
+// ManagerStatus 管道的状态
+type ManagerStatus struct {
+	Title     string       `json:"title"`
+	State     string       `json:"state"`
+	Consumer  mq.Status    `json:"consumer"`
+	Saver     saver.Status `json:"saver"`
+	LastError string       `json:"last_error"`
+}
+
+// ManagerInfo 管道的配置和状态
+type ManagerInfo struct {
+	Config conf.EtcdInfo `json:"config"`
+	Status ManagerStatus `json:"status"`
+}
+
+var (
+	managersLk     sync.RWMutex // 保护logManagers和failedManagers, 状态查询和配置更新在不同的协程中
+	logManagers    map[string]*manager
+	failedManagers = map[string]ManagerStatus{} // 创建或者更新失败的管道
+)
 
-func newManager(title string, dbhosts []string, mqhosts []string) (*manager, error) {
-	if title == "" || len(dbhosts) == 0 || len(mqhosts) == 0 {
-		return nil, fmt.Errorf("Wrong parameters: title %s, dbhosts %v, mqhosts %v", title, dbhosts, mqhosts)
+func newManager(eInfo conf.EtcdInfo) (*manager, error) {
+	if eInfo.Title == "" || len(eInfo.DbHosts) == 0 || len(eInfo.MqHosts) == 0 {
+		return nil, fmt.Errorf("Wrong parameters: title %s, dbhosts %v, mqhosts %v", eInfo.Title, eInfo.DbHosts, eInfo.MqHosts)
 	}
 
-	consumer, err := mq.NewMessageQueue(mq.MqConf{
-		Flag:  mq.KAFKA,
-		Topic: title,
-		Hosts: mqhosts,
-	})
+	parser, timestamp, err := newParser(eInfo)
 	if err != nil {
 		return nil, err
 	}
-	saver, err := saver.NewSaver(saver.SaverConf{
-		Flag:  saver.ElasticSearch,
-		Index: title,
-		Hosts: dbhosts,
-	})
+	consumer, err := mq.NewMessageQueue(mqConf(eInfo))
+	if err != nil {
+		return nil, err
+	}
+	saver, err := saver.NewSaver(saverConf(eInfo))
 	if err != nil {
 		consumer.Close()
 		return nil, err
 	}
+	deadLetter, err := deadletter.New(deadLetterConf(eInfo))
+	if err != nil {
+		consumer.Close()
+		saver.Close()
+		return nil, err
+	}
 
 	return &manager{
-		topic:    title,
-		consumer: consumer,
-		saver:    saver,
+		topic:      eInfo.Title,
+		info:       eInfo,
+		consumer:   consumer,
+		parser:     parser,
+		timestamp:  timestamp,
+		saver:      saver,
+		deadLetter: deadLetter,
+		done:       make(chan struct{}),
+		closing:    make(chan struct{}),
 	}, nil
 }
 
+// mqConf 生成消息队列的配置
+func mqConf(eInfo conf.EtcdInfo) mq.MqConf {
+	return mq.MqConf{
+		Flag:          mq.KAFKA,
+		Topic:         eInfo.Title,
+		Hosts:         eInfo.MqHosts,
+		Group:         eInfo.Group,
+		InitialOffset: eInfo.InitialOffset,
+		InstanceId:    eInfo.InstanceId,
+		Security:      securityConf(eInfo),
+	}
+}
+
+// securityConf 生成kafka的加密和认证配置, etcd中没有配置时使用本地配置
+func securityConf(eInfo conf.EtcdInfo) mq.SecurityConf {
+	k := conf.KafkaConfigs
+	if eInfo.Kafka != nil {
+		k = *eInfo.Kafka
+	}
+	return mq.SecurityConf{
+		TLS: mq.TLSConf{
+			Enable:             k.TLS.Enable,
+			CA:                 k.TLS.CA,
+			Cert:               k.TLS.Cert,
+			Key:                k.TLS.Key,
+			InsecureSkipVerify: k.TLS.InsecureSkipVerify,
+		},
+		SASL: mq.SASLConf{
+			Mechanism:    k.SASL.Mechanism,
+			User:         k.SASL.User,
+			Password:     k.SASL.Password,
+			PasswordFile: k.SASL.PasswordFile,
+		},
+	}
+}
+
+// newParser 根据配置生成解析器和事件时间的提取器
+func newParser(eInfo conf.EtcdInfo) (*parser.Parser, *parser.Timestamp, error) {
+	confs := []parser.Conf{}
+	for _, p := range eInfo.Parsers {
+		confs = append(confs, parser.Conf{
+			Flag:     parser.Flag(p.Type),
+			Field:    p.Field,
+			Target:   p.Target,
+			Pattern:  p.Pattern,
+			Patterns: p.Patterns,
+		})
+	}
+	p, err := parser.NewParser(confs)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	ts, err := parser.NewTimestamp(parser.TimestampConf{
+		Field:    eInfo.Timestamp.Field,
+		Layouts:  eInfo.Timestamp.Layouts,
+		Timezone: eInfo.Timestamp.Timezone,
+		Fallback: eInfo.Timestamp.Fallback,
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return p, ts, nil
+}
+
+// saverConf 生成存储器的配置
+func saverConf(eInfo conf.EtcdInfo) saver.SaverConf {
+	return saver.SaverConf{
+		Flag:  saver.ElasticSearch,
+		Title: eInfo.Title,
+		Index: eInfo.Index,
+		Hosts: eInfo.DbHosts,
+		Bulk: saver.BulkConf{
+			Actions:  eInfo.Bulk.Actions,
+			Size:     eInfo.Bulk.Size,
+			Interval: time.Duration(eInfo.Bulk.Interval) * time.Millisecond,
+		},
+	}
+}
+
+// deadLetterConf 生成死信的配置
+func deadLetterConf(eInfo conf.EtcdInfo) deadletter.Conf {
+	return deadletter.Conf{
+		Title:    eInfo.Title,
+		Topic:    eInfo.DeadLetter.Topic,
+		Hosts:    eInfo.MqHosts,
+		Security: securityConf(eInfo),
+		Dir:      eInfo.DeadLetter.Dir,
+		MaxSize:  eInfo.DeadLetter.MaxSize,
+		MaxFiles: eInfo.DeadLetter.MaxFiles,
+	}
+}
+
 func InitManagers() {
+	managersLk.Lock()
+	defer managersLk.Unlock()
+
 	logManagers = map[string]*manager{}
 	for _, eInfo := range conf.EtcdInfos {
-		m, err := newManager(eInfo.Title, eInfo.DbHosts, eInfo.MqHosts)
+		m, err := newManager(eInfo)
 		if err != nil {
 			logrus.Error("new manager error: ", err)
+			setFailed(eInfo.Title, err)
 			continue
 		}
 		logManagers[eInfo.Title] = m
@@ -64,6 +219,9 @@ func InitManagers() {
 }
 
 func UpdateManagers() {
+	managersLk.Lock()
+	defer managersLk.Unlock()
+
 	// 转换为map
 	m := map[string]bool{}
 	for i := range conf.EtcdInfos {
@@ -72,25 +230,28 @@ func UpdateManagers() {
 	// 删除旧数据
 	for i := range logManagers {
 		if !m[i] {
-			logManagers[i].consumer.Close()
-			logManagers[i].saver.Close()
+			logManagers[i].close()
 			delete(logManagers, i)
+			metrics.Delete(i)
 		}
 	}
+	failedManagers = map[string]ManagerStatus{}
 	// 更新数据
 	for _, eInfo := range conf.EtcdInfos {
 		if eInfo.Title == "" || len(eInfo.DbHosts) == 0 || len(eInfo.MqHosts) == 0 {
 			logrus.Errorf("Wrong etcd info: %v, manager exit.", eInfo)
 			delete(logManagers, eInfo.Title)
+			setFailed(eInfo.Title, fmt.Errorf("Wrong parameters: title %s, dbhosts %v, mqhosts %v", eInfo.Title, eInfo.DbHosts, eInfo.MqHosts))
 			continue
 		}
 
 		var err error
 		manager := logManagers[eInfo.Title]
 		if manager == nil {
-			manager, err = newManager(eInfo.Title, eInfo.DbHosts, eInfo.MqHosts)
+			manager, err = newManager(eInfo)
 			if err != nil {
 				logrus.Error("Create new manager error: ", err)
+				setFailed(eInfo.Title, err)
 			} else {
 				logManagers[eInfo.Title] = manager
 				go manager.work()
@@ -98,16 +259,108 @@ func UpdateManagers() {
 			continue
 		}
 
-		err = manager.update(eInfo.Title, eInfo.DbHosts, eInfo.MqHosts)
+		err = manager.update(eInfo)
 		if err != nil {
 			logrus.Error("Update manager err: ", err)
 			delete(logManagers, eInfo.Title)
+			setFailed(eInfo.Title, err)
 		}
 	}
 	return
 }
 
+// setFailed 记录创建或者更新失败的管道
+func setFailed(title string, err error) {
+	failedManagers[title] = ManagerStatus{
+		Title:     title,
+		State:     StateFailed,
+		LastError: err.Error(),
+	}
+}
+
+// Status 全部管道的状态, 包括创建或者更新失败的管道, 按照名称排序
+func Status() []ManagerStatus {
+	managersLk.RLock()
+	defer managersLk.RUnlock()
+
+	list := []ManagerStatus{}
+	for _, m := range logManagers {
+		list = append(list, m.status())
+	}
+	for _, st := range failedManagers {
+		list = append(list, st)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Title < list[j].Title
+	})
+	return list
+}
+
+// Managers 全部管道的配置和状态, 按照名称排序
+// 配置中的kafka密码不会返回
+func Managers() []ManagerInfo {
+	managersLk.RLock()
+	defer managersLk.RUnlock()
+
+	list := []ManagerInfo{}
+	for _, m := range logManagers {
+		info := m.info
+		if info.Kafka != nil && info.Kafka.SASL.Password != "" {
+			k := *info.Kafka
+			k.SASL.Password = "******"
+			info.Kafka = &k
+		}
+		list = append(list, ManagerInfo{
+			Config: info,
+			Status: m.status(),
+		})
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Config.Title < list[j].Config.Title
+	})
+	return list
+}
+
+// Pause 暂停管道的消费, 配置更新后依然保持暂停, 服务重启后恢复
+// 已经消费的消息会继续存储
+func Pause(title string) error {
+	managersLk.Lock()
+	defer managersLk.Unlock()
+	m := logManagers[title]
+	if m == nil {
+		return ErrManagerNotFound
+	}
+	m.consumer.Pause()
+	return nil
+}
+
+// Resume 恢复管道的消费
+func Resume(title string) error {
+	managersLk.Lock()
+	defer managersLk.Unlock()
+	m := logManagers[title]
+	if m == nil {
+		return ErrManagerNotFound
+	}
+	return m.consumer.Resume()
+}
+
+// Reread 从指定的位置重新消费管道的分区
+// 只能重置本实例在重新加入消费者组后分配到的分区
+func Reread(title string, partition int32, offset int64) error {
+	managersLk.Lock()
+	defer managersLk.Unlock()
+	m := logManagers[title]
+	if m == nil {
+		return ErrManagerNotFound
+	}
+	return m.consumer.Reread(partition, offset)
+}
+
 func CloseManagers() {
+	managersLk.Lock()
+	defer managersLk.Unlock()
+
 	for _, m := range logManagers {
 		m.close()
 	}
@@ -115,49 +368,161 @@ func CloseManagers() {
 }
 
 func (m *manager) work() {
+	defer close(m.done)
 	for {
 		message, err := m.consumer.Consume()
 		if err != nil {
 			logrus.Errorf("consume messages from mq error: %s, exit.", err.Error())
 			return
 		}
+		metrics.MessagesConsumed.WithLabelValues(m.topic).Inc()
 
-		err = m.saver.Insert(message)
+		// 解析消息, 解析出的字段作为文档的字段存储, 然后提取事件时间, 最后写入存储时间
+		doc := saver.NewDocument(message.Value)
+		if doc != nil {
+			m.lk.RLock()
+			m.parser.Parse(doc)
+			m.timestamp.Extract(doc)
+			m.lk.RUnlock()
+			saver.SetIngestTime(doc)
+		}
+
+		// 存储器批量写入, 写入结果通过回调返回
+		// 只有存储器确认后才提交偏移量, 存储器关闭时没有写入的消息会被重新消费
+		start := time.Now()
+		err = m.saver.Insert(doc, func(err error) {
+			if err == saver.ErrClosed {
+				return
+			}
+			metrics.SaveLatency.WithLabelValues(m.topic).Observe(time.Since(start).Seconds())
+			if err != nil {
+				metrics.DocumentsFailed.WithLabelValues(m.topic).Inc()
+				// 文档本身的错误, 重试也无法存储, 写入死信
+				logrus.Errorf("Save error: %s, partition: %d, offset: %d, message: %s", err.Error(), message.Partition, message.Offset, message.Value)
+				ok := m.writeDeadLetter(&deadletter.Letter{
+					Title:     m.topic,
+					Topic:     message.Topic,
+					Partition: message.Partition,
+					Offset:    message.Offset,
+					Error:     err.Error(),
+					Payload:   message.Value,
+				})
+				if !ok {
+					// 管道已经关闭, 不提交偏移量, 重新加入消费者组后重新消费
+					return
+				}
+			} else {
+				metrics.DocumentsSaved.WithLabelValues(m.topic).Inc()
+			}
+			message.Ack()
+		})
 		if err != nil {
-			logrus.Errorf("Save error: %s, message: %s, wait one second.", err.Error(), message)
-			time.Sleep(time.Second)
+			logrus.Errorf("Insert message to saver error: %s, exit.", err.Error())
+			return
+		}
+	}
+}
+
+// writeDeadLetter 写入死信, 失败时按照退避时间一直重试, 直到写入成功或者管道被关闭
+// 重试期间存储器的回调被阻塞, 存储器不再接收新的文档, 不会继续消费之后永远无法提交的消息
+func (m *manager) writeDeadLetter(l *deadletter.Letter) bool {
+	backoff := deadLetterBackoffMin
+	for {
+		err := m.deadLetter.Write(l)
+		if err == nil {
+			return true
+		}
+		logrus.Errorf("Write dead letter error: %s, partition: %d, offset: %d, retry after %v", err.Error(), l.Partition, l.Offset, backoff)
+		select {
+		case <-m.closing:
+			return false
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if backoff > deadLetterBackoffMax {
+			backoff = deadLetterBackoffMax
 		}
 	}
 }
 
-func (m *manager) update(title string, dbhosts []string, mqhosts []string) error {
+func (m *manager) update(eInfo conf.EtcdInfo) error {
 	if m.consumer == nil || m.saver == nil {
 		return fmt.Errorf("Manager must implement consumer and saver.")
 	}
+	// 任何一步失败都释放全部资源, 由调用者标记为失败的管道
+	// 更新解析器
+	parser, timestamp, err := newParser(eInfo)
+	if err != nil {
+		m.close()
+		return err
+	}
+	m.lk.Lock()
+	m.parser = parser
+	m.timestamp = timestamp
+	m.lk.Unlock()
+
 	// 更新消费者
-	err := m.consumer.Update(mq.MqConf{
-		Flag:  mq.KAFKA,
-		Topic: title,
-		Hosts: mqhosts,
-	})
+	err = m.consumer.Update(mqConf(eInfo))
 	if err != nil {
+		m.close()
 		return err
 	}
 	// 更新存储器
-	err = m.saver.Update(saver.SaverConf{
-		Flag:  saver.ElasticSearch,
-		Index: title,
-		Hosts: dbhosts,
-	})
+	err = m.saver.Update(saverConf(eInfo))
+	if err != nil {
+		m.close()
+		return err
+	}
+	// 更新死信
+	err = m.deadLetter.Update(deadLetterConf(eInfo))
 	if err != nil {
-		m.consumer.Close()
+		m.close()
 		return err
 	}
+	m.info = eInfo
 
 	return nil
 }
 
+// status 管道的状态, 存储设备不可用时优先显示存储设备的错误
+func (m *manager) status() ManagerStatus {
+	st := ManagerStatus{
+		Title:    m.topic,
+		State:    StateRunning,
+		Consumer: m.consumer.Status(),
+		Saver:    m.saver.Status(),
+	}
+	st.LastError = st.Consumer.LastError
+	if !st.Consumer.Connected {
+		st.State = StateDisconnected
+	}
+	if !st.Saver.Reachable {
+		st.State = StateUnreachable
+		st.LastError = st.Saver.LastError
+	}
+	if st.Consumer.Paused {
+		st.State = StatePaused
+	}
+	return st
+}
+
+// close 停止消费协程并且释放资源
+// 先关闭消费者和存储器让消费协程退出, 存储器关闭前的写入结果可能写入死信, 最后关闭死信
+// 正在重试的死信不再写入, 对应的消息没有确认, 会被重新消费
 func (m *manager) close() {
+	close(m.closing)
 	m.consumer.Close()
 	m.saver.Close()
+	<-m.done
+	m.deadLetter.Close()
+}
+
+// ReplayDeadLetters 将管道的死信重新写入原来的topic, 返回重放的死信数量
+func ReplayDeadLetters(title string) (int, error) {
+	for _, eInfo := range conf.EtcdInfos {
+		if eInfo.Title == title {
+			return deadletter.Replay(deadLetterConf(eInfo))
+		}
+	}
+	return 0, fmt.Errorf("Pipeline %s not found", title)
 }
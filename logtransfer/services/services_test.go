@@ -0,0 +1,199 @@
+package services
+
+import (
+	"io/ioutil"
+	"logtransfer/conf"
+	"logtransfer/deadletter"
+	"logtransfer/saver"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+)
+
+// newTestBroker kafka的模拟服务, 加入消费者组总是失败, 消费者组会一直重试
+func newTestBroker(t *testing.T, topic string) *sarama.MockBroker {
+	broker := sarama.NewMockBroker(t, 1)
+	broker.SetHandlerByMap(map[string]sarama.MockResponse{
+		"MetadataRequest": sarama.NewMockMetadataResponse(t).
+			SetBroker(broker.Addr(), broker.BrokerID()).
+			SetLeader(topic, 0, broker.BrokerID()),
+		"FindCoordinatorRequest": sarama.NewMockFindCoordinatorResponse(t).
+			SetCoordinator(sarama.CoordinatorGroup, "logtransfer", broker),
+		"JoinGroupRequest": sarama.NewMockJoinGroupResponse(t).
+			SetError(sarama.ErrGroupAuthorizationFailed),
+	})
+	return broker
+}
+
+// newTestElastic elasticsearch的模拟服务, 只用于创建客户端
+func newTestElastic() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"version":{"number":"7.10.0"}}`))
+	}))
+}
+
+// TestUpdateFailed 任何一步更新失败都要停止消费协程并且释放消费者、存储器和死信
+func TestUpdateFailed(t *testing.T) {
+	broker := newTestBroker(t, "test")
+	defer broker.Close()
+	es := newTestElastic()
+	defer es.Close()
+
+	base := conf.EtcdInfo{
+		Title:   "test",
+		MqHosts: []string{broker.Addr()},
+		DbHosts: []string{es.URL},
+		Group:   "logtransfer",
+	}
+	base.DeadLetter.Dir = t.TempDir()
+
+	tests := []struct {
+		name   string
+		update func(eInfo *conf.EtcdInfo)
+	}{
+		{"parser", func(eInfo *conf.EtcdInfo) {
+			eInfo.Parsers = []conf.ParserInfo{{Type: "unknown"}}
+		}},
+		{"consumer", func(eInfo *conf.EtcdInfo) {
+			eInfo.InitialOffset = "yesterday"
+		}},
+		{"saver", func(eInfo *conf.EtcdInfo) {
+			eInfo.Index = "{unknown}"
+		}},
+		{"deadletter", func(eInfo *conf.EtcdInfo) {
+			eInfo.Title = ""
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, err := newManager(base)
+			if err != nil {
+				t.Fatal(err)
+			}
+			go m.work()
+
+			eInfo := base
+			tt.update(&eInfo)
+			if err := m.update(eInfo); err == nil {
+				t.Fatal("update should fail")
+			}
+
+			select {
+			case <-m.done:
+			case <-time.After(10 * time.Second):
+				t.Fatal("work goroutine is still running")
+			}
+			if _, err := m.consumer.Consume(); err == nil {
+				t.Error("consumer should be closed")
+			}
+			if err := m.saver.Insert(saver.Document{"msg": "test"}, func(error) {}); err != saver.ErrClosed {
+				t.Errorf("saver should be closed, got %v", err)
+			}
+		})
+	}
+}
+
+// TestPauseStatus 暂停和恢复消费时可以同时查询状态
+func TestPauseStatus(t *testing.T) {
+	broker := newTestBroker(t, "test")
+	defer broker.Close()
+	es := newTestElastic()
+	defer es.Close()
+
+	eInfo := conf.EtcdInfo{
+		Title:   "test",
+		MqHosts: []string{broker.Addr()},
+		DbHosts: []string{es.URL},
+		Group:   "logtransfer",
+	}
+	eInfo.DeadLetter.Dir = t.TempDir()
+	m, err := newManager(eInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go m.work()
+	defer m.close()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			m.status()
+		}
+	}()
+	m.consumer.Pause()
+	if st := m.status(); st.State != StatePaused {
+		t.Errorf("got state %s, want %s", st.State, StatePaused)
+	}
+	if err := m.consumer.Resume(); err != nil {
+		t.Fatal(err)
+	}
+	<-done
+	if st := m.status(); st.State == StatePaused {
+		t.Errorf("got state %s after resume", st.State)
+	}
+}
+
+// TestDeadLetterRetry 死信写入失败时一直重试, 写入成功后才返回, 管道关闭时停止重试
+func TestDeadLetterRetry(t *testing.T) {
+	dir := t.TempDir()
+	// 死信目录是一个文件, 写入失败
+	blocker := filepath.Join(dir, "deadletter")
+	if err := ioutil.WriteFile(blocker, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	dl, err := deadletter.New(deadletter.Conf{Title: "test", Dir: blocker})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dl.Close()
+	m := &manager{deadLetter: dl, closing: make(chan struct{})}
+
+	written := make(chan bool, 1)
+	go func() { written <- m.writeDeadLetter(&deadletter.Letter{Payload: "test"}) }()
+	select {
+	case <-written:
+		t.Fatal("dead letter should be retried")
+	case <-time.After(300 * time.Millisecond):
+	}
+
+	// 问题修复后写入成功
+	if err := os.Remove(blocker); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case ok := <-written:
+		if !ok {
+			t.Error("dead letter should be written")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("dead letter is still retrying")
+	}
+	if _, err := os.Stat(filepath.Join(blocker, "test.log")); err != nil {
+		t.Errorf("dead letter file: %v", err)
+	}
+
+	// 管道关闭时停止重试
+	if err := os.RemoveAll(blocker); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(blocker, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	go func() { written <- m.writeDeadLetter(&deadletter.Letter{Payload: "test"}) }()
+	close(m.closing)
+	select {
+	case ok := <-written:
+		if ok {
+			t.Error("dead letter should not be written")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("dead letter is still retrying after close")
+	}
+}
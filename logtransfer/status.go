@@ -0,0 +1,48 @@
+package main
+
+import (
+	"logtransfer/conf"
+	"logtransfer/services"
+	"logtransfer/utils"
+	"os"
+	"time"
+)
+
+// version 版本号, 编译时通过`-ldflags "-X main.version=x.y.z"`设置
+var version = "dev"
+
+var startTime = time.Now()
+
+// errorRecorder 最近的错误日志, 写入实例状态
+var errorRecorder = utils.NewErrorRecorder(20)
+
+// instanceStatus 注册到etcd中的实例状态
+type instanceStatus struct {
+	Service    string                   `json:"service"`
+	Version    string                   `json:"version"`
+	StartTime  time.Time                `json:"start_time"`
+	UpdateTime time.Time                `json:"update_time"`
+	Node       string                   `json:"node"`        // 节点标识
+	NodeSource string                   `json:"node_source"` // 节点标识的来源
+	Hostname   string                   `json:"hostname"`
+	Http       string                   `json:"http"`    // http服务的监听地址
+	Sources    []services.ManagerStatus `json:"sources"` // 管道的状态以及分区的消费进度
+	Errors     []utils.ErrorEntry       `json:"errors"`  // 最近的错误日志
+}
+
+// currentStatus 生成当前的实例状态
+func currentStatus() interface{} {
+	hostname, _ := os.Hostname()
+	return instanceStatus{
+		Service:    "logtransfer",
+		Version:    version,
+		StartTime:  startTime,
+		UpdateTime: time.Now(),
+		Node:       conf.Configs.NodeId,
+		NodeSource: conf.Configs.NodeSource,
+		Hostname:   hostname,
+		Http:       conf.HttpConfigs.Listen,
+		Sources:    services.Status(),
+		Errors:     errorRecorder.Recent(),
+	}
+}
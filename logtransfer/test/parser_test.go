@@ -0,0 +1,121 @@
+package test
+
+import (
+	"logtransfer/parser"
+	"testing"
+)
+
+func TestParser(t *testing.T) {
+	p, err := parser.NewParser([]parser.Conf{
+		{Flag: parser.GROK, Pattern: "%{NGINXACCESS}"},
+		{Flag: parser.LOGFMT, Field: "extra", Target: "kv"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	doc := map[string]interface{}{
+		"msg":   `10.1.3.10 - - [19/Apr/2021:10:00:00 +0800] "GET /index.html HTTP/1.1" 200 612 "-" "curl/7.68.0"`,
+		"extra": `level=info msg="request done" cached`,
+	}
+	p.Parse(doc)
+	if doc[parser.ErrorField] != nil {
+		t.Fatal(doc[parser.ErrorField])
+	}
+	if doc["remote_addr"] != "10.1.3.10" || doc["method"] != "GET" || doc["request"] != "/index.html" {
+		t.Errorf("wrong nginx fields: %v", doc)
+	}
+	if doc["status"] != int64(200) || doc["body_bytes_sent"] != int64(612) {
+		t.Errorf("wrong nginx numbers: %v", doc)
+	}
+	kv, ok := doc["kv"].(map[string]interface{})
+	if !ok || kv["level"] != "info" || kv["msg"] != "request done" || kv["cached"] != true {
+		t.Errorf("wrong logfmt fields: %v", doc["kv"])
+	}
+
+	// 不匹配时记录错误
+	doc = map[string]interface{}{"msg": "not a nginx log"}
+	p.Parse(doc)
+	if doc[parser.ErrorField] == nil {
+		t.Errorf("parse error not recorded: %v", doc)
+	}
+
+	// json和正则
+	p, err = parser.NewParser([]parser.Conf{
+		{Flag: parser.REGEX, Pattern: `^(?P<level>\w+) (?P<body>.*)$`},
+		{Flag: parser.JSON, Field: "body"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	doc = map[string]interface{}{"msg": `ERROR {"code": 500, "path": "/api"}`}
+	p.Parse(doc)
+	if doc["level"] != "ERROR" || doc["code"] != float64(500) || doc["path"] != "/api" {
+		t.Errorf("wrong regex/json fields: %v", doc)
+	}
+
+	// 解析出的同名字段不覆盖文档已有的固定字段, 文档中没有的固定字段可以写入
+	p, err = parser.NewParser([]parser.Conf{{Flag: parser.JSON}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := `{"msg": "inner", "time": 1, "path": "/api", "level": "info"}`
+	doc = map[string]interface{}{"msg": msg, "time": int64(2)}
+	p.Parse(doc)
+	if doc["msg"] != msg || doc["time"] != int64(2) || doc["path"] != "/api" || doc["level"] != "info" {
+		t.Errorf("reserved fields overwritten: %v", doc)
+	}
+
+	for _, c := range []parser.Conf{
+		{Flag: parser.GROK, Pattern: "%{NOTEXIST:x}"},
+		// 只有不命名的分组
+		{Flag: parser.REGEX, Pattern: `^(\w+) (.*)$`},
+		{Flag: parser.JSON, Target: "msg"},
+	} {
+		if _, err := parser.NewParser([]parser.Conf{c}); err == nil {
+			t.Errorf("parser %+v should fail", c)
+		}
+	}
+}
+
+func TestTimestamp(t *testing.T) {
+	ts, err := parser.NewTimestamp(parser.TimestampConf{
+		Field:    "time_local",
+		Layouts:  []string{"UNIX_MS", "02/Jan/2006:15:04:05 -0700", "2006-01-02 15:04:05"},
+		Timezone: "Asia/Shanghai",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := map[interface{}]string{
+		"19/Apr/2021:10:00:00 +0000": "2021-04-19T10:00:00.000Z",
+		"2021-04-19 10:00:00":        "2021-04-19T10:00:00.000+08:00",
+		float64(1618826400123):       "2021-04-19T18:00:00.123+08:00",
+	}
+	for value, want := range cases {
+		doc := map[string]interface{}{"time_local": value}
+		ts.Extract(doc)
+		if got := doc[parser.TimestampField]; got != want {
+			t.Errorf("extract %v: got %s, want %s", value, got, want)
+		}
+	}
+
+	// 提取失败时使用读取时间
+	doc := map[string]interface{}{"time_local": "bad", "readtime": "2021-04-19T10:00:00.5Z"}
+	ts.Extract(doc)
+	if doc[parser.TimestampField] != "2021-04-19T10:00:00.500Z" || doc[parser.ErrorField] == nil {
+		t.Errorf("wrong fallback: %v", doc)
+	}
+
+	// 没有配置字段时保留解析出的@timestamp
+	ts, err = parser.NewTimestamp(parser.TimestampConf{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	doc = map[string]interface{}{parser.TimestampField: "2021-04-19T10:00:00.000Z", "readtime": "2021-04-20T10:00:00Z"}
+	ts.Extract(doc)
+	if doc[parser.TimestampField] != "2021-04-19T10:00:00.000Z" {
+		t.Errorf("parsed timestamp overwritten: %v", doc)
+	}
+}
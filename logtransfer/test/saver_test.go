@@ -0,0 +1,175 @@
+package test
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"logtransfer/parser"
+	"logtransfer/saver"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestIngestTime 解析出的同名字段不能覆盖存储时间, 不合法的@timestamp不会作为事件时间
+func TestIngestTime(t *testing.T) {
+	p, err := parser.NewParser([]parser.Conf{{Flag: parser.JSON}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts, err := parser.NewTimestamp(parser.TimestampConf{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now().UnixNano() / int64(time.Millisecond)
+	doc := saver.NewDocument(`{"time": 1, "ingest_time": 2, "@timestamp": "bogus", "msg": "hello"}`)
+	p.Parse(doc)
+	ts.Extract(doc)
+	saver.SetIngestTime(doc)
+
+	ingest, ok := doc[saver.IngestField].(int64)
+	if !ok || ingest < start {
+		t.Errorf("wrong ingest time: %v, start %d", doc[saver.IngestField], start)
+	}
+	if doc[parser.TimestampField] == "bogus" {
+		t.Errorf("@timestamp overwritten by parsed field: %v", doc[parser.TimestampField])
+	}
+	// 消息内容是文档的固定字段, 不会被解析出的msg覆盖
+	if doc["msg"] != `{"time": 1, "ingest_time": 2, "@timestamp": "bogus", "msg": "hello"}` || doc["time"] == int64(1) {
+		t.Errorf("reserved fields overwritten: %v", doc)
+	}
+}
+
+// bulkStub 模拟es的批量写入, 记录每次请求中的文档, 按照顺序返回预设的结果
+type bulkStub struct {
+	lk       sync.Mutex
+	requests [][]string       // 每次请求中文档的msg
+	statuses map[string][]int // msg -> 每次写入返回的状态码, 用完后返回201
+	failures int              // 前几次请求整体返回429
+}
+
+func (s *bulkStub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if !strings.HasSuffix(r.URL.Path, "/_bulk") {
+		w.Write([]byte(`{"version":{"number":"7.10.0"}}`))
+		return
+	}
+
+	// 请求为ndjson, 操作和文档交替出现
+	msgs := []string{}
+	scanner := bufio.NewScanner(r.Body)
+	for i := 0; scanner.Scan(); i++ {
+		if i%2 == 0 {
+			continue
+		}
+		doc := map[string]interface{}{}
+		json.Unmarshal(scanner.Bytes(), &doc)
+		msgs = append(msgs, fmt.Sprint(doc["msg"]))
+	}
+
+	s.lk.Lock()
+	defer s.lk.Unlock()
+	s.requests = append(s.requests, msgs)
+	if s.failures > 0 {
+		s.failures--
+		w.WriteHeader(http.StatusTooManyRequests)
+		w.Write([]byte(`{"error":{"type":"es_rejected_execution_exception","reason":"rejected"},"status":429}`))
+		return
+	}
+
+	items := []string{}
+	for _, msg := range msgs {
+		status := http.StatusCreated
+		if statuses := s.statuses[msg]; len(statuses) > 0 {
+			status = statuses[0]
+			s.statuses[msg] = statuses[1:]
+		}
+		item := fmt.Sprintf(`{"index":{"_index":"log","status":%d}}`, status)
+		if status == http.StatusBadRequest {
+			item = `{"index":{"_index":"log","status":400,"error":{"type":"mapper_parsing_exception","reason":"failed to parse"}}}`
+		}
+		items = append(items, item)
+	}
+	fmt.Fprintf(w, `{"took":1,"errors":true,"items":[%s]}`, strings.Join(items, ","))
+}
+
+// TestElasticBulk 整个请求失败时全部重试, 只有429等可以重试的文档被重试, 文档本身的错误直接回调
+func TestElasticBulk(t *testing.T) {
+	stub := &bulkStub{
+		failures: 1,
+		statuses: map[string][]int{
+			"bad":  {http.StatusBadRequest},
+			"busy": {http.StatusTooManyRequests},
+		},
+	}
+	es := httptest.NewServer(stub)
+	defer es.Close()
+
+	s, err := saver.NewSaver(saver.SaverConf{
+		Flag:  saver.ElasticSearch,
+		Title: "log",
+		Hosts: []string{es.URL},
+		Bulk:  saver.BulkConf{Actions: 3, Interval: time.Hour},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	var wg sync.WaitGroup
+	var lk sync.Mutex
+	results := map[string][]error{}
+	for _, msg := range []string{"ok", "bad", "busy"} {
+		msg := msg
+		wg.Add(1)
+		err := s.Insert(saver.Document{"msg": msg}, func(err error) {
+			lk.Lock()
+			results[msg] = append(results[msg], err)
+			lk.Unlock()
+			wg.Done()
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("callbacks not called")
+	}
+
+	// 每个文档只回调一次
+	lk.Lock()
+	defer lk.Unlock()
+	if len(results["ok"]) != 1 || results["ok"][0] != nil {
+		t.Errorf("ok: got %v", results["ok"])
+	}
+	if len(results["bad"]) != 1 || results["bad"][0] == nil || !strings.Contains(results["bad"][0].Error(), "mapper_parsing_exception") {
+		t.Errorf("bad: got %v", results["bad"])
+	}
+	if len(results["busy"]) != 1 || results["busy"][0] != nil {
+		t.Errorf("busy: got %v", results["busy"])
+	}
+
+	// 第一次整体429, 全部重试; 第二次只有busy返回429, 只重试busy
+	stub.lk.Lock()
+	defer stub.lk.Unlock()
+	want := [][]string{{"ok", "bad", "busy"}, {"ok", "bad", "busy"}, {"busy"}}
+	if !reflect.DeepEqual(stub.requests, want) {
+		t.Errorf("got bulk requests %v, want %v", stub.requests, want)
+	}
+	if st := s.Status(); !st.Reachable || st.LastError == "" {
+		t.Errorf("wrong status: %+v", st)
+	}
+}
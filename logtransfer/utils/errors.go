@@ -0,0 +1,57 @@
+package utils
+
+import (
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// ErrorEntry 一条错误日志
+type ErrorEntry struct {
+	Time    time.Time `json:"time"`
+	Message string    `json:"message"`
+}
+
+// ErrorRecorder 记录最近的错误日志, 作为logrus的hook使用
+type ErrorRecorder struct {
+	lk      sync.Mutex
+	size    int
+	entries []ErrorEntry
+}
+
+// NewErrorRecorder 最多记录size条错误日志, 超过后丢弃最旧的
+func NewErrorRecorder(size int) *ErrorRecorder {
+	if size <= 0 {
+		size = 1
+	}
+	return &ErrorRecorder{size: size}
+}
+
+// Levels 只记录error及以上级别的日志
+func (r *ErrorRecorder) Levels() []logrus.Level {
+	return []logrus.Level{logrus.PanicLevel, logrus.FatalLevel, logrus.ErrorLevel}
+}
+
+// Fire 记录一条日志, 日志中的error字段追加到消息后面
+func (r *ErrorRecorder) Fire(entry *logrus.Entry) error {
+	msg := entry.Message
+	if err, ok := entry.Data[logrus.ErrorKey].(error); ok {
+		msg += ": " + err.Error()
+	}
+
+	r.lk.Lock()
+	defer r.lk.Unlock()
+	r.entries = append(r.entries, ErrorEntry{Time: entry.Time, Message: msg})
+	if len(r.entries) > r.size {
+		r.entries = append(r.entries[:0], r.entries[len(r.entries)-r.size:]...)
+	}
+	return nil
+}
+
+// Recent 最近的错误日志, 按照时间从旧到新排序
+func (r *ErrorRecorder) Recent() []ErrorEntry {
+	r.lk.Lock()
+	defer r.lk.Unlock()
+	return append([]ErrorEntry{}, r.entries...)
+}
@@ -6,11 +6,39 @@ import (
 	"strings"
 )
 
+// NetworkIps 全部网卡的ipv4地址, 多个地址以空格分隔
+func NetworkIps() (map[string]string, error) {
+	ips := make(map[string]string)
+	interfaces, err := net.Interfaces()
+	if err != nil {
+		return ips, err
+	}
+
+	for _, i := range interfaces {
+		address, err := i.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, v := range address {
+			// 去除回环地址, 只获取ipv4
+			if ipnet, ok := v.(*net.IPNet); ok && !ipnet.IP.IsLoopback() && ipnet.IP.To4() != nil {
+				ips[i.Name] += ipnet.IP.String() + " "
+			}
+		}
+	}
+
+	for k := range ips {
+		ips[k] = strings.Trim(ips[k], " ")
+	}
+	return ips, nil
+}
+
 func OutBoundIp() (string, error) {
 	conn, err := net.Dial("udp", "1.1.1.1:3000")
 	if err != nil {
 		return "", err
 	}
+	defer conn.Close()
 
 	addr := conn.LocalAddr().String()
 	ip := strings.Split(addr, ":")[0]